@@ -2,11 +2,14 @@ package auth
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"log"
 	"net/mail"
 	"sync"
 	"time"
 
+	"github.com/GCET-Open-Source-Foundation/auth/email"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/oauth2"
@@ -44,29 +47,65 @@ return 1
 /* Auth manages the internal state of the library, including database connections, */
 /* cryptographic parameters, and caching clients. It is safe for concurrent use. */
 type Auth struct {
-	Conn               *pgxpool.Pool
-	argonParams        ArgonParameters
-	pepper             string
-	pepperOnce         sync.Once
-	jwtSecret          []byte
-	jwtExpiry          time.Duration
-	otpExpiry          time.Duration
-	otpLength          int
-	jwtOnce            sync.Once
-	smtpEmail          string
-	smtpPassword       string
-	smtpHost           string
-	smtpPort           string
-	smtp_once          sync.Once
-	refreshTokenExpiry time.Duration
-	refreshTokenLength int
-	ctx                context.Context
-	cancel             context.CancelFunc
-	oauthConfig        *oauth2.Config
-	oauthOnce          sync.Once
-	redisClient        *redis.Client
-	requestGroup       singleflight.Group
-	rateLimitSHA       string
+	Conn                 *pgxpool.Pool
+	argonParams          ArgonParameters
+	pepper               string
+	pepperOnce           sync.Once
+	jwtSecret            []byte
+	jwtExpiry            time.Duration
+	otpExpiry            time.Duration
+	otpLength            int
+	otpMaxAttempts       int
+	otpMu                sync.RWMutex
+	otpPurposes          map[OTPPurpose]otpSettings
+	otpLimits            *otpLimiters
+	totpCfg              *TOTPConfig
+	mfaMu                sync.Mutex
+	mfaCfg               *MFAConfig
+	magicLink            *magicLinkSettings
+	notifierMu           sync.RWMutex
+	notifier             Notifier
+	templatesMu          sync.RWMutex
+	outboxMu             sync.Mutex
+	outboxCfg            *OutboxConfig
+	outboxOnce           sync.Once
+	outboxWake           chan struct{}
+	emailTemplates       *emailTemplates
+	jwtOnce              sync.Once
+	tokenFormat          TokenFormat
+	pasetoLocalKey       []byte
+	pasetoPrivateKey     ed25519.PrivateKey
+	pasetoPublicKey      ed25519.PublicKey
+	smtpEmail            string
+	smtpPassword         string
+	smtpHost             string
+	smtpPort             string
+	smtpClient           *email.Client
+	smtpClientFrom       string
+	smtp_once            sync.Once
+	refreshTokenExpiry   time.Duration
+	refreshTokenLength   int
+	refreshMaxSessionAge time.Duration
+	refreshRotationGrace time.Duration
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	oauthConfig          *oauth2.Config
+	oauthOnce            sync.Once
+	redisClient          *redis.Client
+	requestGroup         singleflight.Group
+	rateLimitSHA         string
+	dpopMu               sync.Mutex
+	dpopMaxAge           time.Duration
+	dpopClockSkew        time.Duration
+	dpopSeen             map[string]time.Time
+	dpopLastPrune        time.Time
+	eventMu              sync.RWMutex
+	eventHandler         func(SecurityEvent)
+	janitorMu            sync.Mutex
+	janitorRunMu         sync.Mutex
+	janitorCfg           *JanitorConfig
+	janitorStats         JanitorStats
+	janitorReset         chan struct{}
 }
 
 /*
@@ -76,10 +115,11 @@ non-database functions like password hashing.
 */
 func NewBareAuth() *Auth {
 	return &Auth{
-		argonParams: globalDefaultArgon,
-		jwtExpiry:   24 * time.Hour,
-		otpExpiry:   5 * time.Minute,
-		otpLength:   6,
+		argonParams:    globalDefaultArgon,
+		jwtExpiry:      24 * time.Hour,
+		otpExpiry:      5 * time.Minute,
+		otpLength:      6,
+		otpMaxAttempts: 5,
 	}
 }
 
@@ -114,21 +154,22 @@ func Init(ctx context.Context, port uint16, dbUser, dbPass, dbName, host string)
 
 	/* No errors in init */
 	temp := &Auth{
-		Conn:        pool,
-		argonParams: globalDefaultArgon,
-		jwtExpiry:   24 * time.Hour,
-		otpExpiry:   5 * time.Minute,
-		otpLength:   6,
-		ctx:         libCtx,
-		cancel:      libCancel,
+		Conn:           pool,
+		argonParams:    globalDefaultArgon,
+		jwtExpiry:      24 * time.Hour,
+		otpExpiry:      5 * time.Minute,
+		otpLength:      6,
+		otpMaxAttempts: 5,
+		ctx:            libCtx,
+		cancel:         libCancel,
 	}
 
 	if err := temp.checkTables(ctx); err != nil {
 		pool.Close()
 		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
 	}
-	/* start the background OTP cleaner */
-	temp.startOTPCleanup()
+	/* start the background janitor (expired OTPs, refresh tokens, deny-list) */
+	temp.startJanitor()
 
 	return temp, nil
 }
@@ -155,9 +196,36 @@ func (a *Auth) SMTPInit(email, password, host, port string) error {
 	return nil
 }
 
+/*
+SMTPClientInit is SMTPInit with full control over the connection: implicit
+TLS or a STARTTLS policy, a private CA, the AUTH mechanism and timeouts.
+from is the sender address, optionally with a display name such as
+"Example <noreply@example.com>". It takes precedence over SMTPInit.
+*/
+func (a *Auth) SMTPClientInit(from string, cfg email.Config) error {
+	if from == "" {
+		return ErrEmptyInput
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return ErrInvalidEmail
+	}
+	client, err := email.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+
+	a.notifierMu.Lock()
+	a.smtpClient = client
+	a.smtpClientFrom = from
+	a.notifierMu.Unlock()
+	return nil
+}
+
 /*
 RedisInit initializes the Redis client for caching and rate limiting.
-It verifies the connection by sending a Ping.
+It verifies the connection by sending a Ping. On first use with a database
+that was populated by an older version, it deletes the cache entries that
+held raw refresh tokens.
 */
 func (a *Auth) RedisInit(addr, password string, db int) error {
 	if addr == "" {
@@ -183,6 +251,11 @@ func (a *Auth) RedisInit(addr, password string, db int) error {
 
 	a.redisClient = client
 	a.rateLimitSHA = sha
+
+	if err := a.purgeLegacyRefreshCache(); err != nil {
+		/* Not fatal: the stale entries are never read and expire on their own */
+		log.Printf("failed to purge legacy refresh token cache entries: %v", err)
+	}
 	return nil
 }
 
@@ -191,9 +264,13 @@ Close performs a graceful shutdown of the Auth library.
 It stops background tasks, closes database Connections, and wipes sensitive data from memory.
 */
 func (a *Auth) Close() {
-	/* 1. Stop background routines (OTP cleaner) */
+	/* 1. Stop background routines (janitor) */
 	if a.cancel != nil {
-		a.cancel() /* This sends the signal to otp.go to stop!*/
+		a.cancel() /* This sends the signal to janitor.go to stop!*/
+	}
+
+	if a.otpLimits != nil {
+		a.otpLimits.stop()
 	}
 
 	/* 2. Close Database Connection */
@@ -203,19 +280,39 @@ func (a *Auth) Close() {
 	}
 
 	/* 3. Wipe Sensitive Memory (Security Best Practice) */
-	/* Overwrite JWT secret with zeros */
+	/* Overwrite JWT secret and PASETO keys with zeros */
 	if len(a.jwtSecret) > 0 {
 		for i := range a.jwtSecret {
 			a.jwtSecret[i] = 0
 		}
 		a.jwtSecret = nil
 	}
+	for i := range a.pasetoLocalKey {
+		a.pasetoLocalKey[i] = 0
+	}
+	a.pasetoLocalKey = nil
+	for i := range a.pasetoPrivateKey {
+		a.pasetoPrivateKey[i] = 0
+	}
+	a.pasetoPrivateKey = nil
+	if a.totpCfg != nil {
+		for i := range a.totpCfg.EncryptionKey {
+			a.totpCfg.EncryptionKey[i] = 0
+		}
+		a.totpCfg = nil
+	}
 
 	/* Clear string secrets (Go strings are immutable, but we can unassign them) */
 	/* Note: This is best-effort since GC handles actual string memory */
 	a.smtpPassword = ""
 	a.pepper = ""
 	a.oauthConfig = nil
+	if a.magicLink != nil {
+		for i := range a.magicLink.key {
+			a.magicLink.key[i] = 0
+		}
+		a.magicLink = nil
+	}
 
 	/* 4. Close Redis Connection */
 	if a.redisClient != nil {
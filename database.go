@@ -31,16 +31,137 @@ func (a *Auth) checkTables(ctx context.Context) error {
 			PRIMARY KEY (user_id, spaceName, role)
 		);
 		CREATE TABLE IF NOT EXISTS otps (
-			email TEXT PRIMARY KEY, 
+			email TEXT NOT NULL, 
+			purpose TEXT NOT NULL DEFAULT 'login', 
 			code TEXT NOT NULL, 
-			expires_at TIMESTAMP NOT NULL
+			salt TEXT, 
+			attempts INTEGER NOT NULL DEFAULT 0, 
+			expires_at TIMESTAMP NOT NULL, 
+			PRIMARY KEY (email, purpose)
 		);
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT;
+		ALTER TABLE otps ADD COLUMN IF NOT EXISTS salt TEXT;
+		ALTER TABLE otps ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+		DELETE FROM otps WHERE salt IS NULL;
+		ALTER TABLE otps ADD COLUMN IF NOT EXISTS purpose TEXT NOT NULL DEFAULT 'login';
+		DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM pg_index i
+				JOIN pg_attribute att ON att.attrelid = i.indrelid AND att.attnum = ANY(i.indkey)
+				WHERE i.indrelid = 'otps'::regclass AND i.indisprimary AND att.attname = 'purpose'
+			) THEN
+				ALTER TABLE otps DROP CONSTRAINT IF EXISTS otps_pkey;
+				ALTER TABLE otps ADD PRIMARY KEY (email, purpose);
+			END IF;
+		END $$;
 		CREATE TABLE IF NOT EXISTS refresh_tokens (
 			token TEXT PRIMARY KEY, 
 			user_id TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE, 
+			session_id TEXT, 
+			dpop_jkt TEXT, 
+			device_name TEXT, 
+			user_agent TEXT, 
+			ip_address TEXT, 
 			expires_at TIMESTAMP NOT NULL, 
 			revoked BOOLEAN NOT NULL DEFAULT false, 
-			created_at TIMESTAMP NOT NULL DEFAULT NOW()
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(), 
+			last_used_at TIMESTAMP, 
+			session_started_at TIMESTAMP, 
+			revoked_at TIMESTAMP, 
+			rotated_at TIMESTAMP, 
+			successor TEXT, 
+			amr TEXT[], 
+			acr TEXT, 
+			hashed BOOLEAN NOT NULL DEFAULT false
+		);
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_id TEXT;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS dpop_jkt TEXT;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS hashed BOOLEAN NOT NULL DEFAULT false;
+		UPDATE refresh_tokens
+			SET token = encode(sha256(convert_to(token, 'UTF8')), 'hex'), hashed = true
+			WHERE hashed = false;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS device_name TEXT;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS user_agent TEXT;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS ip_address TEXT;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_started_at TIMESTAMP;
+		UPDATE refresh_tokens
+			SET session_id = md5(random()::text || token), session_started_at = created_at
+			WHERE session_id IS NULL;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMP;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS successor TEXT;
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS amr TEXT[];
+		ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS acr TEXT;
+		CREATE INDEX IF NOT EXISTS refresh_tokens_user_session ON refresh_tokens (user_id, session_id);
+		CREATE TABLE IF NOT EXISTS totp_secrets (
+			user_id TEXT PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE, 
+			secret TEXT NOT NULL, 
+			confirmed BOOLEAN NOT NULL DEFAULT false, 
+			last_step BIGINT NOT NULL DEFAULT 0, 
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(), 
+			confirmed_at TIMESTAMP, 
+			failed_attempts INTEGER NOT NULL DEFAULT 0, 
+			locked_until TIMESTAMP
+		);
+		ALTER TABLE totp_secrets ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE totp_secrets ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id BIGSERIAL PRIMARY KEY, 
+			user_id TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE, 
+			code_hash TEXT NOT NULL, 
+			salt TEXT NOT NULL, 
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(), 
+			used_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS recovery_codes_user ON recovery_codes (user_id);
+		CREATE TABLE IF NOT EXISTS mfa_challenges (
+			token TEXT PRIMARY KEY, 
+			user_id TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE, 
+			factors TEXT[] NOT NULL, 
+			amr TEXT[], 
+			device_name TEXT, 
+			user_agent TEXT, 
+			ip_address TEXT, 
+			attempts INTEGER NOT NULL DEFAULT 0, 
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(), 
+			expires_at TIMESTAMP NOT NULL
+		);
+		ALTER TABLE mfa_challenges ADD COLUMN IF NOT EXISTS amr TEXT[];
+		CREATE TABLE IF NOT EXISTS step_up_attempts (
+			user_id TEXT NOT NULL, 
+			factor TEXT NOT NULL, 
+			attempts INTEGER NOT NULL DEFAULT 0, 
+			expires_at TIMESTAMP NOT NULL, 
+			PRIMARY KEY (user_id, factor)
+		);
+		CREATE TABLE IF NOT EXISTS magic_links (
+			token TEXT PRIMARY KEY, 
+			email TEXT NOT NULL, 
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(), 
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS email_outbox (
+			id BIGSERIAL PRIMARY KEY, 
+			kind TEXT NOT NULL, 
+			recipient TEXT NOT NULL, 
+			message JSONB, 
+			status TEXT NOT NULL DEFAULT 'pending', 
+			attempts INTEGER NOT NULL DEFAULT 0, 
+			last_error TEXT, 
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(), 
+			next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(), 
+			expires_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS email_outbox_due ON email_outbox (next_attempt_at) WHERE status = 'pending';
+		CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti TEXT PRIMARY KEY, 
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS token_watermarks (
+			user_id TEXT PRIMARY KEY, 
+			not_before TIMESTAMP NOT NULL
 		);
 	`
 	_, err := a.Conn.Exec(ctx, query)
@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Confirmation is the cnf claim of RFC 7800. For DPoP-bound tokens JKT holds the
+base64url SHA-256 JWK thumbprint of the client's public key (RFC 9449 section 6).
+*/
+type Confirmation struct {
+	JKT string `json:"jkt,omitempty"`
+}
+
+/*
+DPoPConfig controls how DPoP proofs are accepted.
+MaxAge is how old a proof's iat may be (default 1 minute).
+ClockSkew is how far in the future iat may be, to tolerate client clocks (default 5 seconds).
+Seen jti values are remembered for MaxAge + ClockSkew to reject replays.
+*/
+type DPoPConfig struct {
+	MaxAge    time.Duration
+	ClockSkew time.Duration
+}
+
+/* dpopAlgorithms are the asymmetric JWS algorithms accepted for proofs. */
+var dpopAlgorithms = []string{"ES256", "ES384", "EdDSA", "RS256", "PS256"}
+
+/*
+DPoPInit configures DPoP proof validation. It is optional;
+without it the defaults described on DPoPConfig apply.
+*/
+func (a *Auth) DPoPInit(cfg DPoPConfig) error {
+	if cfg.MaxAge < 0 || cfg.ClockSkew < 0 {
+		return fmt.Errorf("%w: DPoP durations cannot be negative", ErrInvalidInput)
+	}
+
+	a.dpopMu.Lock()
+	defer a.dpopMu.Unlock()
+	a.dpopMaxAge = cfg.MaxAge
+	a.dpopClockSkew = cfg.ClockSkew
+	return nil
+}
+
+/*
+ValidateDPoPProof checks a DPoP proof JWT (the value of the DPoP request header)
+against the request it arrived with and returns the JWK thumbprint of the key
+that signed it.
+
+method and requestURL are the HTTP method and full URL of the request; the
+query and fragment are ignored as RFC 9449 requires. accessToken is the token
+presented alongside the proof, whose hash must match the ath claim; pass an
+empty string at the token endpoint, where no access token is sent.
+*/
+func (a *Auth) ValidateDPoPProof(proof, method, requestURL, accessToken string) (string, error) {
+	if proof == "" || method == "" || requestURL == "" {
+		return "", ErrEmptyInput
+	}
+
+	var jkt string
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, errors.New("typ must be dpop+jwt")
+		}
+		jwk, ok := token.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("missing jwk header")
+		}
+		key, thumbprint, err := parseJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+		jkt = thumbprint
+		return key, nil
+	}, jwt.WithValidMethods(dpopAlgorithms))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+
+	if htm, _ := claims["htm"].(string); htm != method {
+		return "", fmt.Errorf("%w: htm does not match request method", ErrInvalidDPoPProof)
+	}
+
+	htu, _ := claims["htu"].(string)
+	if !sameDPoPURL(htu, requestURL) {
+		return "", fmt.Errorf("%w: htu does not match request URL", ErrInvalidDPoPProof)
+	}
+
+	maxAge, skew := a.dpopWindow()
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil {
+		return "", fmt.Errorf("%w: missing iat", ErrInvalidDPoPProof)
+	}
+	now := time.Now()
+	if iat.Time.Before(now.Add(-maxAge)) || iat.Time.After(now.Add(skew)) {
+		return "", fmt.Errorf("%w: iat outside the acceptable window", ErrInvalidDPoPProof)
+	}
+
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("%w: ath does not match access token", ErrInvalidDPoPProof)
+		}
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", fmt.Errorf("%w: missing jti", ErrInvalidDPoPProof)
+	}
+	if err := a.rememberDPoPProof(jkt+":"+jti, maxAge+skew); err != nil {
+		return "", err
+	}
+
+	return jkt, nil
+}
+
+/*
+ValidateDPoPToken validates a DPoP-bound access token together with its proof.
+The token must carry a cnf.jkt claim matching the key that signed the proof.
+Resource servers accepting DPoP tokens must call this: ValidateToken refuses
+bound tokens with ErrDPoPProofRequired.
+*/
+func (a *Auth) ValidateDPoPToken(accessToken, proof, method, requestURL string) (*JWTClaims, error) {
+	claims, err := a.validateAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Confirmation == nil || claims.Confirmation.JKT == "" {
+		return nil, fmt.Errorf("%w: access token is not DPoP-bound", ErrInvalidDPoPProof)
+	}
+
+	jkt, err := a.ValidateDPoPProof(proof, method, requestURL, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if jkt != claims.Confirmation.JKT {
+		return nil, fmt.Errorf("%w: proof key does not match token binding", ErrInvalidDPoPProof)
+	}
+
+	return claims, nil
+}
+
+/*
+IssueDPoPTokenPair works like IssueTokenPair but binds both tokens to the key
+identified by jkt, usually the thumbprint returned by ValidateDPoPProof at the
+token endpoint. The access token carries cnf.jkt and the pair's token_type is "DPoP".
+*/
+func (a *Auth) IssueDPoPTokenPair(userID, jkt string, info ...SessionInfo) (*TokenPair, error) {
+	if userID == "" || jkt == "" {
+		return nil, ErrEmptyInput
+	}
+	if !a.canSignTokens() {
+		return nil, ErrNotInitialized
+	}
+
+	seed := newSessionSeed(userID, info)
+	seed.DPoPJKT = jkt
+	rt, err := a.generateRefreshToken(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.newTokenPair(rt)
+}
+
+/*
+RefreshDPoPTokenPair rotates a DPoP-bound refresh token. jkt must be the
+thumbprint of the key that signed the proof on this refresh request; a bound
+refresh token is refused for any other key, and for plain RefreshTokenPair.
+*/
+func (a *Auth) RefreshDPoPTokenPair(refreshToken, jkt string) (*TokenPair, error) {
+	if refreshToken == "" || jkt == "" {
+		return nil, ErrEmptyInput
+	}
+	if !a.canSignTokens() {
+		return nil, ErrNotInitialized
+	}
+
+	rt, err := a.rotateRefreshToken(refreshToken, jkt)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.newTokenPair(rt)
+}
+
+/* dpopWindow returns the configured proof age limits, falling back to the defaults. */
+func (a *Auth) dpopWindow() (maxAge, skew time.Duration) {
+	a.dpopMu.Lock()
+	defer a.dpopMu.Unlock()
+
+	maxAge, skew = a.dpopMaxAge, a.dpopClockSkew
+	if maxAge == 0 {
+		maxAge = time.Minute
+	}
+	if skew == 0 {
+		skew = 5 * time.Second
+	}
+	return maxAge, skew
+}
+
+/*
+rememberDPoPProof records a proof ID and fails with ErrDPoPReplay if it was seen before.
+Redis is used when configured so replays are caught across instances;
+otherwise an in-memory cache on the Auth instance is used.
+*/
+func (a *Auth) rememberDPoPProof(id string, ttl time.Duration) error {
+	if a.redisClient != nil {
+		stored, err := a.redisClient.SetNX(a.ctx, "dpop_jti:"+id, 1, ttl).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("%w: failed to record DPoP proof: %v", ErrRedisUnavailable, err)
+		}
+		if !stored {
+			return ErrDPoPReplay
+		}
+		return nil
+	}
+
+	a.dpopMu.Lock()
+	defer a.dpopMu.Unlock()
+
+	now := time.Now()
+	if a.dpopSeen == nil {
+		a.dpopSeen = make(map[string]time.Time)
+	}
+
+	/* Prune expired entries at most once per TTL to keep this cheap */
+	if now.Sub(a.dpopLastPrune) > ttl {
+		for k, exp := range a.dpopSeen {
+			if now.After(exp) {
+				delete(a.dpopSeen, k)
+			}
+		}
+		a.dpopLastPrune = now
+	}
+
+	if exp, ok := a.dpopSeen[id]; ok && now.Before(exp) {
+		return ErrDPoPReplay
+	}
+	a.dpopSeen[id] = now.Add(ttl)
+	return nil
+}
+
+/*
+sameDPoPURL compares htu with the request URL, ignoring query and fragment,
+case in scheme and host, and default ports.
+*/
+func sameDPoPURL(htu, requestURL string) bool {
+	if htu == "" {
+		return false
+	}
+	u1, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	u2, err := url.Parse(requestURL)
+	if err != nil {
+		return false
+	}
+
+	normalize := func(u *url.URL) string {
+		scheme := strings.ToLower(u.Scheme)
+		host := strings.ToLower(u.Hostname())
+		port := u.Port()
+		if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+			port = ""
+		}
+		if port != "" {
+			host += ":" + port
+		}
+		path := u.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		return scheme + "://" + host + path
+	}
+
+	return normalize(u1) == normalize(u2)
+}
+
+/*
+parseJWK converts a public JWK from the proof header into a crypto key and
+computes its RFC 7638 thumbprint. Keys containing private material are rejected.
+*/
+func parseJWK(jwk map[string]interface{}) (interface{}, string, error) {
+	str := func(name string) string {
+		v, _ := jwk[name].(string)
+		return v
+	}
+	if str("d") != "" {
+		return nil, "", errors.New("jwk must not contain a private key")
+	}
+
+	var key interface{}
+	var members map[string]string
+
+	switch str("kty") {
+	case "EC":
+		var curve ecdh.Curve
+		var ellipticCurve elliptic.Curve
+		switch str("crv") {
+		case "P-256":
+			curve, ellipticCurve = ecdh.P256(), elliptic.P256()
+		case "P-384":
+			curve, ellipticCurve = ecdh.P384(), elliptic.P384()
+		default:
+			return nil, "", errors.New("unsupported EC curve")
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(str("x"))
+		y, errY := base64.RawURLEncoding.DecodeString(str("y"))
+		size := (ellipticCurve.Params().BitSize + 7) / 8
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, "", errors.New("malformed EC key")
+		}
+		/* Round-trip through crypto/ecdh to make sure the point is on the curve */
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := curve.NewPublicKey(point); err != nil {
+			return nil, "", errors.New("EC point is not on the curve")
+		}
+		key = &ecdsa.PublicKey{Curve: ellipticCurve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		members = map[string]string{"crv": str("crv"), "kty": "EC", "x": str("x"), "y": str("y")}
+
+	case "OKP":
+		if str("crv") != "Ed25519" {
+			return nil, "", errors.New("unsupported OKP curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(str("x"))
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", errors.New("malformed Ed25519 key")
+		}
+		key = ed25519.PublicKey(x)
+		members = map[string]string{"crv": "Ed25519", "kty": "OKP", "x": str("x")}
+
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(str("n"))
+		e, errE := base64.RawURLEncoding.DecodeString(str("e"))
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, "", errors.New("malformed RSA key")
+		}
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < 2048 {
+			return nil, "", errors.New("RSA key must be at least 2048 bits")
+		}
+		key = &rsa.PublicKey{N: modulus, E: int(new(big.Int).SetBytes(e).Int64())}
+		members = map[string]string{"e": str("e"), "kty": "RSA", "n": str("n")}
+
+	default:
+		return nil, "", errors.New("unsupported key type")
+	}
+
+	/* encoding/json sorts map keys, giving the lexicographic order RFC 7638 needs */
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(canonical)
+
+	return key, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,347 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+/* TLSMode selects how the connection to the SMTP server is secured. */
+type TLSMode int
+
+const (
+	/* STARTTLSOpportunistic upgrades with STARTTLS when the server offers it (the default) */
+	STARTTLSOpportunistic TLSMode = iota
+	/* STARTTLSRequired refuses to send unless the server offers STARTTLS */
+	STARTTLSRequired
+	/* ImplicitTLS speaks TLS from the first byte, as on port 465 */
+	ImplicitTLS
+	/* NoTLS never encrypts; only for local test servers */
+	NoTLS
+)
+
+/* AuthMechanism selects the SMTP AUTH mechanism. */
+type AuthMechanism int
+
+const (
+	/* AuthAuto picks PLAIN, LOGIN or CRAM-MD5, in that order, from what the server offers */
+	AuthAuto AuthMechanism = iota
+	AuthPlain
+	AuthLogin
+	AuthCRAMMD5
+)
+
+var (
+	ErrSTARTTLSUnavailable = errors.New("smtp server does not offer STARTTLS")
+	ErrAuthUnsupported     = errors.New("smtp server offers no supported AUTH mechanism")
+	ErrInsecureAuth        = errors.New("refusing to send smtp credentials over an unencrypted connection")
+)
+
+/*
+Config describes an SMTP server and how to talk to it.
+Username is normally the sender address; leave it empty for servers that
+need no authentication. RootCAs replaces the system pool, for servers with
+a private CA, and ServerName overrides the name checked in the certificate
+(default Host). DialTimeout bounds connecting and the TLS handshake
+(default 10 seconds); Timeout bounds the whole conversation after that
+(default 30 seconds). LocalName is sent in EHLO (default "localhost").
+DKIM, if set, signs every message the client builds.
+*/
+type Config struct {
+	Host        string
+	Port        string
+	Username    string
+	Password    string
+	TLS         TLSMode
+	RootCAs     *x509.CertPool
+	ServerName  string
+	Auth        AuthMechanism
+	DialTimeout time.Duration
+	Timeout     time.Duration
+	LocalName   string
+	DKIM        *DKIMConfig
+}
+
+/* Client sends mail through one SMTP server. It is safe for concurrent use. */
+type Client struct {
+	cfg  Config
+	dkim *DKIMSigner
+}
+
+/* NewClient checks the configuration and fills in the defaults. */
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Host == "" || cfg.Port == "" {
+		return nil, errors.New("smtp host and port are required")
+	}
+	if cfg.TLS < STARTTLSOpportunistic || cfg.TLS > NoTLS {
+		return nil, fmt.Errorf("unknown smtp tls mode %d", cfg.TLS)
+	}
+	if cfg.Auth < AuthAuto || cfg.Auth > AuthCRAMMD5 {
+		return nil, fmt.Errorf("unknown smtp auth mechanism %d", cfg.Auth)
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = cfg.Host
+	}
+	c := &Client{cfg: cfg}
+	if cfg.DKIM != nil {
+		signer, err := NewDKIMSigner(*cfg.DKIM)
+		if err != nil {
+			return nil, err
+		}
+		c.dkim = signer
+	}
+	return c, nil
+}
+
+/* SendMail sends a plain-text message with the given subject and body. */
+func (c *Client) SendMail(ctx context.Context, from, to, subject, body string) error {
+	return c.SendContent(ctx, from, to, Content{Subject: subject, Text: body})
+}
+
+/*
+SendContent sends a message, as multipart/alternative if it has an HTML part.
+from and to may include a display name, e.g. "Example <noreply@example.com>".
+*/
+func (c *Client) SendContent(ctx context.Context, from, to string, content Content) error {
+	fromAddr, err := parseAddress("From", from)
+	if err != nil {
+		return err
+	}
+	toAddr, err := parseAddress("To", to)
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(ctx, &Message{
+		From:    fromAddr,
+		To:      []mail.Address{toAddr},
+		Subject: content.Subject,
+		Text:    content.Text,
+		HTML:    content.HTML,
+	})
+}
+
+/* SendMessage builds m, signs it if DKIM is configured, and sends it to all of its recipients. */
+func (c *Client) SendMessage(ctx context.Context, m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	if c.dkim != nil {
+		if msg, err = c.dkim.Sign(msg); err != nil {
+			return err
+		}
+	}
+	return c.Send(ctx, m.From.Address, m.Recipients(), msg)
+}
+
+/*
+Send delivers a ready-made message to the recipients. Cancelling ctx aborts
+the conversation at once, whatever stage it is at.
+*/
+func (c *Client) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	/* Close the socket if ctx ends, which unblocks any pending read or write */
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	deadline := time.Now().Add(c.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	err = c.converse(conn, from, to, msg)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+/* dial connects, completing the TLS handshake first for ImplicitTLS. */
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, c.cfg.DialTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(dialCtx, "tcp", net.JoinHostPort(c.cfg.Host, c.cfg.Port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to smtp server: %w", err)
+	}
+	if c.cfg.TLS != ImplicitTLS {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, c.tlsConfig())
+	if err := tlsConn.HandshakeContext(dialCtx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtp tls handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+/* converse runs the SMTP dialogue over an open connection. */
+func (c *Client) converse(conn net.Conn, from string, to []string, msg []byte) error {
+	client, err := smtp.NewClient(conn, c.cfg.Host)
+	if err != nil {
+		return fmt.Errorf("smtp greeting failed: %w", err)
+	}
+	defer client.Close()
+
+	localName := c.cfg.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err := client.Hello(localName); err != nil {
+		return fmt.Errorf("smtp EHLO failed: %w", err)
+	}
+
+	if c.cfg.TLS == STARTTLSOpportunistic || c.cfg.TLS == STARTTLSRequired {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(c.tlsConfig()); err != nil {
+				return fmt.Errorf("smtp STARTTLS failed: %w", err)
+			}
+		} else if c.cfg.TLS == STARTTLSRequired {
+			return ErrSTARTTLSUnavailable
+		}
+	}
+
+	if c.cfg.Username != "" {
+		auth, err := c.auth(client)
+		if err != nil {
+			return err
+		}
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("smtp authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("smtp MAIL FROM rejected: %w", err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("smtp RCPT TO %s rejected: %w", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA rejected: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write smtp message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp message rejected: %w", err)
+	}
+	return client.Quit()
+}
+
+/* auth picks the mechanism from the config and what the server offers. */
+func (c *Client) auth(client *smtp.Client) (smtp.Auth, error) {
+	ok, params := client.Extension("AUTH")
+	if !ok {
+		return nil, ErrAuthUnsupported
+	}
+	offered := strings.Fields(strings.ToUpper(params))
+	has := func(m string) bool {
+		for _, o := range offered {
+			if o == m {
+				return true
+			}
+		}
+		return false
+	}
+
+	mech := c.cfg.Auth
+	if mech == AuthAuto {
+		switch {
+		case has("PLAIN"):
+			mech = AuthPlain
+		case has("LOGIN"):
+			mech = AuthLogin
+		case has("CRAM-MD5"):
+			mech = AuthCRAMMD5
+		default:
+			return nil, ErrAuthUnsupported
+		}
+	}
+
+	switch mech {
+	case AuthPlain:
+		return smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, c.cfg.Host), nil
+	case AuthLogin:
+		return &loginAuth{username: c.cfg.Username, password: c.cfg.Password, host: c.cfg.Host}, nil
+	default:
+		return smtp.CRAMMD5Auth(c.cfg.Username, c.cfg.Password), nil
+	}
+}
+
+func (c *Client) tlsConfig() *tls.Config {
+	return &tls.Config{
+		ServerName: c.cfg.ServerName,
+		RootCAs:    c.cfg.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+/*
+loginAuth implements the LOGIN mechanism, which net/smtp lacks. Like
+smtp.PlainAuth it sends the password in the clear, so it refuses to run
+without TLS except against localhost.
+*/
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (l *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, ErrInsecureAuth
+	}
+	if server.Name != l.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (l *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(l.username), nil
+	case "password:":
+		return []byte(l.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected smtp LOGIN challenge %q", fromServer)
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,244 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+DKIMConfig enables DKIM signing (RFC 6376) of every message a Client
+builds. Domain and Selector name the DNS record holding the public key,
+<Selector>._domainkey.<Domain>. PrivateKey is an *rsa.PrivateKey (at least
+1024 bits, 2048 recommended) for rsa-sha256 or an ed25519.PrivateKey for
+ed25519-sha256 (RFC 8463); ParseDKIMPrivateKey reads either from PEM.
+Headers lists the header fields to sign; the default covers the ones the
+message builder writes. Canonicalization is always relaxed/relaxed.
+*/
+type DKIMConfig struct {
+	Domain     string
+	Selector   string
+	PrivateKey crypto.Signer
+	Headers    []string
+}
+
+var defaultDKIMHeaders = []string{
+	"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+/* DKIMSigner signs messages with one key. It is safe for concurrent use. */
+type DKIMSigner struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+	headers   []string
+}
+
+/* NewDKIMSigner checks the configuration and key. */
+func NewDKIMSigner(cfg DKIMConfig) (*DKIMSigner, error) {
+	if cfg.Domain == "" || cfg.Selector == "" {
+		return nil, errors.New("dkim domain and selector are required")
+	}
+	if strings.ContainsAny(cfg.Domain+cfg.Selector, "; \t\r\n") {
+		return nil, errors.New("dkim domain and selector must not contain separators or whitespace")
+	}
+
+	s := &DKIMSigner{domain: cfg.Domain, selector: cfg.Selector, key: cfg.PrivateKey, headers: cfg.Headers}
+	switch k := cfg.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("dkim rsa key is %d bits, at least 1024 are required", k.N.BitLen())
+		}
+		s.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.algorithm = "ed25519-sha256"
+	case nil:
+		return nil, errors.New("dkim private key is required")
+	default:
+		return nil, fmt.Errorf("unsupported dkim key type %T", cfg.PrivateKey)
+	}
+
+	if len(s.headers) == 0 {
+		s.headers = defaultDKIMHeaders
+	}
+	for _, h := range s.headers {
+		if !validHeaderName(h) {
+			return nil, fmt.Errorf("invalid dkim header name %q", h)
+		}
+	}
+	return s, nil
+}
+
+/*
+ParseDKIMPrivateKey reads an RSA key in PKCS #1 or PKCS #8 PEM, or an
+Ed25519 key in PKCS #8 PEM, as produced by openssl genpkey.
+*/
+func ParseDKIMPrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found in dkim key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dkim key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported dkim key type %T", key)
+	}
+	return signer, nil
+}
+
+/*
+Sign returns msg with a DKIM-Signature header added at the top. msg must
+use CRLF line endings, as Message.Bytes produces.
+*/
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		/* A message without a body is all header */
+		header, body = bytes.TrimSuffix(msg, []byte("\r\n")), nil
+	}
+	fields := splitHeaderFields(string(header) + "\r\n")
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	/*
+		Sign every listed field that is present. Repeated fields are signed
+		from the bottom up, as verifiers pick them.
+	*/
+	var signedNames []string
+	var signed bytes.Buffer
+	used := make(map[int]bool)
+	for _, name := range s.headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			signedNames = append(signedNames, name)
+			signed.WriteString(relaxedHeader(fields[i]))
+			signed.WriteString("\r\n")
+		}
+	}
+	if len(signedNames) == 0 {
+		return nil, errors.New("dkim: none of the headers to sign are present")
+	}
+
+	sig := "DKIM-Signature: v=1; a=" + s.algorithm + "; c=relaxed/relaxed;" +
+		"\r\n\td=" + s.domain + "; s=" + s.selector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10) + ";" +
+		"\r\n\th=" + strings.Join(signedNames, ":") + ";" +
+		"\r\n\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";" +
+		"\r\n\tb="
+	/* The signature covers its own header with b= empty and no trailing CRLF */
+	signed.WriteString(relaxedHeader(sig))
+	digest := sha256.Sum256(signed.Bytes())
+
+	var raw []byte
+	var err error
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		raw, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case ed25519.PrivateKey:
+		/* RFC 8463: Ed25519 signs the SHA-256 digest, not the data */
+		raw = ed25519.Sign(k, digest[:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim signing failed: %w", err)
+	}
+
+	out := make([]byte, 0, len(sig)+len(raw)*2+len(msg))
+	out = append(out, sig...)
+	out = append(out, base64.StdEncoding.EncodeToString(raw)...)
+	out = append(out, "\r\n"...)
+	return append(out, msg...), nil
+}
+
+/* splitHeaderFields splits a header block into fields, keeping folded lines with their field. */
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
+
+/*
+relaxedHeader canonicalizes one field per RFC 6376 section 3.4.2: lower-case
+name, unfolded, runs of whitespace reduced to one space, and no whitespace
+at the end or around the colon.
+*/
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value
+}
+
+/*
+relaxedBody canonicalizes the body per RFC 6376 section 3.4.4: whitespace
+runs reduced to one space, none at line ends, no empty lines at the end,
+and a final CRLF unless the body is empty.
+*/
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		var b strings.Builder
+		inWSP := false
+		for j := 0; j < len(line); j++ {
+			if c := line[j]; c == ' ' || c == '\t' {
+				inWSP = true
+				continue
+			}
+			if inWSP {
+				b.WriteByte(' ')
+				inWSP = false
+			}
+			b.WriteByte(line[j])
+		}
+		lines[i] = b.String()
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
@@ -0,0 +1,364 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrHeaderInjection = errors.New("line break in header value")
+	ErrInvalidAddress  = errors.New("invalid email address")
+	ErrInvalidHeader   = errors.New("invalid header")
+)
+
+/*
+HeaderError reports a header or address that cannot go into a message
+unchanged, such as a subject with a line break in it. Field is the header
+name. It wraps ErrHeaderInjection, ErrInvalidAddress or ErrInvalidHeader.
+*/
+type HeaderError struct {
+	Field string
+	Err   error
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("email header %s: %v", e.Field, e.Err)
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+/*
+Message is an email to be built per RFC 5322. From and at least one of To,
+Cc or Bcc are required; Bcc recipients get the message but are not listed in
+it. Display names and a Subject outside ASCII are encoded per RFC 2047.
+Headers adds custom headers such as List-Unsubscribe; the headers the
+builder sets itself cannot be overridden. Date defaults to now and
+MessageID to a random ID at the sender's domain.
+*/
+type Message struct {
+	From      mail.Address
+	To        []mail.Address
+	Cc        []mail.Address
+	Bcc       []mail.Address
+	ReplyTo   []mail.Address
+	Subject   string
+	Text      string
+	HTML      string
+	Headers   map[string]string
+	Date      time.Time
+	MessageID string
+}
+
+/* reservedHeaders are written by Bytes and cannot be set through Headers. */
+var reservedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true,
+	"Subject": true, "Date": true, "Message-Id": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+/* Recipients returns the envelope addresses: To, Cc and Bcc. */
+func (m *Message) Recipients() []string {
+	var out []string
+	for _, list := range [][]mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, a := range list {
+			out = append(out, a.Address)
+		}
+	}
+	return out
+}
+
+/*
+Bytes validates the message and renders it with CRLF line endings. Bodies
+are sent quoted-printable, so long lines and non-ASCII text survive any
+server. With HTML set the message is multipart/alternative.
+*/
+func (m *Message) Bytes() ([]byte, error) {
+	if err := checkAddress("From", m.From); err != nil {
+		return nil, err
+	}
+	if len(m.To)+len(m.Cc)+len(m.Bcc) == 0 {
+		return nil, &HeaderError{Field: "To", Err: fmt.Errorf("%w: no recipients", ErrInvalidAddress)}
+	}
+	for _, h := range []struct {
+		field string
+		list  []mail.Address
+	}{{"To", m.To}, {"Cc", m.Cc}, {"Bcc", m.Bcc}, {"Reply-To", m.ReplyTo}} {
+		for _, a := range h.list {
+			if err := checkAddress(h.field, a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if hasLineBreak(m.Subject) {
+		return nil, &HeaderError{Field: "Subject", Err: ErrHeaderInjection}
+	}
+	if hasLineBreak(m.MessageID) {
+		return nil, &HeaderError{Field: "Message-ID", Err: ErrHeaderInjection}
+	}
+
+	custom := make([]string, 0, len(m.Headers))
+	for name, value := range m.Headers {
+		if !validHeaderName(name) {
+			return nil, &HeaderError{Field: name, Err: fmt.Errorf("%w: bad header name", ErrInvalidHeader)}
+		}
+		if reservedHeaders[canonicalHeader(name)] {
+			return nil, &HeaderError{Field: name, Err: fmt.Errorf("%w: set by the message builder", ErrInvalidHeader)}
+		}
+		if hasLineBreak(value) {
+			return nil, &HeaderError{Field: name, Err: ErrHeaderInjection}
+		}
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := m.MessageID
+	if messageID == "" {
+		id, err := newMessageID(m.From.Address)
+		if err != nil {
+			return nil, err
+		}
+		messageID = id
+	}
+
+	var b bytes.Buffer
+	writeHeader := func(name, value string) {
+		b.WriteString(name + ": " + value + "\r\n")
+	}
+	writeHeader("From", m.From.String())
+	if len(m.To) > 0 {
+		writeHeader("To", formatAddressList(m.To))
+	}
+	if len(m.Cc) > 0 {
+		writeHeader("Cc", formatAddressList(m.Cc))
+	}
+	if len(m.ReplyTo) > 0 {
+		writeHeader("Reply-To", formatAddressList(m.ReplyTo))
+	}
+	writeHeader("Subject", encodeHeader("Subject", m.Subject))
+	writeHeader("Date", date.Format(time.RFC1123Z))
+	writeHeader("Message-ID", messageID)
+	writeHeader("MIME-Version", "1.0")
+	for _, name := range custom {
+		writeHeader(name, encodeHeader(name, m.Headers[name]))
+	}
+
+	if m.HTML == "" {
+		if err := writePart(&b, "text/plain", m.Text); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate MIME boundary: %w", err)
+	}
+	boundary := "alt-" + hex.EncodeToString(raw)
+
+	writeHeader("Content-Type", "multipart/alternative; boundary=\""+boundary+"\"")
+	b.WriteString("\r\n")
+	/* Plain text first: clients show the last part they understand */
+	for _, part := range []struct{ mediaType, body string }{
+		{"text/plain", m.Text},
+		{"text/html", m.HTML},
+	} {
+		b.WriteString("--" + boundary + "\r\n")
+		if err := writePart(&b, part.mediaType, part.body); err != nil {
+			return nil, err
+		}
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.Bytes(), nil
+}
+
+/* writePart writes the content headers, a blank line and the encoded body. */
+func writePart(b *bytes.Buffer, mediaType, body string) error {
+	b.WriteString("Content-Type: " + mediaType + "; charset=\"UTF-8\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n")
+	qp := quotedprintable.NewWriter(b)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+	b.WriteString("\r\n")
+	return nil
+}
+
+/* checkAddress rejects line breaks and anything net/mail cannot parse back. */
+func checkAddress(field string, a mail.Address) error {
+	if hasLineBreak(a.Name) || hasLineBreak(a.Address) {
+		return &HeaderError{Field: field, Err: ErrHeaderInjection}
+	}
+	parsed, err := mail.ParseAddress("<" + a.Address + ">")
+	if err != nil || parsed.Address != a.Address {
+		return &HeaderError{Field: field, Err: fmt.Errorf("%w: %q", ErrInvalidAddress, a.Address)}
+	}
+	return nil
+}
+
+/* parseAddress parses "name <addr>" or a bare address for the given field. */
+func parseAddress(field, s string) (mail.Address, error) {
+	if hasLineBreak(s) {
+		return mail.Address{}, &HeaderError{Field: field, Err: ErrHeaderInjection}
+	}
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return mail.Address{}, &HeaderError{Field: field, Err: fmt.Errorf("%w: %q", ErrInvalidAddress, s)}
+	}
+	return *a, nil
+}
+
+func formatAddressList(list []mail.Address) string {
+	parts := make([]string, len(list))
+	for i := range list {
+		parts[i] = list[i].String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+/* maxHeaderLine is the line length RFC 5322 section 2.1.1 asks header lines to keep within. */
+const maxHeaderLine = 78
+
+/*
+encodeHeader turns an unstructured header value into RFC 2047 Q encoded-words
+if it is not plain ASCII, and folds it so that no line of "name: value" is
+longer than maxHeaderLine. Encoded-words end on character boundaries, so each
+decodes on its own, and folds go between words, where decoders drop the
+whitespace again. A plain ASCII value is folded at its spaces; a single word
+too long for a line is left whole.
+*/
+func encodeHeader(name, value string) string {
+	if !needsEncoding(value) {
+		return foldHeader(name, strings.Split(value, " "))
+	}
+
+	const prefix, suffix = "=?UTF-8?q?", "?="
+	/* A word must fit after "Name: " on the first line, and RFC 2047 caps it at 75 */
+	limit := min(75, maxHeaderLine-len(name)-2)
+	limit = max(limit, len(prefix)+len(suffix)+3*utf8.UTFMax)
+
+	var words []string
+	var word strings.Builder
+	for _, r := range value {
+		enc := qEncodeRune(r)
+		if word.Len() > 0 && len(prefix)+word.Len()+len(enc)+len(suffix) > limit {
+			words = append(words, prefix+word.String()+suffix)
+			word.Reset()
+		}
+		word.WriteString(enc)
+	}
+	words = append(words, prefix+word.String()+suffix)
+	return foldHeader(name, words)
+}
+
+/*
+foldHeader joins words with single spaces, starting a new line instead
+wherever the next word would push the line past maxHeaderLine.
+*/
+func foldHeader(name string, words []string) string {
+	var b strings.Builder
+	lineLen := len(name) + 2
+	for i, w := range words {
+		if i > 0 {
+			/* An empty word is a run of spaces; folding there would leave a blank line */
+			if w != "" && lineLen+1+len(w) > maxHeaderLine {
+				b.WriteString("\r\n")
+				lineLen = 0
+			}
+			b.WriteByte(' ')
+			lineLen++
+		}
+		b.WriteString(w)
+		lineLen += len(w)
+	}
+	return b.String()
+}
+
+/* needsEncoding reports whether s has bytes that cannot appear in a header as they are. */
+func needsEncoding(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' || c > '~') && c != '\t' {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+qEncodeRune encodes one character for a Q encoded-word (RFC 2047 section
+4.2), keeping only the characters section 5 allows everywhere as they are.
+*/
+func qEncodeRune(r rune) string {
+	switch {
+	case r == ' ':
+		return "_"
+	case r < utf8.RuneSelf && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!*+-/", r)):
+		return string(r)
+	}
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	var b strings.Builder
+	for _, c := range buf[:n] {
+		fmt.Fprintf(&b, "=%02X", c)
+	}
+	return b.String()
+}
+
+func hasLineBreak(s string) bool {
+	return strings.ContainsAny(s, "\r\n")
+}
+
+/* validHeaderName reports whether name is a header field name per RFC 5322: printable ASCII without a colon. */
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+/* canonicalHeader capitalises each dash-separated word, e.g. "list-id" to "List-Id". */
+func canonicalHeader(name string) string {
+	words := strings.Split(strings.ToLower(name), "-")
+	for i, w := range words {
+		if w != "" {
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+	return strings.Join(words, "-")
+}
+
+/* newMessageID returns a random Message-ID at the sender's domain. */
+func newMessageID(from string) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate Message-ID: %w", err)
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+	return "<" + hex.EncodeToString(raw) + "@" + domain + ">", nil
+}
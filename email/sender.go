@@ -1,32 +1,43 @@
 package email
 
 import (
+	"context"
 	"fmt"
-	"net/smtp"
 )
 
+/*
+Content is a rendered email. HTML is optional; when it is set the message
+is sent as multipart/alternative, with Text as the fallback part for
+clients that do not show HTML.
+*/
+type Content struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
 /*
 Send is a helper function that uses the SMTP protocol to send a message.
-It handles the authentication and message formatting.
+The message is built with Message, so a toEmail or subject containing a
+line break is refused with a *HeaderError. It authenticates as fromEmail
+and uses implicit TLS on port 465 and opportunistic STARTTLS otherwise,
+with the default Client timeouts.
+Use NewClient for control over TLS, authentication or cancellation.
 */
 func Send(host, port, fromEmail, password, toEmail, subject, body string) error {
-	/* Set up authentication information. */
-	auth := smtp.PlainAuth("", fromEmail, password, host)
-
-	/* SMTP server address */
-	address := host + ":" + port
-
-	/* Message headers and body
-	We use \r\n because SMTP protocol expects CRLF line endings */
-	msg := []byte("To: " + toEmail + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"MIME-Version: 1.0\r\n" +
-		"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
-		"\r\n" +
-		body + "\r\n")
+	return SendContent(host, port, fromEmail, password, toEmail, Content{Subject: subject, Text: body})
+}
 
-	/* Send the email */
-	err := smtp.SendMail(address, auth, fromEmail, []string{toEmail}, msg)
+/* SendContent works like Send for a message that may have an HTML part. */
+func SendContent(host, port, fromEmail, password, toEmail string, content Content) error {
+	cfg := Config{Host: host, Port: port, Username: fromEmail, Password: password}
+	if port == "465" {
+		cfg.TLS = ImplicitTLS
+	}
+	client, err := NewClient(cfg)
+	if err == nil {
+		err = client.SendContent(context.Background(), fromEmail, toEmail, content)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to send email via SMTP: %w", err)
 	}
@@ -7,11 +7,14 @@ var (
 	ErrDatabaseUnavailable     = errors.New("database connection unavailable")
 	ErrInvalidToken            = errors.New("invalid jwt token")
 	ErrTokenExpired            = errors.New("jwt token expired")
+	ErrTokenRevoked            = errors.New("jwt token has been revoked")
 	ErrOTPExpired              = errors.New("otp expired")
 	ErrInvalidOTP              = errors.New("invalid otp code")
+	ErrOTPAttemptsExceeded     = errors.New("too many otp attempts, request a new code")
+	ErrOTPResendCooldown       = errors.New("otp was sent recently, wait before resending")
 	ErrUserNotFound            = errors.New("user not found")
 	ErrInvalidCredentials      = errors.New("invalid credentials")
-	ErrSMTPNotInitialized      = errors.New("smtp not initialized")
+	ErrSMTPNotInitialized      = errors.New("smtp not initialized and no notifier set")
 	ErrJWTSecretMissing        = errors.New("jwt secret not initialized")
 	ErrInvalidInput            = errors.New("invalid input provided")
 	ErrInvalidEmail            = errors.New("invalid email format")
@@ -20,9 +23,27 @@ var (
 	ErrRefreshTokenInvalid     = errors.New("invalid refresh token")
 	ErrRefreshTokenRevoked     = errors.New("refresh token has been revoked")
 	ErrRefreshTokenExpired     = errors.New("refresh token has expired")
+	ErrRefreshTokenReused      = errors.New("revoked refresh token reused, session revoked")
+	ErrSessionNotFound         = errors.New("session not found")
 	ErrOAuthNotInitialized     = errors.New("oauth not initialized")
 	ErrOAuthExchangeFailed     = errors.New("failed to exchange oauth code")
 	ErrOAuthProfileFetchFailed = errors.New("failed to fetch user profile from provider")
 	ErrRedisUnavailable        = errors.New("redis connection unavailable")
 	ErrRateLimitBackendDown    = errors.New("rate limit backend is down")
+	ErrInvalidDPoPProof        = errors.New("invalid dpop proof")
+	ErrDPoPReplay              = errors.New("dpop proof has already been used")
+	ErrDPoPProofRequired       = errors.New("token is dpop-bound and needs a dpop proof")
+	ErrTOTPNotInitialized      = errors.New("totp not initialized")
+	ErrTOTPNotEnrolled         = errors.New("totp not enrolled")
+	ErrTOTPAlreadyEnrolled     = errors.New("totp already enrolled, disable it first")
+	ErrInvalidTOTP             = errors.New("invalid totp code")
+	ErrTOTPReplay              = errors.New("totp code has already been used")
+	ErrTOTPLocked              = errors.New("too many wrong totp codes, try again later")
+	ErrInvalidRecoveryCode     = errors.New("invalid or already used recovery code")
+	ErrMFAChallengeInvalid     = errors.New("invalid or expired mfa challenge")
+	ErrMFAFactorNotAllowed     = errors.New("factor not available for this challenge")
+	ErrStepUpAttemptsExceeded  = errors.New("too many step-up attempts, try again later")
+	ErrMagicLinkNotInitialized = errors.New("magic links not initialized")
+	ErrMagicLinkInvalid        = errors.New("invalid, expired or already used magic link")
+	ErrOutboxMessageNotFound   = errors.New("outbox message not found or cannot be retried")
 )
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"log"
+	"time"
+)
+
+/* SecurityEventType identifies the kind of security event being reported. */
+type SecurityEventType string
+
+const (
+	/* EventRefreshTokenReuse: a revoked refresh token was presented, its whole family was revoked */
+	EventRefreshTokenReuse SecurityEventType = "refresh_token_reuse"
+	/* EventRecoveryCodeUsed: a recovery code was spent; Detail says how many are left */
+	EventRecoveryCodeUsed SecurityEventType = "recovery_code_used"
+)
+
+/*
+SecurityEvent describes something suspicious the library detected and acted on.
+SessionID is set for refresh token events and identifies the revoked family.
+*/
+type SecurityEvent struct {
+	Type      SecurityEventType `json:"type"`
+	UserID    string            `json:"user_id"`
+	SessionID string            `json:"session_id,omitempty"`
+	Time      time.Time         `json:"time"`
+	Detail    string            `json:"detail,omitempty"`
+}
+
+/*
+OnSecurityEvent registers a callback for security events, e.g. to alert
+the user or feed a SIEM. Only one handler is kept; a later call replaces it.
+The handler runs synchronously on the request path, so it should return quickly.
+Without a handler, events are written to the standard logger.
+*/
+func (a *Auth) OnSecurityEvent(handler func(SecurityEvent)) {
+	a.eventMu.Lock()
+	defer a.eventMu.Unlock()
+	a.eventHandler = handler
+}
+
+/* emitSecurityEvent delivers an event to the registered handler, or logs it. */
+func (a *Auth) emitSecurityEvent(ev SecurityEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	a.eventMu.RLock()
+	handler := a.eventHandler
+	a.eventMu.RUnlock()
+
+	if handler == nil {
+		log.Printf("security event %s: user=%s session=%s %s", ev.Type, ev.UserID, ev.SessionID, ev.Detail)
+		return
+	}
+	handler(ev)
+}
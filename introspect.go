@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ClientCredentials maps OAuth client IDs to their client secrets.
+Callers of the introspection and revocation endpoints must authenticate with
+one of these pairs, either via HTTP Basic auth or client_id/client_secret form fields.
+An empty map rejects every request.
+*/
+type ClientCredentials map[string]string
+
+/*
+IntrospectionResponse is the RFC 7662 introspection response.
+Only Active is set for inactive tokens, as the RFC recommends.
+*/
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Subject   string   `json:"sub,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	TokenID   string   `json:"jti,omitempty"`
+	SessionID string   `json:"sid,omitempty"`
+	AMR       []string `json:"amr,omitempty"`
+	ACR       string   `json:"acr,omitempty"`
+
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+}
+
+/* oauthError is the RFC 6749 section 5.2 error body. */
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+/*
+IntrospectionHandler returns an http.Handler implementing OAuth 2.0 token
+introspection (RFC 7662). It accepts POSTed form data with a "token" and an
+optional "token_type_hint" of access_token or refresh_token.
+
+Access tokens are checked with ValidateToken and refresh tokens with a
+read-only lookup, so revocation is honoured for both and introspecting a
+refresh token does not count as using its session. token_type is the type
+the token is used with, Bearer or DPoP.
+*/
+func (a *Auth) IntrospectionHandler(clients ClientCredentials) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, hint, ok := parseTokenRequest(w, r, clients)
+		if !ok {
+			return
+		}
+
+		var resp IntrospectionResponse
+		if hint == "refresh_token" {
+			resp = a.introspectRefreshToken(token)
+			if !resp.Active {
+				resp = a.introspectAccessToken(token)
+			}
+		} else {
+			resp = a.introspectAccessToken(token)
+			if !resp.Active {
+				resp = a.introspectRefreshToken(token)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+/*
+RevocationHandler returns an http.Handler implementing OAuth 2.0 token
+revocation (RFC 7009). Refresh tokens are revoked with RevokeRefreshToken and
+access tokens are added to the jti deny-list with RevokeAccessToken. As
+section 2.1 recommends, revoking a refresh token also revokes the access
+tokens issued for its session (those carrying its sid claim).
+
+As the RFC requires, an unknown or already invalid token still gets a 200 response.
+If the storage backend is down the handler answers 503 so the client can retry.
+*/
+func (a *Auth) RevocationHandler(clients ClientCredentials) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, hint, ok := parseTokenRequest(w, r, clients)
+		if !ok {
+			return
+		}
+
+		var err error
+		if hint == "access_token" {
+			err = a.revokeAccessTokenString(token)
+			if errors.Is(err, ErrInvalidToken) {
+				err = a.revokeRefreshTokenGrant(token)
+			}
+		} else {
+			err = a.revokeRefreshTokenGrant(token)
+			if errors.Is(err, ErrRefreshTokenInvalid) {
+				err = a.revokeAccessTokenString(token)
+			}
+		}
+
+		switch {
+		case err == nil,
+			errors.Is(err, ErrInvalidToken),
+			errors.Is(err, ErrTokenRevoked),
+			errors.Is(err, ErrRefreshTokenInvalid):
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeJSON(w, http.StatusServiceUnavailable, oauthError{
+				Error:       "temporarily_unavailable",
+				Description: "token storage is unavailable",
+			})
+		}
+	})
+}
+
+/*
+introspectAccessToken validates a JWT and maps its claims to an introspection
+response. A DPoP-bound token is reported active with its cnf claim, so the
+resource server can check the proof against it (RFC 9449 section 6.2).
+*/
+func (a *Auth) introspectAccessToken(token string) IntrospectionResponse {
+	claims, err := a.validateAccessToken(token)
+	if err != nil {
+		return IntrospectionResponse{}
+	}
+
+	resp := IntrospectionResponse{
+		Active:    true,
+		Subject:   claims.Subject,
+		Username:  claims.UserID,
+		TokenType: "Bearer",
+		Issuer:    claims.Issuer,
+		TokenID:   claims.ID,
+		SessionID: claims.SessionID,
+		AMR:       claims.AMR,
+		ACR:       claims.ACR,
+
+		Confirmation: claims.Confirmation,
+	}
+	if claims.Confirmation != nil {
+		resp.TokenType = "DPoP"
+	}
+	if claims.ExpiresAt != nil {
+		resp.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		resp.NotBefore = claims.NotBefore.Unix()
+	}
+	return resp
+}
+
+/*
+introspectRefreshToken reports whether an opaque refresh token is still usable.
+It only reads the token, so unlike ValidateRefreshToken it does not count as
+using the session.
+*/
+func (a *Auth) introspectRefreshToken(token string) IntrospectionResponse {
+	rt, err := a.lookupRefreshToken(token)
+	if err != nil || rt.Revoked || time.Now().After(rt.ExpiresAt) {
+		return IntrospectionResponse{}
+	}
+
+	resp := IntrospectionResponse{
+		Active:    true,
+		Subject:   rt.UserID,
+		Username:  rt.UserID,
+		TokenType: "Bearer",
+		ExpiresAt: rt.ExpiresAt.Unix(),
+		IssuedAt:  rt.CreatedAt.Unix(),
+		SessionID: rt.SessionID,
+		AMR:       rt.AMR,
+		ACR:       rt.ACR,
+	}
+	if rt.DPoPJKT != "" {
+		resp.TokenType = "DPoP"
+	}
+	return resp
+}
+
+/*
+lookupRefreshToken reads a refresh token's row without touching it. Only the
+fields introspection and revocation need are filled in.
+*/
+func (a *Auth) lookupRefreshToken(token string) (*RefreshToken, error) {
+	if token == "" {
+		return nil, ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+
+	rt := &RefreshToken{}
+	var sessionID, boundJKT, acr *string
+	err := a.Conn.QueryRow(a.ctx, `
+		SELECT user_id, session_id, dpop_jkt, expires_at, created_at, revoked, amr, acr
+		FROM refresh_tokens WHERE token = $1`,
+		hashRefreshToken(token),
+	).Scan(&rt.UserID, &sessionID, &boundJKT, &rt.ExpiresAt, &rt.CreatedAt, &rt.Revoked, &rt.AMR, &acr)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	rt.SessionID = derefString(sessionID)
+	rt.DPoPJKT = derefString(boundJKT)
+	rt.ACR = derefString(acr)
+	return rt, nil
+}
+
+/*
+revokeRefreshTokenGrant revokes a refresh token and the access tokens of its
+session. An already revoked token, such as one rotated out, is left alone so
+it cannot be used to cut off the session that replaced it.
+*/
+func (a *Auth) revokeRefreshTokenGrant(token string) error {
+	rt, err := a.lookupRefreshToken(token)
+	if err != nil {
+		return err
+	}
+	if rt.Revoked {
+		return nil
+	}
+	if err := a.RevokeRefreshToken(token); err != nil {
+		return err
+	}
+	if rt.SessionID == "" {
+		/* Tokens from before sessions existed have no access tokens tied to them */
+		return nil
+	}
+	return a.revokeSessionAccessTokens(rt.SessionID)
+}
+
+/* revokeAccessTokenString validates a JWT and puts its jti on the deny-list. */
+func (a *Auth) revokeAccessTokenString(token string) error {
+	/* Revoking a bound token needs no proof: it only takes power away */
+	claims, err := a.validateAccessToken(token)
+	if errors.Is(err, ErrNotInitialized) {
+		/* Without a signing key nothing can be a valid access token */
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		/* Tokens minted before jti existed cannot be denied individually */
+		return ErrInvalidToken
+	}
+	return a.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+}
+
+/*
+parseTokenRequest performs the checks shared by both endpoints: POST only,
+client authentication, and a non-empty token parameter.
+On failure it writes the error response itself and returns ok = false.
+*/
+func parseTokenRequest(w http.ResponseWriter, r *http.Request, clients ClientCredentials) (token, hint string, ok bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, oauthError{Error: "invalid_request"})
+		return "", "", false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "malformed form body"})
+		return "", "", false
+	}
+
+	if !authenticateClient(r, clients) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		writeJSON(w, http.StatusUnauthorized, oauthError{Error: "invalid_client"})
+		return "", "", false
+	}
+
+	token = r.PostForm.Get("token")
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "missing token parameter"})
+		return "", "", false
+	}
+
+	return token, r.PostForm.Get("token_type_hint"), true
+}
+
+/* authenticateClient checks client credentials from Basic auth or the form body. */
+func authenticateClient(r *http.Request, clients ClientCredentials) bool {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if clientID == "" || secret == "" {
+		return false
+	}
+
+	expected, found := clients[clientID]
+	if !found {
+		/* Compare anyway so unknown IDs take the same time as wrong secrets */
+		expected = "\x00"
+	}
+
+	match := subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+	return found && match
+}
+
+/* writeJSON encodes v as the response body with the given status. */
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
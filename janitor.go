@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+JanitorConfig controls the background janitor that Init starts.
+Interval is the time between runs (default 5 minutes); a negative value turns
+the periodic runs off, for deployments that call RunJanitor from their own
+scheduler. BatchSize caps the rows removed per DELETE (default 1000), so a
+large backlog is worked through without long locks.
+DeadLetterRetention is how long dead outbox messages are kept for
+inspection (default 7 days).
+RevokedRetention is how long revoked refresh tokens are kept after they have
+expired (default 7 days). A revoked token is never purged before it expires,
+so presenting it again is detected as reuse and revokes its session for as
+long as the token could otherwise have been used.
+*/
+type JanitorConfig struct {
+	Interval            time.Duration
+	BatchSize           int
+	RevokedRetention    time.Duration
+	DeadLetterRetention time.Duration
+}
+
+/* JanitorCounts is the number of rows deleted, per kind. */
+type JanitorCounts struct {
+	OTPs                 int64 `json:"otps"`
+	ExpiredRefreshTokens int64 `json:"expired_refresh_tokens"`
+	RevokedRefreshTokens int64 `json:"revoked_refresh_tokens"`
+	RevokedAccessTokens  int64 `json:"revoked_access_tokens"`
+	MFAChallenges        int64 `json:"mfa_challenges"`
+	StepUpAttempts       int64 `json:"step_up_attempts"`
+	MagicLinks           int64 `json:"magic_links"`
+	DeadLetters          int64 `json:"dead_letters"`
+}
+
+/*
+JanitorStats reports what the janitor has done since Init, for metrics and
+health checks. Deleted is cumulative across runs; LastError is empty when
+the last run succeeded.
+*/
+type JanitorStats struct {
+	Runs         int64         `json:"runs"`
+	Failures     int64         `json:"failures"`
+	LastRun      time.Time     `json:"last_run"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastError    string        `json:"last_error,omitempty"`
+	Deleted      JanitorCounts `json:"deleted"`
+}
+
+var defaultJanitorConfig = JanitorConfig{
+	Interval:            5 * time.Minute,
+	BatchSize:           1000,
+	RevokedRetention:    7 * 24 * time.Hour,
+	DeadLetterRetention: 7 * 24 * time.Hour,
+}
+
+/*
+JanitorInit replaces the janitor configuration. Zero fields keep their
+defaults. A new Interval takes effect immediately.
+*/
+func (a *Auth) JanitorInit(cfg JanitorConfig) error {
+	if cfg.BatchSize < 0 || cfg.RevokedRetention < 0 || cfg.DeadLetterRetention < 0 {
+		return fmt.Errorf("%w: janitor batch size and retention cannot be negative", ErrInvalidInput)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultJanitorConfig.Interval
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = defaultJanitorConfig.BatchSize
+	}
+	if cfg.RevokedRetention == 0 {
+		cfg.RevokedRetention = defaultJanitorConfig.RevokedRetention
+	}
+	if cfg.DeadLetterRetention == 0 {
+		cfg.DeadLetterRetention = defaultJanitorConfig.DeadLetterRetention
+	}
+
+	a.janitorMu.Lock()
+	a.janitorCfg = &cfg
+	a.janitorMu.Unlock()
+
+	/* Wake the loop so it picks up the new interval */
+	if a.janitorReset != nil {
+		select {
+		case a.janitorReset <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+/*
+RunJanitor performs one purge right away and returns what it deleted.
+It is safe to call while the background loop is running; runs never overlap.
+A failure on one table does not stop the others, and all errors are returned.
+*/
+func (a *Auth) RunJanitor() (JanitorCounts, error) {
+	if a.Conn == nil {
+		return JanitorCounts{}, ErrDatabaseUnavailable
+	}
+
+	a.janitorRunMu.Lock()
+	defer a.janitorRunMu.Unlock()
+
+	cfg := a.janitorConfig()
+	start := time.Now()
+
+	var counts JanitorCounts
+	var errs []error
+	purge := func(dst *int64, table, key, cond string, args ...any) {
+		n, err := a.purgeInBatches(table, key, cond, cfg.BatchSize, args...)
+		*dst = n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", table, err))
+		}
+	}
+
+	purge(&counts.OTPs, "otps", "ctid", "expires_at < NOW()")
+	purge(&counts.ExpiredRefreshTokens, "refresh_tokens", "token", "revoked = false AND expires_at < NOW()")
+	purge(&counts.RevokedRefreshTokens, "refresh_tokens", "token",
+		"revoked = true AND expires_at < NOW() - $2 * INTERVAL '1 second'",
+		cfg.RevokedRetention.Seconds(),
+	)
+	purge(&counts.RevokedAccessTokens, "revoked_tokens", "jti", "expires_at < NOW()")
+	purge(&counts.MFAChallenges, "mfa_challenges", "token", "expires_at < NOW()")
+	purge(&counts.StepUpAttempts, "step_up_attempts", "ctid", "expires_at < NOW()")
+	purge(&counts.MagicLinks, "magic_links", "token", "expires_at < NOW()")
+	if err := a.wipeExpiredOutboxMessages(); err != nil {
+		errs = append(errs, fmt.Errorf("email_outbox: %w", err))
+	}
+	purge(&counts.DeadLetters, "email_outbox", "id",
+		"status = 'dead' AND created_at < NOW() - $2 * INTERVAL '1 second'",
+		cfg.DeadLetterRetention.Seconds(),
+	)
+
+	err := errors.Join(errs...)
+
+	a.janitorMu.Lock()
+	st := &a.janitorStats
+	st.Runs++
+	st.LastRun = start
+	st.LastDuration = time.Since(start)
+	st.LastError = ""
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+	}
+	st.Deleted.OTPs += counts.OTPs
+	st.Deleted.ExpiredRefreshTokens += counts.ExpiredRefreshTokens
+	st.Deleted.RevokedRefreshTokens += counts.RevokedRefreshTokens
+	st.Deleted.RevokedAccessTokens += counts.RevokedAccessTokens
+	st.Deleted.MFAChallenges += counts.MFAChallenges
+	st.Deleted.StepUpAttempts += counts.StepUpAttempts
+	st.Deleted.MagicLinks += counts.MagicLinks
+	st.Deleted.DeadLetters += counts.DeadLetters
+	a.janitorMu.Unlock()
+
+	return counts, err
+}
+
+/* JanitorStats returns a snapshot of the janitor's counters. */
+func (a *Auth) JanitorStats() JanitorStats {
+	a.janitorMu.Lock()
+	defer a.janitorMu.Unlock()
+	return a.janitorStats
+}
+
+/* janitorConfig returns the active configuration, or the defaults. */
+func (a *Auth) janitorConfig() JanitorConfig {
+	a.janitorMu.Lock()
+	defer a.janitorMu.Unlock()
+	if a.janitorCfg == nil {
+		return defaultJanitorConfig
+	}
+	return *a.janitorCfg
+}
+
+/*
+purgeInBatches deletes the rows of table matching cond, at most batch rows
+per statement, until none are left. key identifies a row: the primary key
+column, or ctid for tables with a composite key.
+cond may use $2 onwards for args; $1 is the batch size.
+table, key and cond are always constants from this package.
+*/
+func (a *Auth) purgeInBatches(table, key, cond string, batch int, args ...any) (int64, error) {
+	query := fmt.Sprintf(
+		"DELETE FROM %s WHERE %s IN (SELECT %s FROM %s WHERE %s LIMIT $1)",
+		table, key, key, table, cond,
+	)
+	params := append([]any{batch}, args...)
+
+	var total int64
+	for {
+		tag, err := a.Conn.Exec(a.ctx, query, params...)
+		if err != nil {
+			return total, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+		}
+		total += tag.RowsAffected()
+		if tag.RowsAffected() < int64(batch) {
+			return total, nil
+		}
+	}
+}
+
+/*
+startJanitor is an internal function that runs RunJanitor in the background
+every Interval until Close is called. It replaces the old OTP-only cleaner.
+*/
+func (a *Auth) startJanitor() {
+	a.janitorReset = make(chan struct{}, 1)
+
+	go func() {
+		for {
+			var tick <-chan time.Time
+			var timer *time.Timer
+			if interval := a.janitorConfig().Interval; interval > 0 {
+				timer = time.NewTimer(interval)
+				tick = timer.C
+			}
+
+			select {
+			case <-tick:
+				_, _ = a.RunJanitor()
+
+			case <-a.janitorReset:
+				/* Config changed: loop round and rearm with the new interval */
+
+			case <-a.ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+}
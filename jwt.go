@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -10,9 +12,20 @@ import (
 /*
 JWTClaims struct defines the custom claims for our JWT.
 It includes the standard RegisteredClaims and adds the user ID.
+SessionID is only set on tokens issued through IssueTokenPair and ties the
+access token to the refresh token session it was minted with.
+Confirmation is only set on DPoP-bound tokens.
+AMR, ACR and AuthTime are set on tokens from Login, CompleteMFA and StepUp:
+the authentication methods used (RFC 8176), the assurance level reached
+(ACRSingleFactor or ACRMultiFactor) and when the user last authenticated.
 */
 type JWTClaims struct {
-	UserID string `json:"user_id"`
+	UserID       string           `json:"user_id"`
+	SessionID    string           `json:"sid,omitempty"`
+	Confirmation *Confirmation    `json:"cnf,omitempty"`
+	AMR          []string         `json:"amr,omitempty"`
+	ACR          string           `json:"acr,omitempty"`
+	AuthTime     *jwt.NumericDate `json:"auth_time,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -49,7 +62,7 @@ func (a *Auth) GenerateToken(username string, expiryDuration ...time.Duration) (
 	if username == "" {
 		return "", ErrEmptyInput
 	}
-	if len(a.jwtSecret) == 0 {
+	if !a.canSignTokens() {
 		return "", ErrNotInitialized
 	}
 
@@ -61,15 +74,42 @@ func (a *Auth) GenerateToken(username string, expiryDuration ...time.Duration) (
 		duration = a.jwtExpiry
 	}
 
-	claims := JWTClaims{
+	claims, err := a.newClaims(username, duration)
+	if err != nil {
+		return "", err
+	}
+
+	return a.signClaims(claims)
+}
+
+/*
+newClaims builds the standard claim set for an access token.
+Callers may add optional claims (e.g. the session ID) before signing.
+*/
+func (a *Auth) newClaims(username string, duration time.Duration) (*JWTClaims, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token id: %w", err)
+	}
+
+	now := time.Now()
+	return &JWTClaims{
 		UserID: username,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 			Issuer:    "gcet-auth-library",
 			Subject:   username,
 		},
+	}, nil
+}
+
+/* signClaims serializes and signs the claims in the configured token format. */
+func (a *Auth) signClaims(claims *JWTClaims) (string, error) {
+	if a.tokenFormat != TokenFormatJWT {
+		return a.signPASETO(claims)
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -85,15 +125,54 @@ func (a *Auth) GenerateToken(username string, expiryDuration ...time.Duration) (
 /*
 ValidateToken parses a token string, validates its signature and claims,
 and returns the JWTClaims if the token is valid.
+When PASETOInit was used instead of JWTInit, the token is verified as PASETO v4.
+A DPoP-bound token (one with a cnf claim) is refused with ErrDPoPProofRequired:
+it is only accepted by ValidateDPoPToken together with a proof, so a stolen
+copy is useless on its own.
 
 It is recommended to use users.go->LoginJWT() instead, as this
 function may change.
 */
 func (a *Auth) ValidateToken(tokenString string) (*JWTClaims, error) {
-	if len(a.jwtSecret) == 0 {
+	claims, err := a.validateAccessToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Confirmation != nil {
+		return nil, ErrDPoPProofRequired
+	}
+	return claims, nil
+}
+
+/*
+validateAccessToken checks the signature, expiry and revocation of a token,
+bound or not. Callers other than ValidateDPoPToken must not treat a bound
+token as proof of anything without checking its binding.
+*/
+func (a *Auth) validateAccessToken(tokenString string) (*JWTClaims, error) {
+	if !a.canVerifyTokens() {
 		return nil, ErrNotInitialized
 	}
 
+	claims, err := a.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Signature and expiry are fine, now consult the deny-list and user watermark */
+	if err := a.checkAccessTokenRevoked(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+/* parseToken verifies the token in the configured format and returns its claims. */
+func (a *Auth) parseToken(tokenString string) (*JWTClaims, error) {
+	if a.tokenFormat != TokenFormatJWT {
+		return a.parsePASETO(tokenString)
+	}
+
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("%w: unexpected signing method: %v", ErrInvalidToken, token.Header["alg"])
@@ -105,9 +184,22 @@ func (a *Auth) ValidateToken(tokenString string) (*JWTClaims, error) {
 		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
 	}
 
-	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
 	}
 
-	return nil, ErrInvalidToken
+	return claims, nil
+}
+
+/*
+newTokenID generates a random, URL-safe identifier for the jti claim.
+16 bytes of entropy is plenty to make collisions practically impossible.
+*/
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
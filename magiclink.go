@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+MagicLinkConfig configures passwordless login links.
+SigningKey (at least 32 bytes) signs every link, so forged or altered links
+are rejected before the database is consulted. AllowedRedirects lists the
+URL prefixes a link may point to, e.g. "https://app.example.com/auth/magic"
+allows that page and the pages below it, but not "/auth/magic-other";
+anything else is refused, so a link cannot be made to hand its token to
+another site. Expiry defaults to 15 minutes. CreateUsers registers unknown
+emails on first use, the same way Google sign-in does.
+Subject and Body are text/template strings; they can use {{.Link}},
+{{.Minutes}} and {{.Email}}.
+*/
+type MagicLinkConfig struct {
+	SigningKey       []byte
+	AllowedRedirects []string
+	Expiry           time.Duration
+	CreateUsers      bool
+	Subject          string
+	Body             string
+}
+
+/* magicLinkSettings is a MagicLinkConfig with its URLs and templates parsed. */
+type magicLinkSettings struct {
+	key         []byte
+	redirects   []*url.URL
+	expiry      time.Duration
+	createUsers bool
+	subject     *template.Template
+	body        *template.Template
+}
+
+/* magicLinkEmailData is what the subject and body templates are rendered with. */
+type magicLinkEmailData struct {
+	Link    string
+	Minutes int
+	Email   string
+}
+
+const (
+	magicLinkIDSize = 32
+	/* magicLinkPurpose keys the send limits apart from the OTP purposes */
+	magicLinkPurpose OTPPurpose = "magic_link"
+)
+
+var (
+	defaultMagicLinkSubject = template.Must(template.New("subject").Parse("Your sign-in link"))
+	defaultMagicLinkBody    = template.Must(template.New("body").Parse("Click to sign in:\n\n{{.Link}}\n\nThe link works once and expires in {{.Minutes}} minutes. If you did not ask for it, ignore this email."))
+)
+
+/* MagicLinkInit enables SendMagicLink and ConsumeMagicLink. */
+func (a *Auth) MagicLinkInit(cfg MagicLinkConfig) error {
+	if len(cfg.SigningKey) < 32 {
+		return fmt.Errorf("%w: magic link signing key must be at least 32 bytes", ErrInvalidInput)
+	}
+	if len(cfg.AllowedRedirects) == 0 {
+		return fmt.Errorf("%w: at least one allowed redirect is required", ErrEmptyInput)
+	}
+	if cfg.Expiry < 0 {
+		return fmt.Errorf("%w: expiry %v", ErrInvalidInput, cfg.Expiry)
+	}
+
+	s := &magicLinkSettings{
+		key:         append([]byte(nil), cfg.SigningKey...),
+		expiry:      cfg.Expiry,
+		createUsers: cfg.CreateUsers,
+	}
+	if s.expiry == 0 {
+		s.expiry = 15 * time.Minute
+	}
+	for _, raw := range cfg.AllowedRedirects {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%w: allowed redirect %q must be an absolute http(s) URL", ErrInvalidInput, raw)
+		}
+		u.Path = cleanURLPath(u.Path)
+		s.redirects = append(s.redirects, u)
+	}
+	if cfg.Subject != "" {
+		tmpl, err := template.New("subject").Parse(cfg.Subject)
+		if err != nil {
+			return fmt.Errorf("%w: subject template: %v", ErrInvalidInput, err)
+		}
+		s.subject = tmpl
+	}
+	if cfg.Body != "" {
+		tmpl, err := template.New("body").Parse(cfg.Body)
+		if err != nil {
+			return fmt.Errorf("%w: body template: %v", ErrInvalidInput, err)
+		}
+		s.body = tmpl
+	}
+
+	a.magicLink = s
+	return nil
+}
+
+/*
+SendMagicLink emails the user a single-use sign-in link. The link is
+redirectURL with a token query parameter added; the page it opens should
+pass that token to ConsumeMagicLink. redirectURL must match one of the
+AllowedRedirects. Sends count against the OTPSendLimitsInit limits.
+*/
+func (a *Auth) SendMagicLink(userEmail, redirectURL string) (err error) {
+	if _, err := mail.ParseAddress(userEmail); err != nil {
+		return ErrInvalidEmail
+	}
+	s := a.magicLink
+	if s == nil {
+		return ErrMagicLinkNotInitialized
+	}
+	link, err := url.Parse(redirectURL)
+	if err != nil || !s.redirectAllowed(link) {
+		return fmt.Errorf("%w: redirect URL is not allowed", ErrInvalidInput)
+	}
+	if a.Conn == nil {
+		return ErrNotInitialized
+	}
+	if a.activeNotifier() == nil {
+		return ErrSMTPNotInitialized
+	}
+
+	if !s.createUsers {
+		var exists bool
+		err := a.Conn.QueryRow(a.ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE user_id = $1)", userEmail).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+	}
+
+	refund, err := a.checkOTPSendLimits(userEmail, magicLinkPurpose, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			refund()
+		}
+	}()
+
+	expiresAt := time.Now().Add(s.expiry)
+	token, digest, err := s.newToken(expiresAt)
+	if err != nil {
+		return err
+	}
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+
+	locale := a.userLocale(userEmail)
+	tmpl := a.messageTemplate(locale, "magic_link", "", s.template(), builtinMagicLinkTemplate)
+	data := magicLinkEmailData{Link: link.String(), Minutes: int(s.expiry.Minutes()), Email: userEmail}
+	subject, body, html, err := tmpl.render(data)
+	if err != nil {
+		return err
+	}
+	msg := Message{
+		Kind:    MessageKindMagicLink,
+		To:      userEmail,
+		Locale:  locale,
+		Subject: subject,
+		Body:    body,
+		HTML:    html,
+		Link:    data.Link,
+	}
+
+	return a.storeAndDeliver(msg, expiresAt, func(db dbExecer) error {
+		_, err := db.Exec(a.ctx,
+			"INSERT INTO magic_links (token, email, expires_at) VALUES ($1, $2, $3)",
+			digest, userEmail, expiresAt,
+		)
+		if err != nil {
+			return fmt.Errorf("%w: failed to store magic link: %v", ErrDatabaseUnavailable, err)
+		}
+		return nil
+	})
+}
+
+/*
+ConsumeMagicLink checks a token from a magic link and signs the user in.
+A token works once. Like Login, it returns a token pair, or an MFA challenge
+if the user has a second factor, so a link never bypasses MFA.
+*/
+func (a *Auth) ConsumeMagicLink(token string, info ...SessionInfo) (*LoginResult, error) {
+	if token == "" {
+		return nil, ErrEmptyInput
+	}
+	s := a.magicLink
+	if s == nil {
+		return nil, ErrMagicLinkNotInitialized
+	}
+	digest, err := s.verifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+	if !a.canSignTokens() {
+		return nil, ErrNotInitialized
+	}
+
+	var userEmail string
+	err = a.Conn.QueryRow(a.ctx,
+		"DELETE FROM magic_links WHERE token = $1 AND expires_at > NOW() RETURNING email",
+		digest,
+	).Scan(&userEmail)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMagicLinkInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	if s.createUsers {
+		if err := a.upsertOAuthUser(a.ctx, userEmail); err != nil {
+			return nil, err
+		}
+	}
+
+	return a.completeFirstFactor(userEmail, "otp", info)
+}
+
+/*
+newToken returns a random link token signed together with its expiry, and the
+digest it is stored under.
+*/
+func (s *magicLinkSettings) newToken(expiresAt time.Time) (string, string, error) {
+	payload := make([]byte, magicLinkIDSize+8)
+	if _, err := rand.Read(payload[:magicLinkIDSize]); err != nil {
+		return "", "", fmt.Errorf("failed to generate magic link: %w", err)
+	}
+	binary.BigEndian.PutUint64(payload[magicLinkIDSize:], uint64(expiresAt.Unix()))
+
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload))
+	return token, hashRefreshToken(token), nil
+}
+
+/* verifyToken checks the signature and expiry and returns the storage digest. */
+func (s *magicLinkSettings) verifyToken(token string) (string, error) {
+	enc := base64.RawURLEncoding
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrMagicLinkInvalid
+	}
+	payload, err := enc.DecodeString(body)
+	if err != nil || len(payload) != magicLinkIDSize+8 {
+		return "", ErrMagicLinkInvalid
+	}
+	mac, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return "", ErrMagicLinkInvalid
+	}
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(payload[magicLinkIDSize:])), 0)
+	if time.Now().After(expiresAt) {
+		return "", ErrMagicLinkInvalid
+	}
+	return hashRefreshToken(token), nil
+}
+
+/*
+template returns the MagicLinkConfig subject and body as an email template,
+or nil if neither was set.
+*/
+func (s *magicLinkSettings) template() *emailTemplate {
+	if s.subject == nil && s.body == nil {
+		return nil
+	}
+	t := &emailTemplate{subject: s.subject, text: s.body}
+	if t.subject == nil {
+		t.subject = defaultMagicLinkSubject
+	}
+	if t.text == nil {
+		t.text = defaultMagicLinkBody
+	}
+	return t
+}
+
+func (s *magicLinkSettings) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("magic-link:"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+/*
+redirectAllowed reports whether u starts with one of the allowed redirects:
+same scheme and host, and a path equal to or below the allowed path. The
+path is cleaned first, so "/auth/magic/../admin" is judged as the "/admin"
+the browser will open.
+*/
+func (s *magicLinkSettings) redirectAllowed(u *url.URL) bool {
+	if u.User != nil || u.Fragment != "" {
+		return false
+	}
+	p := cleanURLPath(u.Path)
+	for _, allowed := range s.redirects {
+		if u.Scheme != allowed.Scheme || !strings.EqualFold(u.Host, allowed.Host) {
+			continue
+		}
+		if p == allowed.Path || strings.HasPrefix(p, strings.TrimSuffix(allowed.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+/* cleanURLPath resolves dot segments and duplicate slashes; an empty path is "/". */
+func cleanURLPath(p string) string {
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,451 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+/* MFAFactor names a way of completing a login challenge or a step-up. */
+type MFAFactor string
+
+const (
+	MFAFactorEmailOTP     MFAFactor = "email_otp"
+	MFAFactorTOTP         MFAFactor = "totp"
+	MFAFactorRecoveryCode MFAFactor = "recovery_code"
+	/* MFAFactorPassword is only accepted by StepUp, to re-enter the password */
+	MFAFactorPassword MFAFactor = "password"
+)
+
+/* Authentication context classes (NIST SP 800-63B assurance levels) put in the acr claim. */
+const (
+	ACRSingleFactor = "aal1"
+	ACRMultiFactor  = "aal2"
+)
+
+/*
+MFAConfig controls the login state machine.
+ChallengeExpiry is how long a challenge token from Login stays usable
+(default 5 minutes) and MaxAttempts how many wrong codes it survives
+(default 5). StepUp gets the same budget per user and factor: MaxAttempts
+tries per ChallengeExpiry. EmailOTP offers a code by email as a factor to users whose user
+ID is an email address; as it needs no enrollment, it makes every such user
+go through a second step. It only applies once SMTPInit or NotifierInit
+has been called.
+*/
+type MFAConfig struct {
+	ChallengeExpiry time.Duration
+	MaxAttempts     int
+	EmailOTP        bool
+}
+
+/*
+MFAChallenge is returned by Login when a second factor is needed. Token is
+opaque and single-use; pass it to CompleteMFA with one of the Factors.
+*/
+type MFAChallenge struct {
+	Token     string      `json:"mfa_token"`
+	Factors   []MFAFactor `json:"factors"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+/*
+LoginResult is the outcome of a correct password. Exactly one field is set:
+Tokens when the user has no second factor, Challenge when they do.
+*/
+type LoginResult struct {
+	Tokens    *TokenPair    `json:"tokens,omitempty"`
+	Challenge *MFAChallenge `json:"challenge,omitempty"`
+}
+
+var defaultMFAConfig = MFAConfig{
+	ChallengeExpiry: 5 * time.Minute,
+	MaxAttempts:     5,
+}
+
+/* MFAInit replaces the login state machine settings. Zero fields keep their defaults. */
+func (a *Auth) MFAInit(cfg MFAConfig) error {
+	if cfg.ChallengeExpiry < 0 || cfg.MaxAttempts < 0 {
+		return fmt.Errorf("%w: mfa expiry and attempts cannot be negative", ErrInvalidInput)
+	}
+	if cfg.ChallengeExpiry == 0 {
+		cfg.ChallengeExpiry = defaultMFAConfig.ChallengeExpiry
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultMFAConfig.MaxAttempts
+	}
+
+	a.mfaMu.Lock()
+	a.mfaCfg = &cfg
+	a.mfaMu.Unlock()
+	return nil
+}
+
+/* mfaConfig returns the active configuration, or the defaults. */
+func (a *Auth) mfaConfig() MFAConfig {
+	a.mfaMu.Lock()
+	defer a.mfaMu.Unlock()
+	if a.mfaCfg == nil {
+		return defaultMFAConfig
+	}
+	return *a.mfaCfg
+}
+
+/*
+Login checks the password and either issues a token pair straight away or,
+for a user with a second factor, returns a challenge to complete with
+CompleteMFA. JWTInit (or PASETOInit) and RefreshTokenInit must have been
+called. Tokens carry amr ["pwd"] and acr ACRSingleFactor, or the
+multi-factor equivalents once the challenge is completed.
+*/
+func (a *Auth) Login(userID, password string, info ...SessionInfo) (*LoginResult, error) {
+	if userID == "" || password == "" {
+		return nil, ErrEmptyInput
+	}
+	if !a.canSignTokens() {
+		return nil, ErrNotInitialized
+	}
+	if err := a.LoginUser(userID, password); err != nil {
+		return nil, err
+	}
+
+	return a.completeFirstFactor(userID, "pwd", info)
+}
+
+/*
+completeFirstFactor is called once the user has proven the first factor, whose
+RFC 8176 method is amr. It issues tokens, or a challenge if MFA is needed.
+*/
+func (a *Auth) completeFirstFactor(userID, amr string, info []SessionInfo) (*LoginResult, error) {
+	factors, err := a.mfaFactors(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := newSessionSeed(userID, info)
+	seed.AMR = []string{amr}
+	if len(factors) == 0 {
+		seed.ACR = ACRSingleFactor
+		pair, err := a.issueSessionPair(seed)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{Tokens: pair}, nil
+	}
+
+	challenge, err := a.newMFAChallenge(seed, factors)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{Challenge: challenge}, nil
+}
+
+/*
+SendMFAEmailOTP emails a code for a challenge that offers MFAFactorEmailOTP.
+It is subject to the same send limits as SendOTP.
+*/
+func (a *Auth) SendMFAEmailOTP(challengeToken string) error {
+	if challengeToken == "" {
+		return ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	var userID string
+	var factors []string
+	err := a.Conn.QueryRow(a.ctx,
+		"SELECT user_id, factors FROM mfa_challenges WHERE token = $1 AND expires_at > NOW()",
+		hashRefreshToken(challengeToken),
+	).Scan(&userID, &factors)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrMFAChallengeInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if !slices.Contains(factors, string(MFAFactorEmailOTP)) {
+		return ErrMFAFactorNotAllowed
+	}
+
+	return a.SendOTPFor(userID, OTPPurposeMFA)
+}
+
+/*
+CompleteMFA checks the code for one of the challenge's factors and, if it is
+right, exchanges the challenge for a token pair. Every call uses up one of
+the challenge's attempts. Errors from the factor itself (ErrInvalidTOTP,
+ErrInvalidOTP, ErrInvalidRecoveryCode, ...) are returned as they are.
+*/
+func (a *Auth) CompleteMFA(challengeToken string, factor MFAFactor, code string) (*TokenPair, error) {
+	if challengeToken == "" || factor == "" || code == "" {
+		return nil, ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+	if !a.canSignTokens() {
+		return nil, ErrNotInitialized
+	}
+	digest := hashRefreshToken(challengeToken)
+
+	/* Claim an attempt and load the challenge in one statement, as VerifyOTP does */
+	seed := &RefreshToken{}
+	var factors, firstAMR []string
+	var deviceName, userAgent, ipAddress *string
+	err := a.Conn.QueryRow(a.ctx, `
+		UPDATE mfa_challenges SET attempts = attempts + 1
+		WHERE token = $1 AND expires_at > NOW() AND attempts < $2
+		RETURNING user_id, factors, amr, device_name, user_agent, ip_address`,
+		digest, a.mfaConfig().MaxAttempts,
+	).Scan(&seed.UserID, &factors, &firstAMR, &deviceName, &userAgent, &ipAddress)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMFAChallengeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if !slices.Contains(factors, string(factor)) {
+		return nil, ErrMFAFactorNotAllowed
+	}
+
+	amr, err := a.verifyFactor(seed.UserID, factor, OTPPurposeMFA, code)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Single use: only the request that deletes the row gets the tokens */
+	tag, err := a.Conn.Exec(a.ctx, "DELETE FROM mfa_challenges WHERE token = $1", digest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrMFAChallengeInvalid
+	}
+
+	seed.DeviceName = derefString(deviceName)
+	seed.UserAgent = derefString(userAgent)
+	seed.IPAddress = derefString(ipAddress)
+	if len(firstAMR) == 0 {
+		firstAMR = []string{"pwd"}
+	}
+	seed.AMR = firstAMR
+	for _, m := range []string{amr, "mfa"} {
+		if !slices.Contains(seed.AMR, m) {
+			seed.AMR = append(seed.AMR, m)
+		}
+	}
+	seed.ACR = ACRMultiFactor
+	return a.issueSessionPair(seed)
+}
+
+/*
+StepUp re-authenticates the holder of a valid access token, e.g. before a
+sensitive action, and returns a new access token for the same session with
+the factor added to amr and auth_time set to now. A second factor raises acr
+to ACRMultiFactor; MFAFactorPassword keeps the current level.
+For MFAFactorEmailOTP, send the code with SendOTPFor(userID, OTPPurposeStepUp).
+The new token expires when the old one would have, so a step-up never
+extends a session. DPoP-bound tokens go through StepUpDPoP instead.
+Every call uses up one of the user's attempts for that factor, as in
+CompleteMFA; once MFAConfig.MaxAttempts are used it returns a
+*RetryAfterError wrapping ErrStepUpAttemptsExceeded until the window ends.
+A successful step-up gives the factor its full budget back.
+*/
+func (a *Auth) StepUp(accessToken string, factor MFAFactor, code string) (string, error) {
+	if accessToken == "" || factor == "" || code == "" {
+		return "", ErrEmptyInput
+	}
+	claims, err := a.ValidateToken(accessToken)
+	if err != nil {
+		return "", err
+	}
+	return a.stepUp(claims, factor, code)
+}
+
+/*
+StepUpDPoP is StepUp for a DPoP-bound access token, checked together with
+its proof as in ValidateDPoPToken. The new token keeps the binding.
+*/
+func (a *Auth) StepUpDPoP(accessToken, proof, method, requestURL string, factor MFAFactor, code string) (string, error) {
+	if accessToken == "" || factor == "" || code == "" {
+		return "", ErrEmptyInput
+	}
+	claims, err := a.ValidateDPoPToken(accessToken, proof, method, requestURL)
+	if err != nil {
+		return "", err
+	}
+	return a.stepUp(claims, factor, code)
+}
+
+/* stepUpFactors are the factors StepUp accepts. */
+var stepUpFactors = []MFAFactor{MFAFactorTOTP, MFAFactorEmailOTP, MFAFactorRecoveryCode, MFAFactorPassword}
+
+/* stepUp verifies the factor and mints the stepped-up token from validated claims. */
+func (a *Auth) stepUp(claims *JWTClaims, factor MFAFactor, code string) (string, error) {
+	if !slices.Contains(stepUpFactors, factor) {
+		/* Checked first so made-up factor names do not get attempt rows */
+		return "", fmt.Errorf("%w: unknown mfa factor %q", ErrInvalidInput, factor)
+	}
+	if err := a.claimStepUpAttempt(claims.UserID, factor); err != nil {
+		return "", err
+	}
+	amr, err := a.verifyFactor(claims.UserID, factor, OTPPurposeStepUp, code)
+	if err != nil {
+		return "", err
+	}
+	if _, err := a.Conn.Exec(a.ctx,
+		"DELETE FROM step_up_attempts WHERE user_id = $1 AND factor = $2",
+		claims.UserID, string(factor),
+	); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	stepped, err := a.newClaims(claims.UserID, a.jwtExpiry)
+	if err != nil {
+		return "", err
+	}
+	stepped.ExpiresAt = claims.ExpiresAt
+	stepped.SessionID = claims.SessionID
+	stepped.Confirmation = claims.Confirmation
+	stepped.AuthTime = jwt.NewNumericDate(time.Now())
+
+	stepped.AMR = slices.Clone(claims.AMR)
+	if !slices.Contains(stepped.AMR, amr) {
+		stepped.AMR = append(stepped.AMR, amr)
+	}
+	stepped.ACR = claims.ACR
+	if factor != MFAFactorPassword {
+		stepped.ACR = ACRMultiFactor
+		if !slices.Contains(stepped.AMR, "mfa") {
+			stepped.AMR = append(stepped.AMR, "mfa")
+		}
+	} else if stepped.ACR == "" {
+		stepped.ACR = ACRSingleFactor
+	}
+
+	return a.signClaims(stepped)
+}
+
+/*
+claimStepUpAttempt uses up one step-up attempt for the user and factor, the
+way CompleteMFA claims one from the challenge before checking the code. The
+count starts when the first attempt is made and runs for ChallengeExpiry.
+*/
+func (a *Auth) claimStepUpAttempt(userID string, factor MFAFactor) error {
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+	cfg := a.mfaConfig()
+
+	var attempts int
+	err := a.Conn.QueryRow(a.ctx, `
+		INSERT INTO step_up_attempts (user_id, factor, attempts, expires_at)
+		VALUES ($1, $2, 1, NOW() + $4 * INTERVAL '1 millisecond')
+		ON CONFLICT (user_id, factor) DO UPDATE SET
+			attempts = CASE WHEN step_up_attempts.expires_at <= NOW() THEN 1 ELSE step_up_attempts.attempts + 1 END,
+			expires_at = CASE WHEN step_up_attempts.expires_at <= NOW() THEN EXCLUDED.expires_at ELSE step_up_attempts.expires_at END
+		WHERE step_up_attempts.expires_at <= NOW() OR step_up_attempts.attempts < $3
+		RETURNING attempts`,
+		userID, string(factor), cfg.MaxAttempts, cfg.ChallengeExpiry.Milliseconds(),
+	).Scan(&attempts)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	var remaining float64
+	err = a.Conn.QueryRow(a.ctx,
+		"SELECT COALESCE(EXTRACT(EPOCH FROM expires_at - NOW()), 0)::float8 FROM step_up_attempts WHERE user_id = $1 AND factor = $2",
+		userID, string(factor),
+	).Scan(&remaining)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	wait := max(time.Duration(remaining*float64(time.Second)), 0)
+	return &RetryAfterError{Err: ErrStepUpAttemptsExceeded, RetryAfter: wait}
+}
+
+/*
+verifyFactor checks a code against one factor and returns the RFC 8176
+method it stands for. purpose is the OTP purpose used for email codes.
+*/
+func (a *Auth) verifyFactor(userID string, factor MFAFactor, purpose OTPPurpose, code string) (string, error) {
+	switch factor {
+	case MFAFactorTOTP:
+		return "otp", a.VerifyTOTP(userID, code)
+	case MFAFactorEmailOTP:
+		return "otp", a.VerifyOTPFor(userID, purpose, code)
+	case MFAFactorRecoveryCode:
+		/* Something the user wrote down, not something they hold */
+		return "kba", a.UseRecoveryCode(userID, code)
+	case MFAFactorPassword:
+		return "pwd", a.LoginUser(userID, code)
+	default:
+		return "", fmt.Errorf("%w: unknown mfa factor %q", ErrInvalidInput, factor)
+	}
+}
+
+/* mfaFactors lists the second factors the user can complete a login with. */
+func (a *Auth) mfaFactors(userID string) ([]MFAFactor, error) {
+	var factors []MFAFactor
+
+	totp, err := a.TOTPEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if totp {
+		factors = append(factors, MFAFactorTOTP)
+	}
+
+	if a.mfaConfig().EmailOTP && a.activeNotifier() != nil {
+		if _, err := mail.ParseAddress(userID); err == nil {
+			factors = append(factors, MFAFactorEmailOTP)
+		}
+	}
+
+	codes, err := a.RecoveryCodesRemaining(userID)
+	if err != nil {
+		return nil, err
+	}
+	if codes > 0 {
+		factors = append(factors, MFAFactorRecoveryCode)
+	}
+	return factors, nil
+}
+
+/* newMFAChallenge stores a challenge under the digest of a random token. */
+func (a *Auth) newMFAChallenge(seed *RefreshToken, factors []MFAFactor) (*MFAChallenge, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate mfa challenge: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	expiresAt := time.Now().Add(a.mfaConfig().ChallengeExpiry)
+
+	names := make([]string, len(factors))
+	for i, f := range factors {
+		names[i] = string(f)
+	}
+
+	_, err := a.Conn.Exec(a.ctx, `
+		INSERT INTO mfa_challenges (token, user_id, factors, amr, device_name, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		hashRefreshToken(token), seed.UserID, names, seed.AMR,
+		nullIfEmpty(seed.DeviceName), nullIfEmpty(seed.UserAgent), nullIfEmpty(seed.IPAddress), expiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to store mfa challenge: %v", ErrDatabaseUnavailable, err)
+	}
+
+	return &MFAChallenge{Token: token, Factors: factors, ExpiresAt: expiresAt}, nil
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GCET-Open-Source-Foundation/auth/email"
+)
+
+/* MessageKind tells a Notifier which flow a message belongs to. */
+type MessageKind string
+
+const (
+	MessageKindOTP       MessageKind = "otp"
+	MessageKindMagicLink MessageKind = "magic_link"
+)
+
+/*
+Message is one notification for a user. To is the recipient the flow was
+called with, normally an email address, and Locale their preferred language
+if SetUserLocale stored one. Subject, Body and HTML are the rendered email;
+HTML is empty when the template has no HTML part. Code and Link are the raw
+values, so a channel with its own format, such as SMS, can write a shorter
+text. Only the field matching Kind is set.
+*/
+type Message struct {
+	Kind    MessageKind `json:"kind"`
+	To      string      `json:"to"`
+	Purpose OTPPurpose  `json:"purpose,omitempty"`
+	Locale  string      `json:"locale,omitempty"`
+	Subject string      `json:"subject"`
+	Body    string      `json:"body"`
+	HTML    string      `json:"html,omitempty"`
+	Code    string      `json:"code,omitempty"`
+	Link    string      `json:"link,omitempty"`
+}
+
+/*
+Notifier delivers messages to users. SendOTP, SendMagicLink and the MFA
+email factor all go through it. Implementations must be safe for
+concurrent use.
+*/
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+/*
+NotifierInit routes all messages through n instead of SMTP. Use
+SMTPNotifier, WebhookNotifier, RecordingNotifier or your own, e.g. one that
+looks up the user's phone number and sends an SMS.
+*/
+func (a *Auth) NotifierInit(n Notifier) error {
+	if n == nil {
+		return ErrEmptyInput
+	}
+
+	a.notifierMu.Lock()
+	a.notifier = n
+	a.notifierMu.Unlock()
+	return nil
+}
+
+/*
+activeNotifier returns the notifier from NotifierInit, or one for the
+SMTPClientInit or SMTPInit settings, or nil if none was configured.
+*/
+func (a *Auth) activeNotifier() Notifier {
+	a.notifierMu.RLock()
+	n, client, from := a.notifier, a.smtpClient, a.smtpClientFrom
+	a.notifierMu.RUnlock()
+	if n != nil {
+		return n
+	}
+	if client != nil {
+		return &SMTPNotifier{From: from, Client: client}
+	}
+	if a.smtpHost != "" {
+		return &SMTPNotifier{Host: a.smtpHost, Port: a.smtpPort, From: a.smtpEmail, Password: a.smtpPassword}
+	}
+	return nil
+}
+
+/* notify delivers msg through the active notifier. */
+func (a *Auth) notify(msg Message) error {
+	n := a.activeNotifier()
+	if n == nil {
+		return ErrSMTPNotInitialized
+	}
+	if err := n.Notify(a.ctx, msg); err != nil {
+		return fmt.Errorf("failed to deliver %s message: %w", msg.Kind, err)
+	}
+	return nil
+}
+
+/*
+SMTPNotifier sends the message as an email, as multipart/alternative when
+it has an HTML body. It is what SMTPInit sets up. If Client is set it is used, and ctx cancels the send; otherwise
+Host, Port and Password are passed to email.Send.
+*/
+type SMTPNotifier struct {
+	Host     string
+	Port     string
+	From     string
+	Password string
+	Client   *email.Client
+}
+
+func (s *SMTPNotifier) Notify(ctx context.Context, msg Message) error {
+	content := email.Content{Subject: msg.Subject, Text: msg.Body, HTML: msg.HTML}
+	if s.Client != nil {
+		if err := s.Client.SendContent(ctx, s.From, msg.To, content); err != nil {
+			return fmt.Errorf("failed to send email via SMTP: %w", err)
+		}
+		return nil
+	}
+	return email.SendContent(s.Host, s.Port, s.From, s.Password, msg.To, content)
+}
+
+/*
+WebhookNotifier POSTs each message as JSON to URL, for delivery by another
+service. If Secret is set, the body is signed with HMAC-SHA256 and the hex
+digest sent in the X-Auth-Signature header as "sha256=<digest>", so the
+receiver can check the request came from us. Any non-2xx response is an
+error. Client defaults to one with a 10 second timeout.
+*/
+type WebhookNotifier struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, msg Message) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.Secret) > 0 {
+		mac := hmac.New(sha256.New, w.Secret)
+		mac.Write(body)
+		req.Header.Set("X-Auth-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+/*
+RecordingNotifier keeps every message in memory instead of delivering it.
+It is meant for tests: read the code or link a flow sent from Messages or Last.
+*/
+type RecordingNotifier struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (r *RecordingNotifier) Notify(ctx context.Context, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+/* Messages returns a copy of everything recorded so far. */
+func (r *RecordingNotifier) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.messages...)
+}
+
+/* Last returns the most recent message for the recipient, if any. */
+func (r *RecordingNotifier) Last(to string) (Message, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.messages) - 1; i >= 0; i-- {
+		if r.messages[i].To == to {
+			return r.messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+/* Reset forgets all recorded messages. */
+func (r *RecordingNotifier) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = nil
+}
@@ -6,8 +6,6 @@ import (
 	"math/big"
 	"net/mail"
 	"time"
-
-	"github.com/GCET-Open-Source-Foundation/auth/email"
 )
 
 /* OTPInit configures the OTP settings. If values are 0, defaults are used. */
@@ -24,15 +22,29 @@ func (a *Auth) OTPInit(length int, expiry time.Duration) error {
 	return nil
 }
 
-/* Helper: Generates a secure random number based on the configured OTP length */
-func (a *Auth) generateOTP() (string, error) {
+/*
+OTPMaxAttemptsInit sets how many wrong guesses a code survives (default 5).
+After that the code is dead and VerifyOTP returns ErrOTPAttemptsExceeded until
+a new one is sent, so a 6-digit code cannot be brute-forced within its expiry.
+*/
+func (a *Auth) OTPMaxAttemptsInit(max int) error {
+	if max < 1 {
+		return fmt.Errorf("%w: max attempts %d (must be at least 1)", ErrInvalidInput, max)
+	}
+
+	a.otpMaxAttempts = max
+	return nil
+}
+
+/* Helper: Generates a secure random number of the given length */
+func generateOTP(length int) (string, error) {
 	/* 1. Validation Guard */
-	if a.otpLength < 4 || a.otpLength > 10 {
-		return "", fmt.Errorf("%w: length %d (must be between 4 and 10)", ErrInvalidInput, a.otpLength)
+	if length < 4 || length > 10 {
+		return "", fmt.Errorf("%w: length %d (must be between 4 and 10)", ErrInvalidInput, length)
 	}
 
 	/* 2. Calculate the max value (e.g., 10^6 = 1,000,000)*/
-	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(a.otpLength)), nil)
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
 
 	/* 3. Generate secure random number */
 	n, err := rand.Int(rand.Reader, max)
@@ -41,69 +53,141 @@ func (a *Auth) generateOTP() (string, error) {
 	}
 
 	/* 4. Dynamically pad the string (e.g., 6 digits becomes %06d) */
-	return fmt.Sprintf("%0*d", a.otpLength, n), nil
+	return fmt.Sprintf("%0*d", length, n), nil
 }
 
 /*
 SendOTP generates an OTP, saves it to the DB (upsert), and emails it.
 Usage: auth.SendOTP("user@example.com")
+The code is for OTPPurposeLogin; use SendOTPFor for other flows.
 */
 func (a *Auth) SendOTP(userEmail string) error {
+	return a.SendOTPFor(userEmail, OTPPurposeLogin)
+}
+
+/*
+SendOTPFor works like SendOTP for the given purpose, using that purpose's
+length, expiry and email (see OTPPurposeInit). Sending a new code replaces
+any pending code for the same email and purpose only.
+*/
+func (a *Auth) SendOTPFor(userEmail string, purpose OTPPurpose) error {
+	return a.SendOTPFrom(userEmail, purpose, "")
+}
+
+/*
+SendOTPFrom works like SendOTPFor and also counts the send against the
+per-IP quota of OTPSendLimitsInit. When a limit is hit it returns a
+*RetryAfterError and no code is generated or emailed. A send that fails,
+e.g. because the mail server is down, is not counted.
+*/
+func (a *Auth) SendOTPFrom(userEmail string, purpose OTPPurpose, clientIP string) (err error) {
+	if purpose == "" {
+		return ErrEmptyInput
+	}
 	if _, err := mail.ParseAddress(userEmail); err != nil {
 		return ErrInvalidEmail
 	}
 	if a.Conn == nil {
 		return ErrNotInitialized
 	}
-	if a.smtpHost == "" {
+	if a.activeNotifier() == nil {
 		return ErrSMTPNotInitialized
 	}
 
+	refund, err := a.checkOTPSendLimits(userEmail, purpose, clientIP)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			refund()
+		}
+	}()
+
+	settings := a.otpSettingsFor(purpose)
+
 	/* 1. Generate Code */
-	code, err := a.generateOTP()
+	code, err := generateOTP(settings.length)
 	if err != nil {
 		return fmt.Errorf("failed to generate OTP: %w", err)
 	}
 
 	/* 2. Set Expiry (Uses the config field instead of hardcoded value) */
-	if a.otpExpiry <= 0 {
-		return fmt.Errorf("%w: duration %v", ErrInvalidInput, a.otpExpiry)
+	if settings.expiry <= 0 {
+		return fmt.Errorf("%w: duration %v", ErrInvalidInput, settings.expiry)
 	}
-	expiry := time.Now().Add(a.otpExpiry)
-	/* 3. Upsert into DB (Update if email exists, Insert if new) */
-	query := `
-		INSERT INTO otps (email, code, expires_at) 
-		VALUES ($1, $2, $3)
-		ON CONFLICT (email) 
-		DO UPDATE SET code = $2, expires_at = $3
-	`
-	_, err = a.Conn.Exec(a.ctx, query, userEmail, code, expiry)
+	expiry := time.Now().Add(settings.expiry)
+
+	/* 3. Render the email */
+	locale := a.userLocale(userEmail)
+	tmpl := a.messageTemplate(locale, "otp_"+string(purpose), "otp", settings.template(), builtinOTPTemplate)
+	/* Format to '5 minutes' instead of '5m0s' */
+	subject, body, html, err := tmpl.render(otpEmailData{
+		Code:    code,
+		Minutes: int(settings.expiry.Minutes()),
+		Email:   userEmail,
+		Purpose: purpose,
+	})
 	if err != nil {
-		return fmt.Errorf("db error saving OTP: %w", err)
+		return err
+	}
+	msg := Message{
+		Kind:    MessageKindOTP,
+		To:      userEmail,
+		Purpose: purpose,
+		Locale:  locale,
+		Subject: subject,
+		Body:    body,
+		HTML:    html,
+		Code:    code,
 	}
 
-	/* 4. Send Email */
-	subject := "Your Verification Code"
-	/* Format to '5 minutes' instead of '5m0s' */
-	minutes := int(a.otpExpiry.Minutes())
-	body := fmt.Sprintf("Your OTP is: %s\n\nValid for %d minutes.", code, minutes)
-	err = email.Send(
-		a.smtpHost, a.smtpPort,
-		a.smtpEmail, a.smtpPassword,
-		userEmail, subject, body,
-	)
+	/*
+		4. Upsert into DB (Update if email exists, Insert if new).
+		Only the Argon2 hash is stored, the same way as passwords, so a
+		database dump does not hand out live codes. A new code resets
+		the attempt counter.
+	*/
+	salt, err := generateSalt(16)
 	if err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
+		return fmt.Errorf("failed to generate OTP salt: %w", err)
 	}
+	query := `
+		INSERT INTO otps (email, purpose, code, salt, attempts, expires_at) 
+		VALUES ($1, $2, $3, $4, 0, $5)
+		ON CONFLICT (email, purpose) 
+		DO UPDATE SET code = $3, salt = $4, attempts = 0, expires_at = $5
+	`
+	hash := a.HashPassword(code, salt)
 
-	return nil
+	/* 5. Send it through the configured Notifier (SMTP by default), or queue it in the outbox */
+	return a.storeAndDeliver(msg, expiry, func(db dbExecer) error {
+		if _, err := db.Exec(a.ctx, query, userEmail, purpose, hash, salt, expiry); err != nil {
+			return fmt.Errorf("db error saving OTP: %w", err)
+		}
+		return nil
+	})
 }
 
 /*
 VerifyOTP checks if the code is correct and not expired.
 If valid, it deletes the OTP to prevent reuse.
+Every call uses up one attempt; once OTPMaxAttemptsInit's limit is reached the
+code is rejected with ErrOTPAttemptsExceeded, even if it is right.
+Only codes sent for OTPPurposeLogin are accepted; use VerifyOTPFor for others.
 */
 func (a *Auth) VerifyOTP(userEmail, inputCode string) error {
+	return a.VerifyOTPFor(userEmail, OTPPurposeLogin, inputCode)
+}
+
+/*
+VerifyOTPFor works like VerifyOTP but only accepts a code that was sent for
+the given purpose, so e.g. a login code cannot confirm a password reset.
+*/
+func (a *Auth) VerifyOTPFor(userEmail string, purpose OTPPurpose, inputCode string) error {
+	if purpose == "" {
+		return ErrEmptyInput
+	}
 	if _, err := mail.ParseAddress(userEmail); err != nil {
 		return ErrInvalidEmail
 	}
@@ -111,18 +195,33 @@ func (a *Auth) VerifyOTP(userEmail, inputCode string) error {
 		return ErrDatabaseUnavailable
 	}
 
-	var storedCode string
+	var storedHash, salt string
 	var expiry time.Time
+	var attempts int
 
-	/* Get the OTP */
-	query := "SELECT code, expires_at FROM otps WHERE email = $1"
-	err := a.Conn.QueryRow(a.ctx, query, userEmail).Scan(&storedCode, &expiry)
+	/*
+		Claim an attempt and fetch the OTP in one statement, so parallel
+		guesses cannot get more than the allowed number of comparisons.
+	*/
+	query := `
+		UPDATE otps SET attempts = attempts + 1
+		WHERE email = $1 AND purpose = $2 AND attempts < $3
+		RETURNING code, salt, expires_at, attempts
+	`
+	err := a.Conn.QueryRow(a.ctx, query, userEmail, purpose, a.otpMaxAttempts).Scan(&storedHash, &salt, &expiry, &attempts)
 	if err != nil {
+		exists, existsErr := a.otpExists(userEmail, purpose)
+		if existsErr == nil && exists {
+			return ErrOTPAttemptsExceeded
+		}
 		return ErrInvalidOTP /* OTP not found */
 	}
 
-	/* Check match and expiry */
-	if storedCode != inputCode {
+	/* Check match (constant time) and expiry */
+	if !a.comparePasswords(inputCode, salt, storedHash) {
+		if attempts >= a.otpMaxAttempts {
+			return ErrOTPAttemptsExceeded
+		}
 		return ErrInvalidOTP
 	}
 	if time.Now().After(expiry) {
@@ -130,42 +229,17 @@ func (a *Auth) VerifyOTP(userEmail, inputCode string) error {
 	}
 
 	/* Valid! Delete it. */
-	_, _ = a.Conn.Exec(a.ctx, "DELETE FROM otps WHERE email = $1", userEmail)
+	_, _ = a.Conn.Exec(a.ctx, "DELETE FROM otps WHERE email = $1 AND purpose = $2", userEmail, purpose)
 	return nil
 }
 
-/*
-startOTPCleanup is an internal function that runs in the background.
-It periodically deletes expired OTPs from the database.
-The cleanup cycle is fixed (5 minutes) to ensure consistent performance
-regardless of the configured OTP expiration duration.
-*/
-func (a *Auth) startOTPCleanup() {
-	/* Fixed 5-minute interval to prevent DB stress */
-	ticker := time.NewTicker(5 * time.Minute)
-
-	go func() {
-		/* Ensure the ticker stops when we exit to prevent leaks */
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				/* The Timer ticked: Do the work */
-				if a.Conn != nil {
-					_, _ = a.Conn.Exec(a.ctx, "DELETE FROM otps WHERE expires_at < NOW()")
-				}
-
-			case <-a.ctx.Done():
-				/* The Context was cancelled: STOP EVERYTHING */
-				/* This returns from the function, killing the goroutine "neatly" */
-				return
-			}
-		}
-	}()
+/* OTPExists reports whether the email has an unexpired OTP of any purpose. */
+func (a *Auth) OTPExists(userEmail string) (bool, error) {
+	return a.otpExists(userEmail, "")
 }
 
-func (a *Auth) OTPExists(userEmail string) (bool, error) {
+/* otpExists is OTPExists limited to one purpose; an empty purpose matches any. */
+func (a *Auth) otpExists(userEmail string, purpose OTPPurpose) (bool, error) {
 	if _, err := mail.ParseAddress(userEmail); err != nil {
 		return false, ErrInvalidEmail
 	}
@@ -174,8 +248,8 @@ func (a *Auth) OTPExists(userEmail string) (bool, error) {
 	}
 
 	var exists bool
-	query := "SELECT EXISTS(SELECT 1 FROM otps WHERE email = $1 AND expires_at > NOW())"
-	err := a.Conn.QueryRow(a.ctx, query, userEmail).Scan(&exists)
+	query := "SELECT EXISTS(SELECT 1 FROM otps WHERE email = $1 AND ($2 = '' OR purpose = $2) AND expires_at > NOW())"
+	err := a.Conn.QueryRow(a.ctx, query, userEmail, purpose).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
 	}
@@ -188,7 +262,7 @@ func (a *Auth) ListActiveOTPs(limit, offset int) ([]string, error) {
 		return nil, ErrDatabaseUnavailable
 	}
 
-	query := "SELECT email FROM otps WHERE expires_at > NOW() LIMIT $1 OFFSET $2"
+	query := "SELECT DISTINCT email FROM otps WHERE expires_at > NOW() ORDER BY email LIMIT $1 OFFSET $2"
 	rows, err := a.Conn.Query(a.ctx, query, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+OTPSendLimits caps how often OTP emails go out, so a script cannot flood an
+inbox or burn through the SMTP quota. A zero field turns that limit off.
+ResendInterval is the minimum time between two codes for the same email and
+purpose. PerRecipientDaily caps the codes one email receives in 24 hours,
+across all purposes. PerIPDaily caps the codes requested from one client IP
+in 24 hours; it only applies to SendOTPFrom.
+*/
+type OTPSendLimits struct {
+	ResendInterval    time.Duration
+	PerRecipientDaily int
+	PerIPDaily        int
+}
+
+/*
+RetryAfterError is returned when a send limit is hit. It unwraps to
+ErrOTPResendCooldown or ErrRateLimitExceeded, and RetryAfter is how long the
+caller must wait, e.g. for a Retry-After header.
+*/
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", e.Err, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+/* limiter is what RateLimiter and RedisRateLimiter have in common. */
+type limiter interface {
+	Allow(ctx context.Context, key string) error
+	RetryAfter(ctx context.Context, key string) (time.Duration, error)
+	release(ctx context.Context, key string) error
+}
+
+/* otpLimiters holds the limiters built by OTPSendLimitsInit; nil ones are off. */
+type otpLimiters struct {
+	resend    limiter
+	recipient limiter
+	ip        limiter
+}
+
+/* otpLimitCheck is one limiter applied to one key. */
+type otpLimitCheck struct {
+	lim     limiter
+	key     string
+	onLimit error
+}
+
+/*
+OTPSendLimitsInit turns on send limits for SendOTP, SendOTPFor and
+SendOTPFrom. The counters live in Redis when RedisInit was called first, so
+they are shared between instances; otherwise they are kept in memory.
+Calling it again replaces the limits and starts the counters from zero.
+*/
+func (a *Auth) OTPSendLimitsInit(cfg OTPSendLimits) error {
+	if cfg.ResendInterval < 0 || cfg.PerRecipientDaily < 0 || cfg.PerIPDaily < 0 {
+		return fmt.Errorf("%w: otp send limits cannot be negative", ErrInvalidInput)
+	}
+
+	var lims otpLimiters
+	var err error
+	if cfg.ResendInterval > 0 {
+		lims.resend, err = a.newLimiter(RateLimiterConfig{MaxRequests: 1, Window: cfg.ResendInterval})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.PerRecipientDaily > 0 {
+		lims.recipient, err = a.newLimiter(RateLimiterConfig{MaxRequests: cfg.PerRecipientDaily, Window: 24 * time.Hour})
+		if err != nil {
+			lims.stop()
+			return err
+		}
+	}
+	if cfg.PerIPDaily > 0 {
+		lims.ip, err = a.newLimiter(RateLimiterConfig{MaxRequests: cfg.PerIPDaily, Window: 24 * time.Hour})
+		if err != nil {
+			lims.stop()
+			return err
+		}
+	}
+
+	a.otpMu.Lock()
+	old := a.otpLimits
+	a.otpLimits = &lims
+	a.otpMu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	return nil
+}
+
+/* newLimiter returns a Redis-backed limiter if Redis is set up, else an in-memory one. */
+func (a *Auth) newLimiter(cfg RateLimiterConfig) (limiter, error) {
+	if a.redisClient != nil {
+		return a.NewRedisRateLimiter(cfg)
+	}
+	return NewRateLimiter(cfg)
+}
+
+/* stop shuts down the cleanup goroutines of in-memory limiters. */
+func (l *otpLimiters) stop() {
+	for _, lim := range []limiter{l.resend, l.recipient, l.ip} {
+		if rl, ok := lim.(*RateLimiter); ok {
+			rl.Stop()
+		}
+	}
+}
+
+/*
+checkOTPSendLimits records one send for the recipient and client IP, or
+returns a *RetryAfterError if any limit is reached. Every limit is checked
+before any is counted, so a rejected request does not use up quota.
+The returned refund takes the send back; call it if the code is not sent
+after all, so a delivery failure does not cost the user a send.
+If the Redis backend is down it fails closed with ErrRateLimitBackendDown.
+*/
+func (a *Auth) checkOTPSendLimits(userEmail string, purpose OTPPurpose, clientIP string) (refund func(), err error) {
+	a.otpMu.RLock()
+	lims := a.otpLimits
+	a.otpMu.RUnlock()
+	if lims == nil {
+		return func() {}, nil
+	}
+
+	recipient := strings.ToLower(strings.TrimSpace(userEmail))
+	var checks []otpLimitCheck
+	if lims.resend != nil {
+		checks = append(checks, otpLimitCheck{lims.resend, "otp_resend:" + string(purpose) + ":" + recipient, ErrOTPResendCooldown})
+	}
+	if lims.recipient != nil {
+		checks = append(checks, otpLimitCheck{lims.recipient, "otp_daily:" + recipient, ErrRateLimitExceeded})
+	}
+	if lims.ip != nil && clientIP != "" {
+		checks = append(checks, otpLimitCheck{lims.ip, "otp_ip:" + clientIP, ErrRateLimitExceeded})
+	}
+
+	for _, c := range checks {
+		wait, err := c.lim.RetryAfter(a.ctx, c.key)
+		if err != nil {
+			return nil, err
+		}
+		if wait > 0 {
+			return nil, &RetryAfterError{Err: c.onLimit, RetryAfter: wait}
+		}
+	}
+
+	var counted []otpLimitCheck
+	refund = func() {
+		/* Best effort: a failed refund only costs the user one send */
+		for _, c := range counted {
+			_ = c.lim.release(a.ctx, c.key)
+		}
+	}
+	for _, c := range checks {
+		err := c.lim.Allow(a.ctx, c.key)
+		if errors.Is(err, ErrRateLimitExceeded) {
+			/* Lost a race with a parallel send */
+			refund()
+			wait, _ := c.lim.RetryAfter(a.ctx, c.key)
+			return nil, &RetryAfterError{Err: c.onLimit, RetryAfter: wait}
+		}
+		if err != nil {
+			refund()
+			return nil, err
+		}
+		counted = append(counted, c)
+	}
+	return refund, nil
+}
@@ -0,0 +1,517 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/* OutboxStatus is the state of a queued message. */
+type OutboxStatus string
+
+const (
+	/* OutboxPending messages are waiting for their first or next attempt */
+	OutboxPending OutboxStatus = "pending"
+	/* OutboxDead messages ran out of attempts or expired; they are not retried */
+	OutboxDead OutboxStatus = "dead"
+)
+
+/*
+OutboxConfig controls the email outbox.
+PollInterval is how often the worker looks for due messages (default 2
+seconds); new messages also wake it at once. BatchSize caps the messages
+claimed per pass (default 50). A failed delivery is retried after
+MinBackoff, doubling each time up to MaxBackoff (defaults 5 seconds and 15
+minutes), until MaxAttempts (default 8) is reached and the message is dead
+lettered. Lease is how long a claimed message is hidden from other workers
+(default 1 minute); if a worker dies mid-send, the message is picked up
+again after it.
+EncryptionKey is an optional 32-byte AES-256 key. Queued messages carry the
+code or link in clear, so set it unless the database is as trusted as the
+mail server; keep it outside the database. Either way a message's content
+is wiped once its code or link expires.
+*/
+type OutboxConfig struct {
+	PollInterval  time.Duration
+	BatchSize     int
+	MaxAttempts   int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	Lease         time.Duration
+	EncryptionKey []byte
+}
+
+/*
+OutboxMessage describes a queued message for inspection. The rendered
+email itself is not included, since it carries the code or link.
+*/
+type OutboxMessage struct {
+	ID            int64        `json:"id"`
+	Kind          MessageKind  `json:"kind"`
+	To            string       `json:"to"`
+	Status        OutboxStatus `json:"status"`
+	Attempts      int          `json:"attempts"`
+	LastError     string       `json:"last_error,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	NextAttemptAt time.Time    `json:"next_attempt_at"`
+	ExpiresAt     *time.Time   `json:"expires_at,omitempty"`
+}
+
+var defaultOutboxConfig = OutboxConfig{
+	PollInterval: 2 * time.Second,
+	BatchSize:    50,
+	MaxAttempts:  8,
+	MinBackoff:   5 * time.Second,
+	MaxBackoff:   15 * time.Minute,
+	Lease:        time.Minute,
+}
+
+/*
+OutboxInit turns on queued delivery. From then on SendOTP, SendMagicLink and
+the MFA email factor write their message to the email_outbox table in the
+same transaction as the code or link, and return without waiting for the
+Notifier; a background worker delivers it, retrying on failure. Delivery is
+at least once: a message may be sent twice if the process dies right after
+sending it. Calling OutboxInit again replaces the configuration.
+*/
+func (a *Auth) OutboxInit(cfg OutboxConfig) error {
+	if cfg.PollInterval < 0 || cfg.BatchSize < 0 || cfg.MaxAttempts < 0 ||
+		cfg.MinBackoff < 0 || cfg.MaxBackoff < 0 || cfg.Lease < 0 {
+		return fmt.Errorf("%w: outbox settings cannot be negative", ErrInvalidInput)
+	}
+	if cfg.EncryptionKey != nil && len(cfg.EncryptionKey) != 32 {
+		return fmt.Errorf("%w: outbox encryption key must be 32 bytes", ErrInvalidInput)
+	}
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultOutboxConfig.PollInterval
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = defaultOutboxConfig.BatchSize
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultOutboxConfig.MaxAttempts
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = defaultOutboxConfig.MinBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = defaultOutboxConfig.MaxBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		return fmt.Errorf("%w: max backoff %v is below min backoff %v", ErrInvalidInput, cfg.MaxBackoff, cfg.MinBackoff)
+	}
+	if cfg.Lease == 0 {
+		cfg.Lease = defaultOutboxConfig.Lease
+	}
+	if cfg.EncryptionKey != nil {
+		cfg.EncryptionKey = append([]byte(nil), cfg.EncryptionKey...)
+	}
+
+	/* Start the worker before enabling the outbox, so the wake channel exists */
+	a.outboxOnce.Do(a.startOutboxWorker)
+
+	a.outboxMu.Lock()
+	a.outboxCfg = &cfg
+	a.outboxMu.Unlock()
+	a.wakeOutbox()
+	return nil
+}
+
+/* outboxConfig returns the active configuration, or nil if the outbox is off. */
+func (a *Auth) outboxConfig() *OutboxConfig {
+	a.outboxMu.Lock()
+	defer a.outboxMu.Unlock()
+	return a.outboxCfg
+}
+
+/*
+storeAndDeliver runs store, the flow's own writes, and delivers msg. With the
+outbox on, both happen in one transaction, so a message is queued exactly
+when its code or link is saved. Otherwise msg is sent right after store.
+expiresAt is when the message stops being worth sending.
+*/
+func (a *Auth) storeAndDeliver(msg Message, expiresAt time.Time, store func(db dbExecer) error) error {
+	cfg := a.outboxConfig()
+	if cfg == nil {
+		if err := store(a.Conn); err != nil {
+			return err
+		}
+		return a.notify(msg)
+	}
+
+	payload, err := sealOutboxMessage(cfg.EncryptionKey, msg)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.Conn.Begin(a.ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	defer tx.Rollback(a.ctx)
+
+	if err := store(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(a.ctx,
+		"INSERT INTO email_outbox (kind, recipient, message, expires_at) VALUES ($1, $2, $3, $4)",
+		msg.Kind, msg.To, string(payload), expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("%w: failed to queue message: %v", ErrDatabaseUnavailable, err)
+	}
+	if err := tx.Commit(a.ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	a.wakeOutbox()
+	return nil
+}
+
+/* outboxJob is a claimed message. */
+type outboxJob struct {
+	id        int64
+	recipient string
+	payload   []byte
+	attempts  int
+	expired   bool
+}
+
+/* sealedOutboxMessage is how a message is stored when the outbox has a key. */
+type sealedOutboxMessage struct {
+	Sealed []byte `json:"sealed"`
+}
+
+/*
+sealOutboxMessage encodes msg for the message column, encrypted with
+AES-256-GCM when key is set. The recipient is bound in as additional data,
+so a ciphertext copied to another row does not decrypt.
+*/
+func sealOutboxMessage(key []byte, msg Message) ([]byte, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode outbox message: %w", err)
+	}
+	if key == nil {
+		return payload, nil
+	}
+
+	gcm, err := outboxCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return json.Marshal(sealedOutboxMessage{Sealed: gcm.Seal(nonce, nonce, payload, []byte(msg.To))})
+}
+
+/* openOutboxMessage reverses sealOutboxMessage; unencrypted rows are read as they are. */
+func openOutboxMessage(key []byte, recipient string, payload []byte) (Message, error) {
+	var msg Message
+	var sealed sealedOutboxMessage
+	if err := json.Unmarshal(payload, &sealed); err != nil {
+		return msg, err
+	}
+	if sealed.Sealed != nil {
+		if key == nil {
+			return msg, errors.New("message is encrypted but the outbox has no key")
+		}
+		gcm, err := outboxCipher(key)
+		if err != nil {
+			return msg, err
+		}
+		n := gcm.NonceSize()
+		if len(sealed.Sealed) < n {
+			return msg, errors.New("encrypted message is too short")
+		}
+		payload, err = gcm.Open(nil, sealed.Sealed[:n], sealed.Sealed[n:], []byte(recipient))
+		if err != nil {
+			return msg, errors.New("message does not decrypt with this key")
+		}
+	}
+	err := json.Unmarshal(payload, &msg)
+	return msg, err
+}
+
+func outboxCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+RunOutbox makes one delivery pass right away and returns how many messages
+were delivered. It is safe to call while the worker is running, and from
+several processes: each message is claimed by one of them only.
+*/
+func (a *Auth) RunOutbox() (int, error) {
+	if a.Conn == nil {
+		return 0, ErrDatabaseUnavailable
+	}
+	cfg := a.outboxConfig()
+	if cfg == nil {
+		c := defaultOutboxConfig
+		cfg = &c
+	}
+
+	/* Claiming counts as an attempt and hides the row for the lease */
+	rows, err := a.Conn.Query(a.ctx, `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, message, attempts, COALESCE(expires_at <= NOW(), false)
+	`, cfg.BatchSize, cfg.Lease.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	jobs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (outboxJob, error) {
+		var j outboxJob
+		err := row.Scan(&j.id, &j.recipient, &j.payload, &j.attempts, &j.expired)
+		return j, err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	delivered := 0
+	var errs []error
+	for _, j := range jobs {
+		ok, err := a.deliverOutboxJob(cfg, j)
+		if ok {
+			delivered++
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return delivered, errors.Join(errs...)
+}
+
+/*
+deliverOutboxJob sends one claimed message and records the outcome. Delivery
+failures are recorded on the row, not returned; the error is for the
+database only.
+*/
+func (a *Auth) deliverOutboxJob(cfg *OutboxConfig, j outboxJob) (bool, error) {
+	if j.expired {
+		return false, a.deadLetter(j.id, "expired before it could be delivered", true)
+	}
+	msg, err := openOutboxMessage(cfg.EncryptionKey, j.recipient, j.payload)
+	if err != nil {
+		return false, a.deadLetter(j.id, "unreadable message: "+err.Error(), false)
+	}
+
+	sendErr := a.notify(msg)
+	if sendErr == nil {
+		if _, err := a.Conn.Exec(a.ctx, "DELETE FROM email_outbox WHERE id = $1", j.id); err != nil {
+			return true, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+		}
+		return true, nil
+	}
+
+	if j.attempts >= cfg.MaxAttempts {
+		return false, a.deadLetter(j.id, sendErr.Error(), false)
+	}
+	_, err = a.Conn.Exec(a.ctx,
+		"UPDATE email_outbox SET last_error = $2, next_attempt_at = NOW() + $3 * INTERVAL '1 second' WHERE id = $1",
+		j.id, sendErr.Error(), outboxBackoff(cfg, j.attempts).Seconds(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	return false, nil
+}
+
+/*
+deadLetter stops retrying a message. wipe drops the rendered email, for
+messages whose code or link is no use any more.
+*/
+func (a *Auth) deadLetter(id int64, reason string, wipe bool) error {
+	_, err := a.Conn.Exec(a.ctx, `
+		UPDATE email_outbox
+		SET status = 'dead', last_error = $2, message = CASE WHEN $3 THEN NULL ELSE message END
+		WHERE id = $1
+	`, id, reason, wipe)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	return nil
+}
+
+/*
+wipeExpiredOutboxMessages drops the content of every message whose code or
+link has expired, so the table never holds a usable secret for longer than
+the secret itself lasts. Expired messages still pending, e.g. because no
+worker ran in time, are dead lettered on the way; ones a worker has claimed
+are left to it.
+*/
+func (a *Auth) wipeExpiredOutboxMessages() error {
+	_, err := a.Conn.Exec(a.ctx, `
+		UPDATE email_outbox
+		SET message = NULL, status = 'dead',
+			last_error = CASE WHEN status = 'pending' THEN 'expired before it could be delivered' ELSE last_error END
+		WHERE message IS NOT NULL AND expires_at <= NOW()
+			AND (status = 'dead' OR next_attempt_at <= NOW())
+	`)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	return nil
+}
+
+/*
+outboxBackoff returns the wait after the given number of failed attempts:
+MinBackoff doubled per attempt, capped at MaxBackoff, less up to a fifth at
+random so a burst of failures does not retry in lockstep.
+*/
+func outboxBackoff(cfg *OutboxConfig, attempts int) time.Duration {
+	d := cfg.MinBackoff
+	for i := 1; i < attempts && d < cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > cfg.MaxBackoff {
+		d = cfg.MaxBackoff
+	}
+	if jitter := int64(d / 5); jitter > 0 {
+		d -= time.Duration(mathrand.Int64N(jitter))
+	}
+	return d
+}
+
+/*
+OutboxMessages lists queued messages with the given status, oldest first.
+Use OutboxDead to find messages that could not be delivered.
+*/
+func (a *Auth) OutboxMessages(status OutboxStatus, limit, offset int) ([]OutboxMessage, error) {
+	if status != OutboxPending && status != OutboxDead {
+		return nil, fmt.Errorf("%w: outbox status %q", ErrInvalidInput, status)
+	}
+	if limit <= 0 || offset < 0 {
+		return nil, fmt.Errorf("%w: limit must be positive and offset not negative", ErrInvalidInput)
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+
+	rows, err := a.Conn.Query(a.ctx, `
+		SELECT id, kind, recipient, status, attempts, COALESCE(last_error, ''), created_at, next_attempt_at, expires_at
+		FROM email_outbox WHERE status = $1
+		ORDER BY id LIMIT $2 OFFSET $3
+	`, status, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	msgs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (OutboxMessage, error) {
+		var m OutboxMessage
+		err := row.Scan(&m.ID, &m.Kind, &m.To, &m.Status, &m.Attempts, &m.LastError,
+			&m.CreatedAt, &m.NextAttemptAt, &m.ExpiresAt)
+		return m, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	return msgs, nil
+}
+
+/*
+RetryOutboxMessage puts a dead message back in the queue with a fresh set of
+attempts. Messages that expired cannot be retried; the user has to ask for
+a new code or link.
+*/
+func (a *Auth) RetryOutboxMessage(id int64) error {
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+	tag, err := a.Conn.Exec(a.ctx, `
+		UPDATE email_outbox
+		SET status = 'pending', attempts = 0, last_error = NULL, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'dead' AND message IS NOT NULL
+			AND (expires_at IS NULL OR expires_at > NOW())
+	`, id)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrOutboxMessageNotFound
+	}
+	a.wakeOutbox()
+	return nil
+}
+
+/* DiscardOutboxMessage deletes a queued message, whatever its status. */
+func (a *Auth) DiscardOutboxMessage(id int64) error {
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+	tag, err := a.Conn.Exec(a.ctx, "DELETE FROM email_outbox WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrOutboxMessageNotFound
+	}
+	return nil
+}
+
+/* wakeOutbox asks the worker for a pass now instead of at the next poll. */
+func (a *Auth) wakeOutbox() {
+	if a.outboxWake == nil {
+		return
+	}
+	select {
+	case a.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+/* startOutboxWorker runs RunOutbox every PollInterval, or when woken, until Close. */
+func (a *Auth) startOutboxWorker() {
+	a.outboxWake = make(chan struct{}, 1)
+
+	go func() {
+		for {
+			interval := defaultOutboxConfig.PollInterval
+			if cfg := a.outboxConfig(); cfg != nil {
+				interval = cfg.PollInterval
+			}
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-timer.C:
+			case <-a.outboxWake:
+			case <-a.ctx.Done():
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+
+			/* Keep going while passes deliver something, so a backlog drains quickly */
+			for {
+				n, err := a.RunOutbox()
+				if err != nil || n == 0 || a.ctx.Err() != nil {
+					break
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,421 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+/*
+TokenFormat selects how access tokens are encoded.
+JWT (HS256) is the default; PASETO v4 is enabled through PASETOInit.
+*/
+type TokenFormat int
+
+const (
+	TokenFormatJWT TokenFormat = iota
+	TokenFormatPASETOLocal
+	TokenFormatPASETOPublic
+)
+
+const (
+	pasetoLocalHeader  = "v4.local."
+	pasetoPublicHeader = "v4.public."
+	pasetoNonceSize    = 32
+	pasetoTagSize      = 32
+)
+
+/*
+PASETOConfig configures PASETO v4 access tokens.
+
+Format must be TokenFormatPASETOLocal or TokenFormatPASETOPublic.
+v4.local tokens are encrypted and authenticated with the 32-byte LocalKey.
+v4.public tokens are signed with PrivateKey; a service that only verifies
+tokens can set PublicKey alone.
+Expiry works the same as in JWTInit.
+*/
+type PASETOConfig struct {
+	Format     TokenFormat
+	LocalKey   []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+	Expiry     time.Duration
+}
+
+/*
+PASETOInit switches GenerateToken, ValidateToken and LoginJWT to PASETO v4.
+The claims model is the same JWTClaims struct, so callers do not change;
+timestamps are encoded as RFC 3339 strings as the PASETO spec requires.
+
+Call it instead of JWTInit, immediately after auth.Init().
+Like JWTInit, only the first call takes effect.
+*/
+func (a *Auth) PASETOInit(cfg PASETOConfig) error {
+	switch cfg.Format {
+	case TokenFormatPASETOLocal:
+		if len(cfg.LocalKey) != chacha20.KeySize {
+			return fmt.Errorf("%w: v4.local key must be %d bytes", ErrInvalidInput, chacha20.KeySize)
+		}
+	case TokenFormatPASETOPublic:
+		if cfg.PrivateKey == nil && cfg.PublicKey == nil {
+			return fmt.Errorf("%w: v4.public needs a private or public key", ErrInvalidInput)
+		}
+		if cfg.PrivateKey != nil && len(cfg.PrivateKey) != ed25519.PrivateKeySize {
+			return fmt.Errorf("%w: invalid ed25519 private key", ErrInvalidInput)
+		}
+		if cfg.PublicKey != nil && len(cfg.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("%w: invalid ed25519 public key", ErrInvalidInput)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported PASETO format", ErrInvalidInput)
+	}
+
+	a.jwtOnce.Do(func() {
+		a.tokenFormat = cfg.Format
+		if cfg.Expiry > 0 {
+			a.jwtExpiry = cfg.Expiry
+		}
+
+		if cfg.Format == TokenFormatPASETOLocal {
+			a.pasetoLocalKey = append([]byte(nil), cfg.LocalKey...)
+			return
+		}
+
+		a.pasetoPrivateKey = cfg.PrivateKey
+		a.pasetoPublicKey = cfg.PublicKey
+		if a.pasetoPublicKey == nil {
+			a.pasetoPublicKey = cfg.PrivateKey.Public().(ed25519.PublicKey)
+		}
+	})
+	return nil
+}
+
+/* canSignTokens reports whether the configured token format can issue tokens. */
+func (a *Auth) canSignTokens() bool {
+	switch a.tokenFormat {
+	case TokenFormatPASETOLocal:
+		return len(a.pasetoLocalKey) > 0
+	case TokenFormatPASETOPublic:
+		return a.pasetoPrivateKey != nil
+	default:
+		return len(a.jwtSecret) > 0
+	}
+}
+
+/* canVerifyTokens reports whether the configured token format can validate tokens. */
+func (a *Auth) canVerifyTokens() bool {
+	switch a.tokenFormat {
+	case TokenFormatPASETOLocal:
+		return len(a.pasetoLocalKey) > 0
+	case TokenFormatPASETOPublic:
+		return a.pasetoPublicKey != nil
+	default:
+		return len(a.jwtSecret) > 0
+	}
+}
+
+/* signPASETO encodes the claims and produces a v4.local or v4.public token. */
+func (a *Auth) signPASETO(claims *JWTClaims) (string, error) {
+	payload, err := encodePASETOClaims(claims)
+	if err != nil {
+		return "", err
+	}
+
+	if a.tokenFormat == TokenFormatPASETOLocal {
+		return pasetoEncrypt(a.pasetoLocalKey, payload, nil, nil)
+	}
+	return pasetoSign(a.pasetoPrivateKey, payload, nil, nil), nil
+}
+
+/* parsePASETO verifies a token and checks its time-based claims. */
+func (a *Auth) parsePASETO(tokenString string) (*JWTClaims, error) {
+	var payload []byte
+	var err error
+	if a.tokenFormat == TokenFormatPASETOLocal {
+		payload, _, err = pasetoDecrypt(a.pasetoLocalKey, tokenString, nil)
+	} else {
+		payload, _, err = pasetoVerify(a.pasetoPublicKey, tokenString, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := decodePASETOClaims(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := jwt.NewValidator(jwt.WithExpirationRequired()).Validate(claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	return claims, nil
+}
+
+/* pasetoTimeClaims are the registered claims PASETO encodes as RFC 3339 strings. */
+var pasetoTimeClaims = []string{"exp", "iat", "nbf"}
+
+/*
+encodePASETOClaims marshals JWTClaims and rewrites the NumericDate fields into
+RFC 3339 strings. Going through the JSON form keeps every JWTClaims field,
+including ones added later, without a parallel struct to maintain.
+*/
+func encodePASETOClaims(claims *JWTClaims) ([]byte, error) {
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode claims: %w", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("failed to encode claims: %w", err)
+	}
+
+	for _, name := range pasetoTimeClaims {
+		if v, ok := fields[name].(float64); ok {
+			fields[name] = time.Unix(int64(v), 0).UTC().Format(time.RFC3339)
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+/* decodePASETOClaims is the inverse of encodePASETOClaims. */
+func decodePASETOClaims(payload []byte) (*JWTClaims, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+
+	for _, name := range pasetoTimeClaims {
+		v, ok := fields[name]
+		if !ok {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s must be an RFC 3339 string", ErrInvalidToken, name)
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be an RFC 3339 string", ErrInvalidToken, name)
+		}
+		fields[name] = t.Unix()
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+
+	var claims JWTClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+	return &claims, nil
+}
+
+/* pasetoEncrypt implements v4.local encryption (XChaCha20 + BLAKE2b-MAC). */
+func pasetoEncrypt(key, message, footer, implicit []byte) (string, error) {
+	nonce := make([]byte, pasetoNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	encKey, counterNonce, authKey, err := pasetoSplitKey(key, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(encKey, counterNonce)
+	if err != nil {
+		return "", fmt.Errorf("failed to initialize cipher: %w", err)
+	}
+	ciphertext := make([]byte, len(message))
+	cipher.XORKeyStream(ciphertext, message)
+
+	tag, err := pasetoMAC(authKey, pae([]byte(pasetoLocalHeader), nonce, ciphertext, footer, implicit))
+	if err != nil {
+		return "", err
+	}
+
+	body := make([]byte, 0, len(nonce)+len(ciphertext)+len(tag))
+	body = append(body, nonce...)
+	body = append(body, ciphertext...)
+	body = append(body, tag...)
+
+	return pasetoJoinToken(pasetoLocalHeader, body, footer), nil
+}
+
+/* pasetoDecrypt implements v4.local decryption, rejecting any tampered token. */
+func pasetoDecrypt(key []byte, token string, implicit []byte) (message, footer []byte, err error) {
+	body, footer, err := pasetoSplitToken(token, pasetoLocalHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) < pasetoNonceSize+pasetoTagSize {
+		return nil, nil, fmt.Errorf("%w: token too short", ErrInvalidToken)
+	}
+
+	nonce := body[:pasetoNonceSize]
+	ciphertext := body[pasetoNonceSize : len(body)-pasetoTagSize]
+	tag := body[len(body)-pasetoTagSize:]
+
+	encKey, counterNonce, authKey, err := pasetoSplitKey(key, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expected, err := pasetoMAC(authKey, pae([]byte(pasetoLocalHeader), nonce, ciphertext, footer, implicit))
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(tag, expected) != 1 {
+		return nil, nil, fmt.Errorf("%w: authentication tag mismatch", ErrInvalidToken)
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(encKey, counterNonce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize cipher: %w", err)
+	}
+	message = make([]byte, len(ciphertext))
+	cipher.XORKeyStream(message, ciphertext)
+
+	return message, footer, nil
+}
+
+/* pasetoSign implements v4.public signing. */
+func pasetoSign(key ed25519.PrivateKey, message, footer, implicit []byte) string {
+	sig := ed25519.Sign(key, pae([]byte(pasetoPublicHeader), message, footer, implicit))
+
+	body := make([]byte, 0, len(message)+len(sig))
+	body = append(body, message...)
+	body = append(body, sig...)
+
+	return pasetoJoinToken(pasetoPublicHeader, body, footer)
+}
+
+/* pasetoVerify implements v4.public verification and returns the message and footer. */
+func pasetoVerify(key ed25519.PublicKey, token string, implicit []byte) (message, footer []byte, err error) {
+	body, footer, err := pasetoSplitToken(token, pasetoPublicHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) < ed25519.SignatureSize {
+		return nil, nil, fmt.Errorf("%w: token too short", ErrInvalidToken)
+	}
+
+	message = body[:len(body)-ed25519.SignatureSize]
+	sig := body[len(body)-ed25519.SignatureSize:]
+
+	if !ed25519.Verify(key, pae([]byte(pasetoPublicHeader), message, footer, implicit), sig) {
+		return nil, nil, fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+	}
+
+	return message, footer, nil
+}
+
+/* pasetoJoinToken encodes the body, and the footer when there is one, after the header. */
+func pasetoJoinToken(header string, body, footer []byte) string {
+	token := header + base64.RawURLEncoding.EncodeToString(body)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token
+}
+
+/*
+pasetoSplitToken checks the header and decodes the body and optional footer.
+Checking the header here is what rules out algorithm confusion: a v4.public
+token is never accepted by a v4.local key or vice versa.
+*/
+func pasetoSplitToken(token, header string) (body, footer []byte, err error) {
+	if !strings.HasPrefix(token, header) {
+		return nil, nil, fmt.Errorf("%w: unexpected token header", ErrInvalidToken)
+	}
+
+	parts := strings.Split(token[len(header):], ".")
+	if len(parts) > 2 {
+		return nil, nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	/*
+		Strict decoding rejects non-zero padding bits, otherwise a token could
+		be altered in its last character and still open.
+	*/
+	body, err = base64.RawURLEncoding.Strict().DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed token body", ErrInvalidToken)
+	}
+
+	if len(parts) == 2 {
+		footer, err = base64.RawURLEncoding.Strict().DecodeString(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: malformed token footer", ErrInvalidToken)
+		}
+	}
+
+	return body, footer, nil
+}
+
+/* pasetoSplitKey derives the encryption key, counter nonce and auth key for v4.local. */
+func pasetoSplitKey(key, nonce []byte) (encKey, counterNonce, authKey []byte, err error) {
+	h, err := blake2b.New(56, key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to derive keys: %w", err)
+	}
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(nonce)
+	tmp := h.Sum(nil)
+
+	h, err = blake2b.New(32, key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to derive keys: %w", err)
+	}
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(nonce)
+
+	return tmp[:32], tmp[32:], h.Sum(nil), nil
+}
+
+/* pasetoMAC computes the keyed BLAKE2b-256 tag over the pre-authentication encoding. */
+func pasetoMAC(authKey, preAuth []byte) ([]byte, error) {
+	h, err := blake2b.New(pasetoTagSize, authKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute tag: %w", err)
+	}
+	h.Write(preAuth)
+	return h.Sum(nil), nil
+}
+
+/*
+pae is PASETO's pre-authentication encoding: the piece count followed by each
+piece prefixed with its length, all as little-endian 64-bit integers with the
+top bit cleared.
+*/
+func pae(pieces ...[]byte) []byte {
+	var buf bytes.Buffer
+	le64 := func(n int) {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(n)&^(1<<63))
+		buf.Write(b[:])
+	}
+
+	le64(len(pieces))
+	for _, p := range pieces {
+		le64(len(p))
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
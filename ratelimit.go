@@ -113,6 +113,43 @@ func (rl *RateLimiter) Remaining(ctx context.Context, key string) (int, error) {
 	return remaining, nil
 }
 
+/*
+RetryAfter returns how long the key must wait before Allow would succeed,
+or 0 if it has requests left in the current window.
+*/
+func (rl *RateLimiter) RetryAfter(ctx context.Context, key string) (time.Duration, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-rl.config.Window)
+
+	/* Timestamps are appended in order, so the first live one frees up next */
+	var live []time.Time
+	for _, ts := range rl.buckets[key] {
+		if ts.After(cutoff) {
+			live = append(live, ts)
+		}
+	}
+	if len(live) < rl.config.MaxRequests {
+		return 0, nil
+	}
+	return live[len(live)-rl.config.MaxRequests].Sub(cutoff), nil
+}
+
+/*
+release takes back the most recent request recorded for key, for callers
+that count a request up front and then fail to carry it out.
+*/
+func (rl *RateLimiter) release(ctx context.Context, key string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if n := len(rl.buckets[key]); n > 0 {
+		rl.buckets[key] = rl.buckets[key][:n-1]
+	}
+	return nil
+}
+
 /*
 Reset clears the rate limit state for a specific key.
 Useful when a user successfully authenticates and you want to clear failed-attempt counters.
@@ -251,6 +288,46 @@ func (rl *RedisRateLimiter) Remaining(ctx context.Context, key string) (int, err
 	return remaining, nil
 }
 
+/*
+RetryAfter returns how long the key must wait before Allow would succeed,
+or 0 if it has requests left in the current window.
+*/
+func (rl *RedisRateLimiter) RetryAfter(ctx context.Context, key string) (time.Duration, error) {
+	if key == "" {
+		return 0, ErrEmptyInput
+	}
+
+	now := time.Now()
+	cutoffMs := now.UnixMilli() - rl.config.Window.Milliseconds()
+
+	pipe := rl.client.Pipeline()
+	pipe.ZRemRangeByScore(ctx, "ratelimit:"+key, "0", fmt.Sprintf("%d", cutoffMs))
+	/* Newest MaxRequests entries, oldest first: the first of them frees up next */
+	oldestCmd := pipe.ZRangeWithScores(ctx, "ratelimit:"+key, int64(-rl.config.MaxRequests), int64(-rl.config.MaxRequests))
+	countCmd := pipe.ZCard(ctx, "ratelimit:"+key)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, ErrRateLimitBackendDown
+	}
+
+	if int(countCmd.Val()) < rl.config.MaxRequests || len(oldestCmd.Val()) == 0 {
+		return 0, nil
+	}
+	wait := int64(oldestCmd.Val()[0].Score) - cutoffMs
+	if wait < 0 {
+		return 0, nil
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+/* release takes back the most recent request recorded for key; see RateLimiter.release. */
+func (rl *RedisRateLimiter) release(ctx context.Context, key string) error {
+	if err := rl.client.ZPopMax(ctx, "ratelimit:"+key).Err(); err != nil {
+		return ErrRateLimitBackendDown
+	}
+	return nil
+}
+
 func (rl *RedisRateLimiter) Reset(ctx context.Context, key string) error {
 	if key == "" {
 		return ErrEmptyInput
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+const (
+	/* RecoveryCodeCount is how many codes GenerateRecoveryCodes returns. */
+	RecoveryCodeCount = 10
+
+	/*
+		12 characters of Crockford's base32 alphabet (no i, l, o or u, so
+		codes read back unambiguously) is 60 bits per code.
+	*/
+	recoveryCodeLength   = 12
+	recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+)
+
+/*
+GenerateRecoveryCodes creates a new batch of single-use recovery codes for a
+user and returns them in plain text. Show them to the user once; only Argon2
+hashes are stored. Any earlier batch stops working, used or not.
+*/
+func (a *Auth) GenerateRecoveryCodes(userID string) ([]string, error) {
+	if userID == "" {
+		return nil, ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+
+	/*
+		One salt for the batch: UseRecoveryCode then hashes the input once
+		and compares it against every code, instead of once per code.
+	*/
+	salt, err := generateSalt(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery code salt: %w", err)
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		codes[i] = code
+		hashes[i] = a.HashPassword(normalizeRecoveryCode(code), salt)
+	}
+
+	tx, err := a.Conn.Begin(a.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	defer tx.Rollback(a.ctx)
+
+	if _, err := tx.Exec(a.ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	_, err = tx.Exec(a.ctx, `
+		INSERT INTO recovery_codes (user_id, code_hash, salt)
+		SELECT $1, h, $3 FROM unnest($2::text[]) AS h
+	`, userID, hashes, salt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if err := tx.Commit(a.ctx); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	return codes, nil
+}
+
+/*
+UseRecoveryCode checks a recovery code and, if it is valid, marks it used so
+it cannot be presented again. Dashes, spaces and case are ignored.
+*/
+func (a *Auth) UseRecoveryCode(userID, code string) error {
+	if userID == "" || code == "" {
+		return ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	rows, err := a.Conn.Query(a.ctx,
+		"SELECT id, code_hash, salt FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	defer rows.Close()
+
+	input := normalizeRecoveryCode(code)
+	hashed := make(map[string]string) /* salt -> hash of input */
+	var matched int64
+	found := false
+	for rows.Next() {
+		var id int64
+		var storedHash, salt string
+		if err := rows.Scan(&id, &storedHash, &salt); err != nil {
+			return fmt.Errorf("failed to scan recovery code: %w", err)
+		}
+		h, ok := hashed[salt]
+		if !ok {
+			h = a.HashPassword(input, salt)
+			hashed[salt] = h
+		}
+		if subtle.ConstantTimeCompare([]byte(h), []byte(storedHash)) == 1 && !found {
+			matched, found = id, true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("row iteration error: %w", err)
+	}
+	if !found {
+		return ErrInvalidRecoveryCode
+	}
+
+	/* Claim the code; a parallel request with the same code gets 0 rows */
+	tag, err := a.Conn.Exec(a.ctx,
+		"UPDATE recovery_codes SET used_at = NOW() WHERE id = $1 AND used_at IS NULL",
+		matched,
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidRecoveryCode
+	}
+
+	remaining, _ := a.RecoveryCodesRemaining(userID)
+	a.emitSecurityEvent(SecurityEvent{
+		Type:   EventRecoveryCodeUsed,
+		UserID: userID,
+		Detail: fmt.Sprintf("%d recovery codes left", remaining),
+	})
+	return nil
+}
+
+/* RecoveryCodesRemaining returns how many unused recovery codes the user has. */
+func (a *Auth) RecoveryCodesRemaining(userID string) (int, error) {
+	if userID == "" {
+		return 0, ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return 0, ErrDatabaseUnavailable
+	}
+
+	var n int
+	err := a.Conn.QueryRow(a.ctx,
+		"SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	return n, nil
+}
+
+/* generateRecoveryCode returns a random code formatted as xxxx-xxxx-xxxx. */
+func generateRecoveryCode() (string, error) {
+	raw := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i, c := range raw {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		/* 256 is a multiple of 32, so the modulo is unbiased */
+		b.WriteByte(recoveryCodeAlphabet[int(c)%len(recoveryCodeAlphabet)])
+	}
+	return b.String(), nil
+}
+
+/* normalizeRecoveryCode strips the formatting users may type differently. */
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
@@ -1,42 +1,88 @@
 package auth
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
 )
 
 /*
 RefreshToken represents a stored refresh token in the database.
 Each refresh token is tied to a user and has an expiration time.
 Tokens can be individually revoked without affecting other tokens.
+SessionID stays the same across rotations, so every token in a rotation
+chain (and every access token minted alongside it) shares one session.
+DPoPJKT is set when the session is bound to a DPoP key (see dpop.go).
+The device fields come from the SessionInfo given at login and are carried
+over on rotation, as is SessionStartedAt.
 */
 type RefreshToken struct {
-	Token     string    `json:"token"`
-	UserID    string    `json:"user_id"`
-	ExpiresAt time.Time `json:"expires_at"`
-	Revoked   bool      `json:"revoked"`
-	CreatedAt time.Time `json:"created_at"`
+	Token            string    `json:"token"`
+	UserID           string    `json:"user_id"`
+	SessionID        string    `json:"session_id"`
+	DPoPJKT          string    `json:"dpop_jkt,omitempty"`
+	DeviceName       string    `json:"device_name,omitempty"`
+	UserAgent        string    `json:"user_agent,omitempty"`
+	IPAddress        string    `json:"ip_address,omitempty"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	Revoked          bool      `json:"revoked"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastUsedAt       time.Time `json:"last_used_at"`
+	SessionStartedAt time.Time `json:"session_started_at"`
+	AMR              []string  `json:"amr,omitempty"`
+	ACR              string    `json:"acr,omitempty"`
 }
 
 /*
 RefreshTokenConfig holds the configuration for refresh token behaviour.
 Expiry is how long a refresh token remains valid (e.g. 7 days).
 TokenLength is the byte length of the random token (default 32 = 64 hex chars).
+
+IdleTimeout is how long a session may go without a refresh before it lapses.
+Every rotation issues a token valid for another IdleTimeout, so active users
+stay logged in; when zero, Expiry is used, which was the behaviour before it
+existed. MaxSessionAge caps a session's total lifetime counted from login,
+however active it is; zero means no cap.
+
+RotationGracePeriod lets a token that was rotated moments ago be presented
+again and receive the same successor, instead of tripping reuse detection.
+This covers parallel refreshes from several tabs and retries after a lost
+response. Keep it to a few seconds; zero disables it.
 */
 type RefreshTokenConfig struct {
-	Expiry      time.Duration
-	TokenLength int
+	Expiry              time.Duration
+	TokenLength         int
+	IdleTimeout         time.Duration
+	MaxSessionAge       time.Duration
+	RotationGracePeriod time.Duration
 }
 
 /*
 RefreshTokenInit configures the refresh token settings on the Auth instance.
 If tokenLength <= 0, it defaults to 32 bytes.
+Either Expiry or IdleTimeout must be set.
 This must be called after Init() to use refresh token features.
 */
 func (a *Auth) RefreshTokenInit(cfg RefreshTokenConfig) error {
-	if cfg.Expiry <= 0 {
+	if cfg.IdleTimeout < 0 || cfg.MaxSessionAge < 0 || cfg.RotationGracePeriod < 0 {
+		return fmt.Errorf("%w: refresh token timeouts cannot be negative", ErrInvalidInput)
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = cfg.Expiry
+	}
+	if cfg.IdleTimeout <= 0 {
 		return fmt.Errorf("%w: refresh token expiry must be positive", ErrInvalidInput)
 	}
 
@@ -44,7 +90,9 @@ func (a *Auth) RefreshTokenInit(cfg RefreshTokenConfig) error {
 		cfg.TokenLength = 32
 	}
 
-	a.refreshTokenExpiry = cfg.Expiry
+	a.refreshTokenExpiry = cfg.IdleTimeout
+	a.refreshMaxSessionAge = cfg.MaxSessionAge
+	a.refreshRotationGrace = cfg.RotationGracePeriod
 	a.refreshTokenLength = cfg.TokenLength
 
 	return nil
@@ -54,50 +102,288 @@ func (a *Auth) RefreshTokenInit(cfg RefreshTokenConfig) error {
 GenerateRefreshToken creates a new opaque refresh token for the given user,
 stores it in the database, and returns the token string.
 The caller should return this to the client alongside the JWT access token.
+An optional SessionInfo records the device, shown later by ListUserSessions.
+*/
+func (a *Auth) GenerateRefreshToken(userID string, info ...SessionInfo) (string, error) {
+	rt, err := a.generateRefreshToken(newSessionSeed(userID, info))
+	if err != nil {
+		return "", err
+	}
+	return rt.Token, nil
+}
+
+/*
+generateRefreshToken does the work behind GenerateRefreshToken.
+seed carries the user and any session attributes to keep; an empty SessionID
+starts a new session, while rotation passes the old token's attributes along.
+The token, expiry and creation time are filled in here.
+*/
+func (a *Auth) generateRefreshToken(seed *RefreshToken) (*RefreshToken, error) {
+	rt, digest, err := a.newRefreshToken(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertRefreshToken(a.ctx, a.Conn, rt, digest); err != nil {
+		return nil, err
+	}
+	a.cacheRefreshToken(rt, digest)
+
+	return rt, nil
+}
+
+/*
+newRefreshToken mints the token, session ID and expiry for seed without storing
+anything, and returns the record together with the digest to store it under.
 */
-func (a *Auth) GenerateRefreshToken(userID string) (string, error) {
+func (a *Auth) newRefreshToken(seed *RefreshToken) (*RefreshToken, string, error) {
+	userID := seed.UserID
 	if userID == "" {
-		return "", ErrEmptyInput
+		return nil, "", ErrEmptyInput
 	}
 	if a.Conn == nil {
-		return "", ErrDatabaseUnavailable
+		return nil, "", ErrDatabaseUnavailable
 	}
 	if a.refreshTokenExpiry <= 0 {
-		return "", fmt.Errorf("%w: refresh tokens not configured, call RefreshTokenInit first", ErrNotInitialized)
+		return nil, "", fmt.Errorf("%w: refresh tokens not configured, call RefreshTokenInit first", ErrNotInitialized)
 	}
 
 	/* Generate a cryptographically secure random token */
 	tokenBytes := make([]byte, a.refreshTokenLength)
 	if _, err := rand.Read(tokenBytes); err != nil {
-		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+		return nil, "", fmt.Errorf("failed to generate refresh token: %w", err)
 	}
 	token := hex.EncodeToString(tokenBytes)
 
-	expiresAt := time.Now().Add(a.refreshTokenExpiry)
+	sessionID := seed.SessionID
+	if sessionID == "" {
+		id, err := newTokenID()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate session id: %w", err)
+		}
+		sessionID = id
+	}
+
+	now := time.Now()
+	startedAt := seed.SessionStartedAt
+	if startedAt.IsZero() {
+		startedAt = now
+	}
 
+	/* Slide the idle window forward, but never past the session's hard limit */
+	expiresAt := now.Add(a.refreshTokenExpiry)
+	if a.refreshMaxSessionAge > 0 {
+		if limit := startedAt.Add(a.refreshMaxSessionAge); limit.Before(expiresAt) {
+			expiresAt = limit
+		}
+	}
+	if !expiresAt.After(now) {
+		return nil, "", ErrRefreshTokenExpired
+	}
+
+	return &RefreshToken{
+		Token:            token,
+		UserID:           userID,
+		SessionID:        sessionID,
+		DPoPJKT:          seed.DPoPJKT,
+		DeviceName:       seed.DeviceName,
+		UserAgent:        seed.UserAgent,
+		IPAddress:        seed.IPAddress,
+		ExpiresAt:        expiresAt,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		SessionStartedAt: startedAt,
+		AMR:              seed.AMR,
+		ACR:              seed.ACR,
+	}, hashRefreshToken(token), nil
+}
+
+/*
+dbExecer is satisfied by both *pgxpool.Pool and pgx.Tx, so a refresh token can
+be stored on its own or as part of the rotation transaction.
+*/
+type dbExecer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+/* insertRefreshToken stores rt under its digest. */
+func insertRefreshToken(ctx context.Context, db dbExecer, rt *RefreshToken, digest string) error {
+	/* Creating a token counts as using the session, so last_used_at starts at created_at */
 	query := `
-		INSERT INTO refresh_tokens (token, user_id, expires_at, revoked, created_at)
-		VALUES ($1, $2, $3, false, NOW())
+		INSERT INTO refresh_tokens (token, user_id, session_id, dpop_jkt, device_name, user_agent, ip_address,
+			expires_at, revoked, created_at, last_used_at, session_started_at, amr, acr, hashed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, false, $9, $9, $10, $11, $12, true)
 	`
-	_, err := a.Conn.Exec(a.ctx, query, token, userID, expiresAt)
+	_, err := db.Exec(ctx, query, digest, rt.UserID, rt.SessionID,
+		nullIfEmpty(rt.DPoPJKT), nullIfEmpty(rt.DeviceName), nullIfEmpty(rt.UserAgent), nullIfEmpty(rt.IPAddress),
+		rt.ExpiresAt, rt.CreatedAt, rt.SessionStartedAt, rt.AMR, nullIfEmpty(rt.ACR),
+	)
 	if err != nil {
-		return "", fmt.Errorf("%w: failed to store refresh token: %v", ErrDatabaseUnavailable, err)
+		return fmt.Errorf("%w: failed to store refresh token: %v", ErrDatabaseUnavailable, err)
 	}
+	return nil
+}
 
-	if a.redisClient != nil {
-		pipe := a.redisClient.Pipeline()
-		pipe.Set(a.ctx, "refresh:"+token, userID, a.refreshTokenExpiry)
-		pipe.SAdd(a.ctx, "user_tokens:"+userID, token)
-		pipe.Expire(a.ctx, "user_tokens:"+userID, a.refreshTokenExpiry)
-		_, _ = pipe.Exec(a.ctx)
+/*
+The Redis cache holds one key per token, refresh:<digest>, whose value is
+"u:<user id>" for a live token, refreshBoundMarker for a live DPoP-bound one
+(which only rotation with its key may use) or refreshRevokedMarker for a
+revoked one. Both expire with the token itself, so an expired token can never be
+served from cache.
+
+Revocation writes the marker through after updating Postgres, overwriting any
+live entry, while ValidateRefreshToken only fills the cache with SETNX. A
+validation that read Postgres just before a revoke therefore cannot put a
+live entry back over the marker.
+
+Live entries are kept for at most refreshLiveCacheTTL. If Redis drops the
+marker write, a revoked token can only validate from the stale entry for
+that long; rotation itself always goes through Postgres.
+*/
+const refreshRevokedMarker = "revoked"
+
+const refreshBoundMarker = "dpop"
+
+const refreshLiveCacheTTL = time.Minute
+
+/* liveCacheTTL is how long a live entry for a token expiring at expiresAt may be cached. */
+func liveCacheTTL(expiresAt time.Time) time.Duration {
+	return min(time.Until(expiresAt), refreshLiveCacheTTL)
+}
+
+/*
+refreshCacheMigratedKey records that purgeLegacyRefreshCache has run, so later
+starts skip the scan.
+*/
+const refreshCacheMigratedKey = "refresh_cache:hashed"
+
+/*
+purgeLegacyRefreshCache deletes the cache entries written before refresh
+tokens were stored as digests: refresh:<raw token> keys holding a bare user
+ID, and the user_tokens:<user> sets listing raw tokens. Postgres rows are
+hashed by the schema migration, but these would otherwise keep raw tokens at
+rest in Redis until they expire. Current entries are recognised by their
+value ("u:" prefix, or the revoked or bound marker) and kept. It runs once
+per Redis database; on failure it is retried at the next start.
+*/
+func (a *Auth) purgeLegacyRefreshCache() error {
+	done, err := a.redisClient.Exists(a.ctx, refreshCacheMigratedKey).Result()
+	if err != nil || done > 0 {
+		return err
+	}
+
+	for _, pattern := range []string{"refresh:*", "user_tokens:*"} {
+		iter := a.redisClient.Scan(a.ctx, 0, pattern, 500).Iterator()
+		var batch []string
+		for iter.Next(a.ctx) {
+			batch = append(batch, iter.Val())
+			if len(batch) == 500 {
+				if err := a.deleteLegacyRefreshKeys(batch); err != nil {
+					return err
+				}
+				batch = batch[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if err := a.deleteLegacyRefreshKeys(batch); err != nil {
+			return err
+		}
+	}
+
+	return a.redisClient.Set(a.ctx, refreshCacheMigratedKey, 1, 0).Err()
+}
+
+/* deleteLegacyRefreshKeys deletes the keys in batch that are not in the current cache format. */
+func (a *Auth) deleteLegacyRefreshKeys(batch []string) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	pipe := a.redisClient.Pipeline()
+	gets := make([]*redis.StringCmd, len(batch))
+	for i, key := range batch {
+		if strings.HasPrefix(key, "refresh:") {
+			gets[i] = pipe.Get(a.ctx, key)
+		}
+	}
+	/* Errors are per key here: a key may have expired or hold another type */
+	_, _ = pipe.Exec(a.ctx)
+
+	var legacy []string
+	for i, key := range batch {
+		if gets[i] != nil {
+			val, err := gets[i].Result()
+			if err != nil || val == refreshRevokedMarker || val == refreshBoundMarker || strings.HasPrefix(val, "u:") {
+				continue
+			}
+		}
+		legacy = append(legacy, key)
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	return a.redisClient.Del(a.ctx, legacy...).Err()
+}
+
+/* cacheRefreshToken mirrors a freshly stored token into Redis, if configured. */
+func (a *Auth) cacheRefreshToken(rt *RefreshToken, digest string) {
+	if a.redisClient == nil {
+		return
+	}
+	_ = a.redisClient.Set(a.ctx, "refresh:"+digest, refreshCacheValue(rt.UserID, rt.DPoPJKT), liveCacheTTL(rt.ExpiresAt)).Err()
+}
+
+/* refreshCacheValue is the cache entry for a live token, recording its DPoP binding if any. */
+func refreshCacheValue(userID, dpopJKT string) string {
+	if dpopJKT != "" {
+		return refreshBoundMarker
 	}
+	return "u:" + userID
+}
 
-	return token, nil
+/* revokedDigest is a token that has just been revoked, as RETURNed by Postgres. */
+type revokedDigest struct {
+	digest    string
+	expiresAt time.Time
+}
+
+/*
+markRefreshTokensRevoked writes the revoked marker for each token, so cached
+copies stop validating immediately. The caller has already revoked them in
+Postgres. If the marker cannot be written the entries are deleted instead, so
+the next validation reads Postgres; only if that fails too is an error
+returned, and a stale live entry may then survive for up to
+refreshLiveCacheTTL.
+*/
+func (a *Auth) markRefreshTokensRevoked(tokens []revokedDigest) error {
+	if a.redisClient == nil || len(tokens) == 0 {
+		return nil
+	}
+	keys := make([]string, len(tokens))
+	pipe := a.redisClient.Pipeline()
+	for i, t := range tokens {
+		keys[i] = "refresh:" + t.digest
+		if ttl := time.Until(t.expiresAt); ttl > 0 {
+			pipe.Set(a.ctx, keys[i], refreshRevokedMarker, ttl)
+		} else {
+			pipe.Del(a.ctx, keys[i])
+		}
+	}
+	if _, err := pipe.Exec(a.ctx); err != nil {
+		if delErr := a.redisClient.Del(a.ctx, keys...).Err(); delErr != nil {
+			return fmt.Errorf("%w: failed to update refresh token cache: %v", ErrRedisUnavailable, err)
+		}
+	}
+	return nil
 }
 
 /*
 ValidateRefreshToken checks if a refresh token is valid (exists, not revoked, not expired).
-If valid, it returns the associated user ID.
+If valid, it returns the associated user ID and records the session as used.
+A DPoP-bound token is refused with ErrDPoPProofRequired: it is only usable
+through RefreshDPoPTokenPair with its key, as a bearer it proves nothing.
 */
 func (a *Auth) ValidateRefreshToken(token string) (string, error) {
 	if token == "" {
@@ -107,25 +393,41 @@ func (a *Auth) ValidateRefreshToken(token string) (string, error) {
 		return "", ErrDatabaseUnavailable
 	}
 
+	digest := hashRefreshToken(token)
+
 	if a.redisClient != nil {
-		cachedUser, err := a.redisClient.Get(a.ctx, "refresh:"+token).Result()
+		cached, err := a.redisClient.Get(a.ctx, "refresh:"+digest).Result()
 		if err == nil {
-			return cachedUser, nil
+			if cached == refreshRevokedMarker {
+				return "", ErrRefreshTokenRevoked
+			}
+			if cached == refreshBoundMarker {
+				return "", ErrDPoPProofRequired
+			}
+			if userID, ok := strings.CutPrefix(cached, "u:"); ok {
+				a.touchRefreshToken(digest)
+				return userID, nil
+			}
 		}
 	}
 
-	val, err, _ := a.requestGroup.Do("validate_refresh:"+token, func() (interface{}, error) {
+	val, err, _ := a.requestGroup.Do("validate_refresh:"+digest, func() (interface{}, error) {
 		var userID string
 		var expiresAt time.Time
 		var revoked bool
+		var boundJKT *string
 
-		query := "SELECT user_id, expires_at, revoked FROM refresh_tokens WHERE token = $1"
-		err := a.Conn.QueryRow(a.ctx, query, token).Scan(&userID, &expiresAt, &revoked)
+		query := "SELECT user_id, expires_at, revoked, dpop_jkt FROM refresh_tokens WHERE token = $1"
+		err := a.Conn.QueryRow(a.ctx, query, digest).Scan(&userID, &expiresAt, &revoked, &boundJKT)
 		if err != nil {
 			return "", ErrRefreshTokenInvalid
 		}
 
 		if revoked {
+			/* Postgres already answered; a cache failure only costs the next lookup a query */
+			if err := a.markRefreshTokensRevoked([]revokedDigest{{digest, expiresAt}}); err != nil {
+				log.Printf("refresh token cache: %v", err)
+			}
 			return "", ErrRefreshTokenRevoked
 		}
 
@@ -133,17 +435,18 @@ func (a *Auth) ValidateRefreshToken(token string) (string, error) {
 			return "", ErrRefreshTokenExpired
 		}
 
+		/* SETNX, so a revoked marker written meanwhile is never overwritten */
+		jkt := derefString(boundJKT)
 		if a.redisClient != nil {
-			ttl := time.Until(expiresAt)
-			if ttl > 0 {
-				pipe := a.redisClient.Pipeline()
-				pipe.Set(a.ctx, "refresh:"+token, userID, ttl)
-				pipe.SAdd(a.ctx, "user_tokens:"+userID, token)
-				pipe.Expire(a.ctx, "user_tokens:"+userID, a.refreshTokenExpiry)
-				_, _ = pipe.Exec(a.ctx)
+			if ttl := liveCacheTTL(expiresAt); ttl > 0 {
+				_ = a.redisClient.SetNX(a.ctx, "refresh:"+digest, refreshCacheValue(userID, jkt), ttl).Err()
 			}
 		}
+		if jkt != "" {
+			return "", ErrDPoPProofRequired
+		}
 
+		a.touchRefreshToken(digest)
 		return userID, nil
 	})
 
@@ -154,6 +457,25 @@ func (a *Auth) ValidateRefreshToken(token string) (string, error) {
 	return val.(string), nil
 }
 
+/*
+touchRefreshToken bumps last_used_at for a token that just passed validation.
+Cache hits would otherwise turn every validation into a database write, so with
+Redis the update happens at most once a minute per token. Failures are ignored:
+a stale last-used time is not worth failing the request over.
+*/
+func (a *Auth) touchRefreshToken(digest string) {
+	if a.redisClient != nil {
+		fresh, err := a.redisClient.SetNX(a.ctx, "refresh_touch:"+digest, 1, time.Minute).Result()
+		if err == nil && !fresh {
+			return
+		}
+	}
+	_, _ = a.Conn.Exec(a.ctx,
+		"UPDATE refresh_tokens SET last_used_at = $2 WHERE token = $1",
+		digest, time.Now(),
+	)
+}
+
 /*
 RotateRefreshToken validates the old refresh token, revokes it,
 and issues a new one. This implements refresh token rotation, which
@@ -162,24 +484,307 @@ limits the damage if a token is leaked.
 Returns the new token and the associated user ID.
 */
 func (a *Auth) RotateRefreshToken(oldToken string) (newToken string, userID string, err error) {
-	/* Validate the existing token first */
-	userID, err = a.ValidateRefreshToken(oldToken)
+	rt, err := a.rotateRefreshToken(oldToken, "")
 	if err != nil {
 		return "", "", err
 	}
+	return rt.Token, rt.UserID, nil
+}
 
-	/* Revoke the old token */
-	if err := a.RevokeRefreshToken(oldToken); err != nil {
-		return "", "", fmt.Errorf("failed to revoke old token: %w", err)
+/*
+rotateRefreshToken does the work behind RotateRefreshToken and returns the full
+successor record so callers can keep the session ID.
+dpopJKT is the thumbprint of the key that proved possession for this request,
+or empty for a plain bearer refresh. A DPoP-bound token only rotates when the
+same key is presented, and the binding carries over to the successor.
+
+The old row is locked with SELECT ... FOR UPDATE and the revoke and insert
+commit together, so of two parallel refreshes exactly one mints a successor.
+The other waits on the lock, then sees the token as rotated: within
+RotationGracePeriod it is handed the same successor, after that it counts
+as reuse.
+*/
+func (a *Auth) rotateRefreshToken(oldToken, dpopJKT string) (*RefreshToken, error) {
+	if oldToken == "" {
+		return nil, ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
 	}
+	digest := hashRefreshToken(oldToken)
 
-	/* Issue a new one */
-	newToken, err = a.GenerateRefreshToken(userID)
+	tx, err := a.Conn.Begin(a.ctx)
 	if err != nil {
-		return "", "", err
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	defer tx.Rollback(a.ctx)
+
+	old := &RefreshToken{}
+	var sessionID, boundJKT, deviceName, userAgent, ipAddress, acr, successor *string
+	var startedAt, rotatedAt *time.Time
+	err = tx.QueryRow(a.ctx, `
+		SELECT user_id, session_id, dpop_jkt, device_name, user_agent, ip_address,
+			session_started_at, amr, acr, expires_at, revoked, rotated_at, successor
+		FROM refresh_tokens WHERE token = $1 FOR UPDATE`,
+		digest,
+	).Scan(&old.UserID, &sessionID, &boundJKT, &deviceName, &userAgent, &ipAddress,
+		&startedAt, &old.AMR, &acr, &old.ExpiresAt, &old.Revoked, &rotatedAt, &successor)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	if old.Revoked {
+		if rotatedAt != nil && successor != nil && derefString(boundJKT) == dpopJKT &&
+			time.Since(*rotatedAt) <= a.refreshRotationGrace {
+			if rt, err := a.graceSuccessor(tx, oldToken, *successor); err == nil {
+				return rt, nil
+			}
+		}
+		_ = tx.Rollback(a.ctx)
+		if rotatedAt == nil {
+			/* Revoked by logout or an admin, not rotated: a late retry, not a theft signal */
+			return nil, ErrRefreshTokenRevoked
+		}
+		return nil, a.handleRefreshTokenReuse(digest)
+	}
+	if boundJKT != nil && *boundJKT != dpopJKT {
+		return nil, fmt.Errorf("%w: refresh token is bound to a different key", ErrInvalidDPoPProof)
+	}
+	if boundJKT == nil && dpopJKT != "" {
+		return nil, fmt.Errorf("%w: refresh token is not DPoP-bound", ErrInvalidDPoPProof)
+	}
+	if time.Now().After(old.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	/* Issue a new one in the same session */
+	seed := &RefreshToken{
+		UserID:     old.UserID,
+		SessionID:  derefString(sessionID),
+		DPoPJKT:    dpopJKT,
+		DeviceName: derefString(deviceName),
+		UserAgent:  derefString(userAgent),
+		IPAddress:  derefString(ipAddress),
+		AMR:        old.AMR,
+		ACR:        derefString(acr),
+	}
+	if startedAt != nil {
+		seed.SessionStartedAt = *startedAt
+	}
+	rt, newDigest, err := a.newRefreshToken(seed)
+	if err != nil {
+		return nil, err
 	}
 
-	return newToken, userID, nil
+	var sealed *string
+	if a.refreshRotationGrace > 0 {
+		s, err := sealSuccessor(oldToken, rt.Token)
+		if err != nil {
+			return nil, err
+		}
+		sealed = &s
+	}
+
+	_, err = tx.Exec(a.ctx,
+		"UPDATE refresh_tokens SET revoked = true, revoked_at = NOW(), rotated_at = $2, successor = $3 WHERE token = $1",
+		digest, rt.CreatedAt, sealed,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke old token: %w: %v", ErrDatabaseUnavailable, err)
+	}
+	if err := insertRefreshToken(a.ctx, tx, rt, newDigest); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(a.ctx); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	/*
+		The rotation itself is committed, so a cache failure must not cost the
+		client its new token. Rotating the old one again still goes through
+		Postgres and is caught as reuse, and ValidateRefreshToken stops
+		trusting a stale entry within refreshLiveCacheTTL.
+	*/
+	if err := a.markRefreshTokensRevoked([]revokedDigest{{digest, old.ExpiresAt}}); err != nil {
+		log.Printf("refresh token cache: %v", err)
+	}
+	a.cacheRefreshToken(rt, newDigest)
+
+	return rt, nil
+}
+
+/*
+graceSuccessor recovers the successor of a token rotated within the grace
+period, provided it is still live. Anything else is reported as an error and
+the caller falls back to reuse handling.
+*/
+func (a *Auth) graceSuccessor(tx pgx.Tx, oldToken, sealed string) (*RefreshToken, error) {
+	token, err := openSuccessor(oldToken, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := &RefreshToken{Token: token}
+	var sessionID, boundJKT, deviceName, userAgent, ipAddress, acr *string
+	var lastUsedAt, startedAt *time.Time
+	err = tx.QueryRow(a.ctx, `
+		SELECT user_id, session_id, dpop_jkt, device_name, user_agent, ip_address,
+			expires_at, created_at, last_used_at, session_started_at, amr, acr
+		FROM refresh_tokens
+		WHERE token = $1 AND revoked = false AND expires_at > $2`,
+		hashRefreshToken(token), time.Now(),
+	).Scan(&rt.UserID, &sessionID, &boundJKT, &deviceName, &userAgent, &ipAddress,
+		&rt.ExpiresAt, &rt.CreatedAt, &lastUsedAt, &startedAt, &rt.AMR, &acr)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.SessionID = derefString(sessionID)
+	rt.DPoPJKT = derefString(boundJKT)
+	rt.DeviceName = derefString(deviceName)
+	rt.UserAgent = derefString(userAgent)
+	rt.IPAddress = derefString(ipAddress)
+	rt.ACR = derefString(acr)
+	if lastUsedAt != nil {
+		rt.LastUsedAt = *lastUsedAt
+	}
+	if startedAt != nil {
+		rt.SessionStartedAt = *startedAt
+	}
+	return rt, nil
+}
+
+/*
+sealSuccessor encrypts the successor token with a key derived from the old raw
+token, so only a client that still holds the old token can recover it during
+the grace period, and a database dump reveals nothing usable.
+*/
+func sealSuccessor(oldToken, newToken string) (string, error) {
+	gcm, err := successorCipher(oldToken)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return hex.EncodeToString(gcm.Seal(nonce, nonce, []byte(newToken), nil)), nil
+}
+
+/* openSuccessor reverses sealSuccessor. */
+func openSuccessor(oldToken, sealed string) (string, error) {
+	gcm, err := successorCipher(oldToken)
+	if err != nil {
+		return "", err
+	}
+	data, err := hex.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", ErrRefreshTokenInvalid
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrRefreshTokenInvalid
+	}
+	return string(plain), nil
+}
+
+/*
+successorCipher derives the AES-256-GCM key for sealSuccessor. The prefix keeps
+it distinct from the digest the token is stored under.
+*/
+func successorCipher(oldToken string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("refresh-successor:" + oldToken))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+handleRefreshTokenReuse is called when a rotated-out refresh token is presented
+for rotation. Following the OAuth 2.0 Security BCP, a replayed token means either
+the legitimate client or an attacker holds a stale copy, and we cannot tell
+which, so every token in the family (the session) is revoked, along with the
+access tokens issued for it, and a security event is emitted. The returned error matches both ErrRefreshTokenReused and
+ErrRefreshTokenRevoked.
+*/
+func (a *Auth) handleRefreshTokenReuse(digest string) error {
+	var userID string
+	var sessionID *string
+	err := a.Conn.QueryRow(a.ctx,
+		"SELECT user_id, session_id FROM refresh_tokens WHERE token = $1",
+		digest,
+	).Scan(&userID, &sessionID)
+	if err != nil || sessionID == nil {
+		/* Tokens from before sessions existed have no family to revoke */
+		return ErrRefreshTokenRevoked
+	}
+
+	/* A cache failure still leaves the family revoked in Postgres, so carry on and report it */
+	revokedCount, err := a.revokeSessionTokens(userID, *sessionID)
+	if err != nil && !errors.Is(err, ErrRedisUnavailable) {
+		return err
+	}
+	/* The replayer most likely already holds an access token for the session */
+	if err := a.revokeSessionAccessTokens(*sessionID); err != nil && !errors.Is(err, ErrRedisUnavailable) {
+		return err
+	}
+
+	a.emitSecurityEvent(SecurityEvent{
+		Type:      EventRefreshTokenReuse,
+		UserID:    userID,
+		SessionID: *sessionID,
+		Detail:    fmt.Sprintf("revoked refresh token replayed, %d live token(s) in the family revoked", revokedCount),
+	})
+
+	return fmt.Errorf("%w: %w", ErrRefreshTokenReused, ErrRefreshTokenRevoked)
+}
+
+/*
+revokeSessionTokens revokes every live refresh token of the user's session (a
+rotation family) and marks them revoked in the Redis cache. It returns how
+many were revoked.
+*/
+func (a *Auth) revokeSessionTokens(userID, sessionID string) (int, error) {
+	return a.revokeRefreshTokensWhere(
+		"user_id = $1 AND session_id = $2 AND revoked = false",
+		userID, sessionID,
+	)
+}
+
+/*
+revokeRefreshTokensWhere revokes the refresh tokens matching the given SQL
+condition, writes the revocation through to Redis and returns how many rows
+were revoked. Postgres is updated first, so a Redis failure never leaves a
+token live in the database.
+*/
+func (a *Auth) revokeRefreshTokensWhere(cond string, args ...any) (int, error) {
+	rows, err := a.Conn.Query(a.ctx,
+		"UPDATE refresh_tokens SET revoked = true, revoked_at = COALESCE(revoked_at, NOW()) WHERE "+cond+" RETURNING token, expires_at",
+		args...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	defer rows.Close()
+
+	var revoked []revokedDigest
+	for rows.Next() {
+		var t revokedDigest
+		if err := rows.Scan(&t.digest, &t.expiresAt); err != nil {
+			return 0, fmt.Errorf("failed to scan refresh token: %w", err)
+		}
+		revoked = append(revoked, t)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	return len(revoked), a.markRefreshTokensRevoked(revoked)
 }
 
 /*
@@ -194,21 +799,14 @@ func (a *Auth) RevokeRefreshToken(token string) error {
 		return ErrDatabaseUnavailable
 	}
 
-	cmdTag, err := a.Conn.Exec(a.ctx,
-		"UPDATE refresh_tokens SET revoked = true WHERE token = $1",
-		token,
-	)
+	count, err := a.revokeRefreshTokensWhere("token = $1", hashRefreshToken(token))
 	if err != nil {
-		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+		return err
 	}
-	if cmdTag.RowsAffected() == 0 {
+	if count == 0 {
 		return ErrRefreshTokenInvalid
 	}
 
-	if a.redisClient != nil {
-		a.redisClient.Del(a.ctx, "refresh:"+token)
-	}
-
 	return nil
 }
 
@@ -224,46 +822,32 @@ func (a *Auth) RevokeAllUserRefreshTokens(userID string) error {
 		return ErrDatabaseUnavailable
 	}
 
-	if a.redisClient != nil {
-		tokens, err := a.redisClient.SMembers(a.ctx, "user_tokens:"+userID).Result()
-		if err == nil && len(tokens) > 0 {
-			keys := make([]string, len(tokens))
-			for i, t := range tokens {
-				keys[i] = "refresh:" + t
-			}
-			pipe := a.redisClient.Pipeline()
-			pipe.Del(a.ctx, keys...)
-			pipe.Del(a.ctx, "user_tokens:"+userID)
-			_, _ = pipe.Exec(a.ctx)
-		}
-	}
-
-	_, err := a.Conn.Exec(a.ctx,
-		"UPDATE refresh_tokens SET revoked = true WHERE user_id = $1",
-		userID,
-	)
-	if err != nil {
-		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
-	}
+	/* Already revoked tokens got their cache marker when they were revoked */
+	_, err := a.revokeRefreshTokensWhere("user_id = $1 AND revoked = false", userID)
+	return err
+}
 
-	return nil
+/*
+hashRefreshToken returns the hex SHA-256 digest under which a refresh token is
+stored in Postgres and keyed in Redis, so a dump of either does not leak usable
+tokens. A plain fast hash is enough here: the tokens are 256 bits of randomness,
+so unlike passwords there is nothing to brute-force.
+*/
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 /*
 CleanupExpiredRefreshTokens removes expired refresh tokens from the database.
-This is called periodically by the background cleanup routine.
+The background janitor does this periodically (see JanitorInit); call it
+directly only if you need the purge to happen right now.
 */
 func (a *Auth) CleanupExpiredRefreshTokens() error {
 	if a.Conn == nil {
 		return ErrDatabaseUnavailable
 	}
 
-	_, err := a.Conn.Exec(a.ctx,
-		"DELETE FROM refresh_tokens WHERE expires_at < NOW()",
-	)
-	if err != nil {
-		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
-	}
-
-	return nil
+	_, err := a.purgeInBatches("refresh_tokens", "token", "expires_at < NOW()", a.janitorConfig().BatchSize)
+	return err
 }
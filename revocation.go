@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+revocationCacheTTL bounds how long Redis may answer for Postgres. Postgres holds
+every revocation; Redis caches both "revoked" and "not revoked" answers, so a
+cache write lost during a Redis outage is corrected within this window.
+*/
+const revocationCacheTTL = time.Minute
+
+/*
+RevokeAccessToken puts the token ID (the jti claim) of an access token on the deny-list.
+exp should be the token's own expiry (claims.ExpiresAt); the entry is only kept until then,
+because after that ValidateToken rejects the token on its own.
+
+The entry is always written to Postgres, and to the Redis cache when Redis has been
+initialized, so a Redis flush or eviction cannot bring the token back. Without Postgres,
+Redis is the only store.
+*/
+func (a *Auth) RevokeAccessToken(jti string, exp time.Time) error {
+	if jti == "" {
+		return ErrEmptyInput
+	}
+
+	ttl := time.Until(exp)
+	if ttl <= 0 {
+		/* Already expired, nothing left to deny */
+		return nil
+	}
+
+	return a.denyTokenID(jti, exp)
+}
+
+/*
+revokeSessionAccessTokens denies every access token carrying the given sid
+claim, for as long as one issued now could live. It shares the deny-list with
+RevokeAccessToken under a "sid:" prefix, which hex jti values can never take.
+*/
+func (a *Auth) revokeSessionAccessTokens(sessionID string) error {
+	if sessionID == "" {
+		return ErrEmptyInput
+	}
+	return a.denyTokenID(sessionDenyID(sessionID), time.Now().Add(a.jwtExpiry))
+}
+
+func sessionDenyID(sessionID string) string {
+	return "sid:" + sessionID
+}
+
+/* denyTokenID writes one deny-list entry, kept until exp, to Postgres and the Redis cache. */
+func (a *Auth) denyTokenID(id string, exp time.Time) error {
+	if a.Conn == nil && a.redisClient == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	if a.Conn != nil {
+		query := `
+			INSERT INTO revoked_tokens (jti, expires_at)
+			VALUES ($1, $2)
+			ON CONFLICT (jti) DO UPDATE SET expires_at = GREATEST(revoked_tokens.expires_at, $2)
+		`
+		_, err := a.Conn.Exec(a.ctx, query, id, exp.UTC())
+		if err != nil {
+			return fmt.Errorf("%w: failed to store revoked token: %v", ErrDatabaseUnavailable, err)
+		}
+	}
+
+	if a.redisClient != nil {
+		err := a.redisClient.Set(a.ctx, "revoked_jti:"+id, 1, time.Until(exp)).Err()
+		if err != nil && a.Conn == nil {
+			return fmt.Errorf("%w: failed to store revoked token: %v", ErrRedisUnavailable, err)
+		}
+		/* Otherwise Postgres has it; a stale cached answer expires within revocationCacheTTL */
+	}
+
+	return nil
+}
+
+/*
+RevokeAllUserAccessTokens invalidates every access token issued to the user up to now
+by recording a "not before" watermark. Tokens whose iat is at or before the watermark
+fail validation; tokens issued in a later second are unaffected.
+
+Because iat has one-second precision, a token issued in the rest of the same second
+after the revocation is rejected too; it errs on the side of revoking. Use this alongside
+RevokeAllUserRefreshTokens when a user logs out everywhere or changes their password.
+*/
+func (a *Auth) RevokeAllUserAccessTokens(userID string) error {
+	if userID == "" {
+		return ErrEmptyInput
+	}
+
+	if a.Conn == nil && a.redisClient == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	notBefore := time.Now().Truncate(time.Second).UTC()
+
+	if a.Conn != nil {
+		query := `
+			INSERT INTO token_watermarks (user_id, not_before)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id)
+			DO UPDATE SET not_before = GREATEST(token_watermarks.not_before, $2)
+		`
+		_, err := a.Conn.Exec(a.ctx, query, userID, notBefore)
+		if err != nil {
+			return fmt.Errorf("%w: failed to store token watermark: %v", ErrDatabaseUnavailable, err)
+		}
+	}
+
+	if a.redisClient != nil {
+		/*
+			Without Postgres the watermark lives only in Redis and gets no TTL:
+			GenerateToken accepts arbitrary expiry durations, so there is no upper
+			bound on how long an older token could otherwise stay alive.
+		*/
+		var ttl time.Duration
+		if a.Conn != nil {
+			ttl = revocationCacheTTL
+		}
+		err := a.redisClient.Set(a.ctx, "token_watermark:"+userID, notBefore.Unix(), ttl).Err()
+		if err != nil && a.Conn == nil {
+			return fmt.Errorf("%w: failed to store token watermark: %v", ErrRedisUnavailable, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+checkAccessTokenRevoked reports ErrTokenRevoked if the token's jti or session is on
+the deny-list, or it was issued at or before the user's watermark.
+Redis answers when it has every entry cached; on a miss Postgres is read and the
+answer cached. A bare Auth with neither Redis nor Postgres runs fully stateless and
+skips the check.
+*/
+func (a *Auth) checkAccessTokenRevoked(claims *JWTClaims) error {
+	if a.redisClient == nil && a.Conn == nil {
+		return nil
+	}
+
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	var denyIDs []string
+	if claims.ID != "" {
+		denyIDs = append(denyIDs, claims.ID)
+	}
+	if claims.SessionID != "" {
+		denyIDs = append(denyIDs, sessionDenyID(claims.SessionID))
+	}
+
+	if a.redisClient != nil {
+		pipe := a.redisClient.Pipeline()
+		denyCmds := make([]*redis.StringCmd, len(denyIDs))
+		for i, id := range denyIDs {
+			denyCmds[i] = pipe.Get(a.ctx, "revoked_jti:"+id)
+		}
+		markCmd := pipe.Get(a.ctx, "token_watermark:"+claims.UserID)
+		_, err := pipe.Exec(a.ctx)
+
+		if err == nil || errors.Is(err, redis.Nil) {
+			cached := true
+			for _, cmd := range denyCmds {
+				revoked, err := cmd.Result()
+				if err == nil && revoked == "1" {
+					return ErrTokenRevoked
+				}
+				cached = cached && err == nil
+			}
+			mark, err := markCmd.Int64()
+			if err == nil && revokedByWatermark(issuedAt, mark) {
+				return ErrTokenRevoked
+			}
+			if (cached && err == nil) || a.Conn == nil {
+				return nil
+			}
+			return a.checkRevokedInDB(claims.UserID, denyIDs, issuedAt, true)
+		}
+
+		/* Redis is unhealthy, fall through to Postgres */
+	}
+
+	if a.Conn == nil {
+		/* Fail closed: we cannot tell whether the token was revoked */
+		return ErrRedisUnavailable
+	}
+
+	return a.checkRevokedInDB(claims.UserID, denyIDs, issuedAt, false)
+}
+
+/*
+checkRevokedInDB reads the deny-list and watermark from Postgres. With cache set
+the answer is stored in Redis for revocationCacheTTL. SetNX keeps a concurrent
+revocation's own write from being overwritten with the older answer.
+*/
+func (a *Auth) checkRevokedInDB(userID string, denyIDs []string, issuedAt time.Time, cache bool) error {
+	var denied []string
+	var notBefore *time.Time
+	query := `
+		SELECT
+			ARRAY(SELECT jti FROM revoked_tokens WHERE jti = ANY($1) AND expires_at > NOW()),
+			(SELECT not_before FROM token_watermarks WHERE user_id = $2)
+	`
+	err := a.Conn.QueryRow(a.ctx, query, denyIDs, userID).Scan(&denied, &notBefore)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	var mark int64
+	if notBefore != nil {
+		mark = notBefore.Unix()
+	}
+
+	if cache {
+		pipe := a.redisClient.Pipeline()
+		for _, id := range denyIDs {
+			pipe.SetNX(a.ctx, "revoked_jti:"+id, 0, revocationCacheTTL)
+		}
+		for _, id := range denied {
+			/* Entries only ever go from live to revoked, so "1" may overwrite */
+			pipe.Set(a.ctx, "revoked_jti:"+id, 1, revocationCacheTTL)
+		}
+		pipe.SetNX(a.ctx, "token_watermark:"+userID, mark, revocationCacheTTL)
+		/* Best effort: on failure the next check reads Postgres again */
+		_, _ = pipe.Exec(a.ctx)
+	}
+
+	if len(denied) > 0 || revokedByWatermark(issuedAt, mark) {
+		return ErrTokenRevoked
+	}
+
+	return nil
+}
+
+/* revokedByWatermark reports whether a token issued at issuedAt falls under the watermark, in Unix seconds. */
+func revokedByWatermark(issuedAt time.Time, mark int64) bool {
+	return mark > 0 && issuedAt.Unix() <= mark
+}
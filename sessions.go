@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+SessionInfo describes the device a session was started from.
+Pass it to GenerateRefreshToken or IssueTokenPair at login; every field is optional
+and is only stored for display, never trusted for security decisions.
+*/
+type SessionInfo struct {
+	DeviceName string
+	UserAgent  string
+	IPAddress  string
+}
+
+/*
+Session is one logged-in device as returned by ListUserSessions.
+A session is a refresh token rotation family, so it survives rotation and
+ends when its current refresh token is revoked or expires.
+*/
+type Session struct {
+	SessionID  string    `json:"session_id"`
+	DeviceName string    `json:"device_name,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IPAddress  string    `json:"ip_address,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+/*
+ListUserSessions returns the user's active sessions, most recently used first.
+*/
+func (a *Auth) ListUserSessions(userID string) ([]Session, error) {
+	if userID == "" {
+		return nil, ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+
+	rows, err := a.Conn.Query(a.ctx, `
+		SELECT session_id, device_name, user_agent, ip_address,
+			COALESCE(session_started_at, created_at), COALESCE(last_used_at, created_at), expires_at
+		FROM refresh_tokens
+		WHERE user_id = $1 AND revoked = false AND expires_at > $2 AND session_id IS NOT NULL
+		ORDER BY 6 DESC`,
+		userID, time.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var deviceName, userAgent, ipAddress *string
+		if err := rows.Scan(&s.SessionID, &deviceName, &userAgent, &ipAddress, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		s.DeviceName = derefString(deviceName)
+		s.UserAgent = derefString(userAgent)
+		s.IPAddress = derefString(ipAddress)
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	return sessions, nil
+}
+
+/*
+RevokeSession logs the user out of one device by revoking the session's refresh
+tokens and denying the access tokens issued for it (those carrying its sid claim).
+Returns ErrSessionNotFound if the user has no active session with that ID, so
+one user cannot probe or end another user's sessions.
+*/
+func (a *Auth) RevokeSession(userID, sessionID string) error {
+	if userID == "" || sessionID == "" {
+		return ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	revoked, err := a.revokeSessionTokens(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrSessionNotFound
+	}
+
+	return a.revokeSessionAccessTokens(sessionID)
+}
+
+/* newSessionSeed builds the generateRefreshToken seed for a brand new session. */
+func newSessionSeed(userID string, info []SessionInfo) *RefreshToken {
+	seed := &RefreshToken{UserID: userID}
+	if len(info) > 0 {
+		seed.DeviceName = info[0].DeviceName
+		seed.UserAgent = info[0].UserAgent
+		seed.IPAddress = info[0].IPAddress
+	}
+	return seed
+}
+
+/* nullIfEmpty maps "" to SQL NULL for optional text columns. */
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+/* derefString reads an optional text column, treating NULL as "". */
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+)
+
+/*
+EmailTemplatesConfig supplies localized email templates.
+FS holds one directory per locale, named with a language tag such as "en",
+"de" or "pt-BR", and in it up to three files per message:
+
+	<name>.subject.txt  text/template for the subject line
+	<name>.txt          text/template for the plain-text body
+	<name>.html         html/template for the HTML body (optional)
+
+The names are "otp" and "magic_link". "otp_<purpose>", e.g.
+"otp_reset_password", applies to one OTP purpose only. The data available
+is the same as for OTPPurposeConfig and MagicLinkConfig. DefaultLocale
+(default "en") is used when the user has no preferred language or none of
+its templates exist.
+*/
+type EmailTemplatesConfig struct {
+	FS            fs.FS
+	DefaultLocale string
+}
+
+/* emailTemplate is one message's subject, text and optional HTML templates. */
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+/* emailTemplates holds the parsed sets, keyed by lower-case locale and name. */
+type emailTemplates struct {
+	defaultLocale string
+	sets          map[string]map[string]*emailTemplate
+}
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+var (
+	builtinOTPTemplate = &emailTemplate{
+		subject: defaultOTPSubject,
+		text:    defaultOTPBody,
+		html: htmltemplate.Must(htmltemplate.New("html").Parse(
+			`<p>Your verification code is:</p><p style="font-size:24px;letter-spacing:4px"><strong>{{.Code}}</strong></p><p>It is valid for {{.Minutes}} minutes.</p>`)),
+	}
+	builtinMagicLinkTemplate = &emailTemplate{
+		subject: defaultMagicLinkSubject,
+		text:    defaultMagicLinkBody,
+		html: htmltemplate.Must(htmltemplate.New("html").Parse(
+			`<p><a href="{{.Link}}">Click here to sign in</a>.</p><p>The link works once and expires in {{.Minutes}} minutes. If you did not ask for it, ignore this email.</p>`)),
+	}
+)
+
+/*
+EmailTemplatesInit loads localized templates for the emails the library
+sends. Every template is parsed up front, so a broken file is reported here
+rather than when a user asks for a code. A locale needs a subject and a
+text template for a message before its HTML template is used.
+*/
+func (a *Auth) EmailTemplatesInit(cfg EmailTemplatesConfig) error {
+	if cfg.FS == nil {
+		return ErrEmptyInput
+	}
+	t := &emailTemplates{
+		defaultLocale: strings.ToLower(cfg.DefaultLocale),
+		sets:          make(map[string]map[string]*emailTemplate),
+	}
+	if t.defaultLocale == "" {
+		t.defaultLocale = "en"
+	}
+	if !localePattern.MatchString(t.defaultLocale) {
+		return fmt.Errorf("%w: default locale %q", ErrInvalidInput, cfg.DefaultLocale)
+	}
+
+	err := fs.WalkDir(cfg.FS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		dir, file := path.Split(p)
+		locale := strings.TrimSuffix(dir, "/")
+		if locale == "" || strings.Contains(locale, "/") || !localePattern.MatchString(locale) {
+			return nil
+		}
+
+		var name, kind string
+		switch {
+		case strings.HasSuffix(file, ".subject.txt"):
+			name, kind = strings.TrimSuffix(file, ".subject.txt"), "subject"
+		case strings.HasSuffix(file, ".txt"):
+			name, kind = strings.TrimSuffix(file, ".txt"), "text"
+		case strings.HasSuffix(file, ".html"):
+			name, kind = strings.TrimSuffix(file, ".html"), "html"
+		default:
+			return nil
+		}
+
+		src, err := fs.ReadFile(cfg.FS, p)
+		if err != nil {
+			return err
+		}
+		locale = strings.ToLower(locale)
+		if t.sets[locale] == nil {
+			t.sets[locale] = make(map[string]*emailTemplate)
+		}
+		tmpl := t.sets[locale][name]
+		if tmpl == nil {
+			tmpl = &emailTemplate{}
+			t.sets[locale][name] = tmpl
+		}
+
+		switch kind {
+		case "subject":
+			tmpl.subject, err = texttemplate.New(p).Parse(strings.TrimSpace(string(src)))
+		case "text":
+			tmpl.text, err = texttemplate.New(p).Parse(string(src))
+		default:
+			tmpl.html, err = htmltemplate.New(p).Parse(string(src))
+		}
+		if err != nil {
+			return fmt.Errorf("%w: template %s: %v", ErrInvalidInput, p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for locale, set := range t.sets {
+		for name, tmpl := range set {
+			if tmpl.subject == nil || tmpl.text == nil {
+				return fmt.Errorf("%w: template %s/%s needs both %s.subject.txt and %s.txt", ErrInvalidInput, locale, name, name, name)
+			}
+		}
+	}
+
+	a.templatesMu.Lock()
+	a.emailTemplates = t
+	a.templatesMu.Unlock()
+	return nil
+}
+
+/*
+emailTemplateFor returns the loaded template for name in the closest
+available locale: the exact tag, then its base language, then the default
+locale. It returns nil if EmailTemplatesInit has none.
+*/
+func (a *Auth) emailTemplateFor(locale, name string) *emailTemplate {
+	a.templatesMu.RLock()
+	t := a.emailTemplates
+	a.templatesMu.RUnlock()
+	if t == nil {
+		return nil
+	}
+
+	for _, candidate := range localeCandidates(strings.ToLower(locale), t.defaultLocale) {
+		if tmpl := t.sets[candidate][name]; tmpl != nil {
+			return tmpl
+		}
+	}
+	return nil
+}
+
+/*
+messageTemplate picks the template for a message, in order: a localized one
+for the specific name, the one configured in code (OTPPurposeInit or
+MagicLinkInit), a localized one for the generic name, and the built-in.
+*/
+func (a *Auth) messageTemplate(locale, specific, generic string, configured, builtin *emailTemplate) *emailTemplate {
+	if t := a.emailTemplateFor(locale, specific); t != nil {
+		return t
+	}
+	if configured != nil {
+		return configured
+	}
+	if generic != "" {
+		if t := a.emailTemplateFor(locale, generic); t != nil {
+			return t
+		}
+	}
+	return builtin
+}
+
+/* localeCandidates lists the locales to try, most specific first. */
+func localeCandidates(locale, defaultLocale string) []string {
+	var out []string
+	for _, l := range []string{locale, defaultLocale} {
+		for l != "" {
+			out = append(out, l)
+			i := strings.LastIndex(l, "-")
+			if i < 0 {
+				break
+			}
+			l = l[:i]
+		}
+	}
+	return out
+}
+
+/* render fills in the subject, text body and, if there is one, the HTML body. */
+func (t *emailTemplate) render(data any) (subject, text, html string, err error) {
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render email subject: %w", err)
+	}
+	/* A subject is a single header line */
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render email body: %w", err)
+	}
+	text = buf.String()
+
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, data); err != nil {
+			return "", "", "", fmt.Errorf("failed to render email HTML: %w", err)
+		}
+		html = buf.String()
+	}
+	return subject, text, html, nil
+}
+
+/*
+userLocale returns the preferred language stored for a user, or "" if the
+address has no account or no preference.
+*/
+func (a *Auth) userLocale(userID string) string {
+	if a.Conn == nil {
+		return ""
+	}
+	var locale string
+	err := a.Conn.QueryRow(a.ctx, "SELECT COALESCE(locale, '') FROM users WHERE user_id = $1", userID).Scan(&locale)
+	if err != nil {
+		return ""
+	}
+	return locale
+}
+
+/*
+SetUserLocale stores the user's preferred language, a tag such as "de" or
+"pt-BR", which picks the EmailTemplatesInit templates for their emails.
+An empty locale clears the preference.
+*/
+func (a *Auth) SetUserLocale(userID, locale string) error {
+	if userID == "" {
+		return ErrEmptyInput
+	}
+	if locale != "" && !localePattern.MatchString(locale) {
+		return fmt.Errorf("%w: locale %q", ErrInvalidInput, locale)
+	}
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	tag, err := a.Conn.Exec(a.ctx, "UPDATE users SET locale = NULLIF($2, '') WHERE user_id = $1", userID, locale)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
@@ -122,6 +122,20 @@ func TestOTPInitInvalid(t *testing.T) {
 	}
 }
 
+/*
+TestOTPMaxAttemptsInit verifies that the attempt limit must be positive.
+*/
+func TestOTPMaxAttemptsInit(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.OTPMaxAttemptsInit(0); err == nil {
+		t.Error("expected error for zero attempts")
+	}
+	if err := a.OTPMaxAttemptsInit(3); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 /* ======================== Refresh Token Config ======================== */
 
 /*
@@ -151,6 +165,12 @@ func TestRefreshTokenInitInvalid(t *testing.T) {
 	if err := a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: -time.Hour}); err == nil {
 		t.Error("expected error for negative expiry")
 	}
+	if err := a.RefreshTokenInit(auth.RefreshTokenConfig{IdleTimeout: time.Hour, MaxSessionAge: -time.Hour}); err == nil {
+		t.Error("expected error for negative max session age")
+	}
+	if err := a.RefreshTokenInit(auth.RefreshTokenConfig{IdleTimeout: time.Hour}); err != nil {
+		t.Errorf("IdleTimeout alone should be enough, got: %v", err)
+	}
 }
 
 /*
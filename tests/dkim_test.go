@@ -0,0 +1,223 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GCET-Open-Source-Foundation/auth/email"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+/* dkimRecord returns the DNS TXT record publishing the public half of key. */
+func dkimRecord(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	switch pub := key.Public().(type) {
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatalf("failed to marshal public key: %v", err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+}
+
+/*
+verifyDKIM checks msg with an independent verifier, answering the DNS
+lookup for selector._domainkey.auth.test locally.
+*/
+func verifyDKIM(t *testing.T, msg []byte, key crypto.Signer) error {
+	t.Helper()
+	record := dkimRecord(t, key)
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "selector._domainkey.auth.test" {
+				t.Errorf("unexpected DKIM lookup for %q", domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("expected one signature, got %d", len(verifications))
+	}
+	if verifications[0].Domain != "auth.test" {
+		t.Errorf("unexpected signing domain %q", verifications[0].Domain)
+	}
+	return verifications[0].Err
+}
+
+func dkimTestMessage() *email.Message {
+	return &email.Message{
+		From:    mail.Address{Name: "Auth", Address: "noreply@auth.test"},
+		To:      []mail.Address{{Address: "user@example.com"}},
+		Subject: "Your Verification Code",
+		Text:    "Your OTP is: 123456\n\nValid for 5 minutes.\n.\n",
+		HTML:    "<p>Your OTP is: <b>123456</b></p>",
+	}
+}
+
+func dkimTestKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+	return map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": edKey}
+}
+
+/*
+TestDKIMSignVerifies verifies that signed messages pass an independent
+verifier for both algorithms.
+*/
+func TestDKIMSignVerifies(t *testing.T) {
+	for alg, key := range dkimTestKeys(t) {
+		signer, err := email.NewDKIMSigner(email.DKIMConfig{Domain: "auth.test", Selector: "selector", PrivateKey: key})
+		if err != nil {
+			t.Fatalf("%s: NewDKIMSigner failed: %v", alg, err)
+		}
+		raw, err := dkimTestMessage().Bytes()
+		if err != nil {
+			t.Fatalf("Bytes failed: %v", err)
+		}
+		signed, err := signer.Sign(raw)
+		if err != nil {
+			t.Fatalf("%s: Sign failed: %v", alg, err)
+		}
+		if !bytes.HasPrefix(signed, []byte("DKIM-Signature: v=1; a="+alg+"; c=relaxed/relaxed;")) {
+			t.Errorf("%s: unexpected signature header:\n%s", alg, signed[:200])
+		}
+		if err := verifyDKIM(t, signed, key); err != nil {
+			t.Errorf("%s: signature did not verify: %v", alg, err)
+		}
+	}
+}
+
+/*
+TestDKIMRelaxedCanonicalization verifies that whitespace changes a relay
+may make do not break the signature, while content changes do.
+*/
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	key := dkimTestKeys(t)["ed25519-sha256"]
+	signer, _ := email.NewDKIMSigner(email.DKIMConfig{Domain: "auth.test", Selector: "selector", PrivateKey: key})
+	raw, _ := dkimTestMessage().Bytes()
+	signed, err := signer.Sign(raw)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	/* Refold the subject, pad whitespace and add trailing blank lines */
+	relayed := strings.Replace(string(signed), "Subject: Your Verification Code", "subject:  Your\r\n\tVerification   Code ", 1)
+	relayed += "\r\n\r\n"
+	if err := verifyDKIM(t, []byte(relayed), key); err != nil {
+		t.Errorf("relaxed changes should still verify: %v", err)
+	}
+
+	tampered := strings.Replace(string(signed), "Your Verification Code", "Your Verification Codes", 1)
+	if err := verifyDKIM(t, []byte(tampered), key); err == nil {
+		t.Error("a changed subject must fail verification")
+	}
+	tampered = strings.Replace(string(signed), "123456", "654321", 1)
+	if err := verifyDKIM(t, []byte(tampered), key); err == nil {
+		t.Error("a changed body must fail verification")
+	}
+}
+
+/*
+TestDKIMConfigValidation verifies that bad signer settings are rejected.
+*/
+func TestDKIMConfigValidation(t *testing.T) {
+	key := dkimTestKeys(t)["ed25519-sha256"]
+	bad := map[string]email.DKIMConfig{
+		"no domain":    {Selector: "selector", PrivateKey: key},
+		"no selector":  {Domain: "auth.test", PrivateKey: key},
+		"bad selector": {Domain: "auth.test", Selector: "a; b", PrivateKey: key},
+		"no key":       {Domain: "auth.test", Selector: "selector"},
+		"bad header":   {Domain: "auth.test", Selector: "selector", PrivateKey: key, Headers: []string{"Sub ject"}},
+	}
+	for name, cfg := range bad {
+		if _, err := email.NewDKIMSigner(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if _, err := email.NewClient(email.Config{Host: "127.0.0.1", Port: "25", DKIM: &cfg}); err == nil {
+			t.Errorf("%s: NewClient should reject the DKIM config", name)
+		}
+	}
+}
+
+/*
+TestParseDKIMPrivateKey verifies reading RSA and Ed25519 keys from PEM.
+*/
+func TestParseDKIMPrivateKey(t *testing.T) {
+	for alg, key := range dkimTestKeys(t) {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal key: %v", alg, err)
+		}
+		parsed, err := email.ParseDKIMPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		if err != nil {
+			t.Errorf("%s: ParseDKIMPrivateKey failed: %v", alg, err)
+			continue
+		}
+		if _, err := email.NewDKIMSigner(email.DKIMConfig{Domain: "auth.test", Selector: "selector", PrivateKey: parsed}); err != nil {
+			t.Errorf("%s: parsed key rejected: %v", alg, err)
+		}
+	}
+
+	rsaKey := dkimTestKeys(t)["rsa-sha256"].(*rsa.PrivateKey)
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if _, err := email.ParseDKIMPrivateKey(pkcs1); err != nil {
+		t.Errorf("PKCS #1 key rejected: %v", err)
+	}
+	if _, err := email.ParseDKIMPrivateKey([]byte("not a key")); err == nil {
+		t.Error("expected an error for input without PEM")
+	}
+}
+
+/*
+TestEmailClientDKIM verifies that a client with DKIM configured signs what
+it sends, and that the message as received verifies.
+*/
+func TestEmailClientDKIM(t *testing.T) {
+	key := dkimTestKeys(t)["rsa-sha256"]
+	srv := &fakeSMTP{}
+	host, port := startFakeSMTP(t, srv)
+	client, err := email.NewClient(email.Config{
+		Host: host, Port: port, TLS: email.NoTLS, Timeout: 5 * time.Second,
+		DKIM: &email.DKIMConfig{Domain: "auth.test", Selector: "selector", PrivateKey: key},
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if err := client.SendMessage(context.Background(), dkimTestMessage()); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	srv.mu.Lock()
+	data := srv.data
+	srv.mu.Unlock()
+	if !strings.HasPrefix(data, "DKIM-Signature:") {
+		t.Fatalf("expected a DKIM-Signature header first:\n%s", data)
+	}
+	if err := verifyDKIM(t, []byte(data), key); err != nil {
+		t.Errorf("received message did not verify: %v", err)
+	}
+}
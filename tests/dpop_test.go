@@ -0,0 +1,330 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const dpopTestURL = "https://api.example.com/resource"
+
+func newDPoPKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+/*
+makeDPoPProof builds a DPoP proof JWT the way a client would.
+An empty accessToken omits the ath claim.
+*/
+func makeDPoPProof(t *testing.T, key *ecdsa.PrivateKey, method, htu, accessToken string, iat time.Time) string {
+	t.Helper()
+
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatalf("failed to convert key: %v", err)
+	}
+	point := pub.Bytes()
+
+	claims := jwt.MapClaims{
+		"htm": method,
+		"htu": htu,
+		"iat": iat.Unix(),
+		"jti": rand.Text(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		"y":   base64.RawURLEncoding.EncodeToString(point[33:]),
+	}
+
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign proof: %v", err)
+	}
+	return proof
+}
+
+/*
+TestDPoPProofValid verifies that a well-formed proof is accepted and that the
+thumbprint is stable for the same key.
+*/
+func TestDPoPProofValid(t *testing.T) {
+	a := auth.NewBareAuth()
+	key := newDPoPKey(t)
+
+	jkt1, err := a.ValidateDPoPProof(makeDPoPProof(t, key, "POST", dpopTestURL, "", time.Now()), "POST", dpopTestURL, "")
+	if err != nil {
+		t.Fatalf("expected valid proof, got: %v", err)
+	}
+
+	/* Query strings and default ports are ignored when comparing htu */
+	jkt2, err := a.ValidateDPoPProof(makeDPoPProof(t, key, "GET", dpopTestURL, "", time.Now()), "GET", "https://API.example.com:443/resource?page=2", "")
+	if err != nil {
+		t.Fatalf("expected valid proof with normalized URL, got: %v", err)
+	}
+
+	if jkt1 == "" || jkt1 != jkt2 {
+		t.Errorf("expected a stable thumbprint, got %q and %q", jkt1, jkt2)
+	}
+}
+
+/*
+TestDPoPProofMismatch verifies rejection of proofs for a different method, URL,
+access token, or an iat outside the window.
+*/
+func TestDPoPProofMismatch(t *testing.T) {
+	a := auth.NewBareAuth()
+	key := newDPoPKey(t)
+
+	cases := []struct {
+		name   string
+		proof  string
+		method string
+		url    string
+		token  string
+	}{
+		{"method", makeDPoPProof(t, key, "GET", dpopTestURL, "", time.Now()), "POST", dpopTestURL, ""},
+		{"url", makeDPoPProof(t, key, "GET", dpopTestURL, "", time.Now()), "GET", "https://api.example.com/other", ""},
+		{"stale", makeDPoPProof(t, key, "GET", dpopTestURL, "", time.Now().Add(-10*time.Minute)), "GET", dpopTestURL, ""},
+		{"future", makeDPoPProof(t, key, "GET", dpopTestURL, "", time.Now().Add(10*time.Minute)), "GET", dpopTestURL, ""},
+		{"ath", makeDPoPProof(t, key, "GET", dpopTestURL, "token-a", time.Now()), "GET", dpopTestURL, "token-b"},
+		{"garbage", "not.a.proof", "GET", dpopTestURL, ""},
+	}
+
+	for _, tc := range cases {
+		if _, err := a.ValidateDPoPProof(tc.proof, tc.method, tc.url, tc.token); !errors.Is(err, auth.ErrInvalidDPoPProof) {
+			t.Errorf("%s: expected ErrInvalidDPoPProof, got: %v", tc.name, err)
+		}
+	}
+}
+
+/*
+TestDPoPProofReplay verifies that the in-memory replay cache rejects a reused proof.
+*/
+func TestDPoPProofReplay(t *testing.T) {
+	a := auth.NewBareAuth()
+	proof := makeDPoPProof(t, newDPoPKey(t), "POST", dpopTestURL, "", time.Now())
+
+	if _, err := a.ValidateDPoPProof(proof, "POST", dpopTestURL, ""); err != nil {
+		t.Fatalf("first use should succeed: %v", err)
+	}
+	if _, err := a.ValidateDPoPProof(proof, "POST", dpopTestURL, ""); !errors.Is(err, auth.ErrDPoPReplay) {
+		t.Errorf("expected ErrDPoPReplay on reuse, got: %v", err)
+	}
+}
+
+/*
+TestDPoPInit verifies configuration validation and that MaxAge is honoured.
+*/
+func TestDPoPInit(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.DPoPInit(auth.DPoPConfig{MaxAge: -time.Second}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got: %v", err)
+	}
+	if err := a.DPoPInit(auth.DPoPConfig{MaxAge: 10 * time.Minute}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	proof := makeDPoPProof(t, newDPoPKey(t), "GET", dpopTestURL, "", time.Now().Add(-5*time.Minute))
+	if _, err := a.ValidateDPoPProof(proof, "GET", dpopTestURL, ""); err != nil {
+		t.Errorf("proof within the configured MaxAge should pass: %v", err)
+	}
+}
+
+/*
+TestValidateDPoPTokenRequiresBinding verifies that a plain bearer token is
+not accepted by ValidateDPoPToken.
+*/
+func TestValidateDPoPTokenRequiresBinding(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.JWTInit("dpop-secret")
+
+	token, _ := a.GenerateToken("bearer@example.com")
+	proof := makeDPoPProof(t, newDPoPKey(t), "GET", dpopTestURL, token, time.Now())
+
+	if _, err := a.ValidateDPoPToken(token, proof, "GET", dpopTestURL); !errors.Is(err, auth.ErrInvalidDPoPProof) {
+		t.Errorf("expected ErrInvalidDPoPProof for unbound token, got: %v", err)
+	}
+}
+
+/*
+TestBoundTokenNeedsProof verifies that a token carrying cnf.jkt is refused
+as a plain bearer token, is accepted with a proof from its key, and shows its
+binding in introspection.
+*/
+func TestBoundTokenNeedsProof(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.JWTInit("dpop-secret")
+
+	key := newDPoPKey(t)
+	jkt, err := a.ValidateDPoPProof(makeDPoPProof(t, key, "POST", dpopTestURL, "", time.Now()), "POST", dpopTestURL, "")
+	if err != nil {
+		t.Fatalf("ValidateDPoPProof failed: %v", err)
+	}
+	now := time.Now()
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &auth.JWTClaims{
+		UserID:       "bound@example.com",
+		Confirmation: &auth.Confirmation{JKT: jkt},
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "bound-jti",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}).SignedString([]byte("dpop-secret"))
+
+	if _, err := a.ValidateToken(token); !errors.Is(err, auth.ErrDPoPProofRequired) {
+		t.Errorf("expected ErrDPoPProofRequired from ValidateToken, got: %v", err)
+	}
+	if _, err := a.LoginJWT(token); !errors.Is(err, auth.ErrDPoPProofRequired) {
+		t.Errorf("expected ErrDPoPProofRequired from LoginJWT, got: %v", err)
+	}
+
+	proof := makeDPoPProof(t, key, "GET", dpopTestURL, token, time.Now())
+	if _, err := a.ValidateDPoPToken(token, proof, "GET", dpopTestURL); err != nil {
+		t.Errorf("bound token should validate with a proof: %v", err)
+	}
+
+	rec := postForm(a.IntrospectionHandler(testClients), "resource-server", "rs-secret", url.Values{"token": {token}})
+	resp := decodeIntrospection(t, rec)
+	if !resp.Active || resp.TokenType != "DPoP" || resp.Confirmation == nil || resp.Confirmation.JKT != jkt {
+		t.Errorf("expected an active DPoP token with cnf.jkt, got %+v", resp)
+	}
+}
+
+/*
+TestIntegrationDPoPTokenFlow tests issuing a bound pair, using the access token
+with a proof, and refreshing with the same and a different key.
+*/
+func TestIntegrationDPoPTokenFlow(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("dpop-integration-secret")
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+	_ = a.RegisterUser("dpop@example.com", "password")
+
+	key := newDPoPKey(t)
+	tokenURL := "https://auth.example.com/token"
+
+	jkt, err := a.ValidateDPoPProof(makeDPoPProof(t, key, "POST", tokenURL, "", time.Now()), "POST", tokenURL, "")
+	if err != nil {
+		t.Fatalf("token endpoint proof failed: %v", err)
+	}
+
+	pair, err := a.IssueDPoPTokenPair("dpop@example.com", jkt)
+	if err != nil {
+		t.Fatalf("failed to issue DPoP pair: %v", err)
+	}
+	if pair.TokenType != "DPoP" {
+		t.Errorf("expected token_type DPoP, got %q", pair.TokenType)
+	}
+
+	proof := makeDPoPProof(t, key, "GET", dpopTestURL, pair.AccessToken, time.Now())
+	claims, err := a.ValidateDPoPToken(pair.AccessToken, proof, "GET", dpopTestURL)
+	if err != nil {
+		t.Fatalf("bound token should validate with its key: %v", err)
+	}
+	if claims.Confirmation == nil || claims.Confirmation.JKT != jkt {
+		t.Errorf("expected cnf.jkt %q, got %+v", jkt, claims.Confirmation)
+	}
+
+	/* A proof from another key must not unlock the token */
+	thief := newDPoPKey(t)
+	stolen := makeDPoPProof(t, thief, "GET", dpopTestURL, pair.AccessToken, time.Now())
+	if _, err := a.ValidateDPoPToken(pair.AccessToken, stolen, "GET", dpopTestURL); !errors.Is(err, auth.ErrInvalidDPoPProof) {
+		t.Errorf("expected ErrInvalidDPoPProof for a foreign key, got: %v", err)
+	}
+
+	thiefJKT, _ := a.ValidateDPoPProof(makeDPoPProof(t, thief, "POST", tokenURL, "", time.Now()), "POST", tokenURL, "")
+	if _, err := a.RefreshDPoPTokenPair(pair.RefreshToken, thiefJKT); !errors.Is(err, auth.ErrInvalidDPoPProof) {
+		t.Errorf("expected ErrInvalidDPoPProof refreshing with a foreign key, got: %v", err)
+	}
+	if _, err := a.RefreshTokenPair(pair.RefreshToken); !errors.Is(err, auth.ErrInvalidDPoPProof) {
+		t.Errorf("expected ErrInvalidDPoPProof refreshing a bound token as bearer, got: %v", err)
+	}
+	if _, err := a.ValidateRefreshToken(pair.RefreshToken); !errors.Is(err, auth.ErrDPoPProofRequired) {
+		t.Errorf("expected ErrDPoPProofRequired validating a bound refresh token, got: %v", err)
+	}
+
+	next, err := a.RefreshDPoPTokenPair(pair.RefreshToken, jkt)
+	if err != nil {
+		t.Fatalf("refresh with the bound key should succeed: %v", err)
+	}
+	nextProof := makeDPoPProof(t, key, "GET", dpopTestURL, next.AccessToken, time.Now())
+	nextClaims, err := a.ValidateDPoPToken(next.AccessToken, nextProof, "GET", dpopTestURL)
+	if err != nil {
+		t.Fatalf("rotated token should validate with its key: %v", err)
+	}
+	if nextClaims.Confirmation == nil || nextClaims.Confirmation.JKT != jkt {
+		t.Error("binding should carry over to the rotated pair")
+	}
+}
+
+/*
+TestBoundRefreshTokenNeedsProofWithRedis verifies that the Redis cache
+remembers a refresh token's binding, both when the token is issued and when
+it is filled from Postgres, so a cache hit cannot skip the proof.
+*/
+func TestBoundRefreshTokenNeedsProofWithRedis(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if !setupRedis(t, a) {
+		t.Skip("Redis is not available")
+	}
+	_ = a.JWTInit("dpop-redis-secret")
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+	_ = a.RegisterUser("dpop-redis@example.com", "password")
+
+	pair, err := a.IssueDPoPTokenPair("dpop-redis@example.com", "test-thumbprint")
+	if err != nil {
+		t.Fatalf("failed to issue DPoP pair: %v", err)
+	}
+	bearer, _ := a.IssueTokenPair("dpop-redis@example.com")
+
+	rdb := redis.NewClient(&redis.Options{Addr: testRedisHost, Password: testRedisPass})
+	defer rdb.Close()
+	sum := sha256.Sum256([]byte(pair.RefreshToken))
+	key := "refresh:" + hex.EncodeToString(sum[:])
+
+	/* Served from the entry written at issue, then from Postgres, then from the refill */
+	for i := 0; i < 3; i++ {
+		if i == 1 {
+			rdb.Del(context.Background(), key)
+		}
+		if _, err := a.ValidateRefreshToken(pair.RefreshToken); !errors.Is(err, auth.ErrDPoPProofRequired) {
+			t.Errorf("call %d: expected ErrDPoPProofRequired, got: %v", i, err)
+		}
+	}
+	if v, _ := rdb.Get(context.Background(), key).Result(); v == "" || strings.HasPrefix(v, "u:") {
+		t.Errorf("cache entry should record the binding, got %q", v)
+	}
+	if _, err := a.ValidateRefreshToken(bearer.RefreshToken); err != nil {
+		t.Errorf("unbound token should validate: %v", err)
+	}
+}
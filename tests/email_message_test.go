@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GCET-Open-Source-Foundation/auth/email"
+)
+
+func parseBuilt(t *testing.T, m *email.Message) *mail.Message {
+	t.Helper()
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("built message does not parse: %v\n%s", err, raw)
+	}
+	return msg
+}
+
+/*
+TestEmailMessageHeaders verifies the required headers, RFC 2047 encoding of
+display names and subjects, and that Bcc stays out of the headers.
+*/
+func TestEmailMessageHeaders(t *testing.T) {
+	m := &email.Message{
+		From:    mail.Address{Name: "Zoë's App", Address: "noreply@auth.test"},
+		To:      []mail.Address{{Name: "Jürgen", Address: "jurgen@example.com"}, {Address: "ann@example.com"}},
+		Bcc:     []mail.Address{{Address: "audit@example.com"}},
+		ReplyTo: []mail.Address{{Address: "support@auth.test"}},
+		Subject: "Ihr Bestätigungscode",
+		Text:    "Hallo",
+		Headers: map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@auth.test>"},
+	}
+	msg := parseBuilt(t, m)
+
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Zoë's App" || from[0].Address != "noreply@auth.test" {
+		t.Errorf("unexpected From %v (%v)", from, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Jürgen" {
+		t.Errorf("unexpected To %v (%v)", to, err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Ihr Bestätigungscode" {
+		t.Errorf("subject decoded to %q (%v)", subject, err)
+	}
+	if raw := msg.Header.Get("Subject"); !strings.HasPrefix(raw, "=?") {
+		t.Errorf("non-ASCII subject should be RFC 2047 encoded, got %q", raw)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("bad Date header: %v", err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@auth.test>") {
+		t.Errorf("unexpected Message-ID %q", id)
+	}
+	if msg.Header.Get("MIME-Version") != "1.0" || msg.Header.Get("Reply-To") != "<support@auth.test>" {
+		t.Errorf("missing MIME-Version or Reply-To: %v", msg.Header)
+	}
+	if msg.Header.Get("List-Unsubscribe") != "<mailto:unsubscribe@auth.test>" {
+		t.Errorf("custom header missing: %v", msg.Header)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Error("Bcc must not appear in the headers")
+	}
+
+	rcpts := m.Recipients()
+	if len(rcpts) != 3 || rcpts[2] != "audit@example.com" {
+		t.Errorf("unexpected recipients %v", rcpts)
+	}
+}
+
+/*
+TestEmailMessageFixedDateAndID verifies that Date and MessageID are used
+when given.
+*/
+func TestEmailMessageFixedDateAndID(t *testing.T) {
+	date := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg := parseBuilt(t, &email.Message{
+		From:      mail.Address{Address: "noreply@auth.test"},
+		To:        []mail.Address{{Address: "user@example.com"}},
+		Date:      date,
+		MessageID: "<fixed@auth.test>",
+	})
+	if got, _ := msg.Header.Date(); !got.Equal(date) {
+		t.Errorf("expected date %v, got %v", date, got)
+	}
+	if msg.Header.Get("Message-ID") != "<fixed@auth.test>" {
+		t.Errorf("unexpected Message-ID %q", msg.Header.Get("Message-ID"))
+	}
+}
+
+/*
+TestEmailMessageFoldsLongHeaders verifies that long subjects, encoded or
+not, are folded into lines of at most 78 characters and read back intact.
+*/
+func TestEmailMessageFoldsLongHeaders(t *testing.T) {
+	for _, subject := range []string{
+		strings.TrimSpace(strings.Repeat("Ihr Bestätigungscode für Ihr Konto bei Zoë's App ", 4)),
+		strings.Repeat("日本語の確認コード", 10),
+		strings.TrimSpace(strings.Repeat("Your verification code for the account ", 5)),
+	} {
+		m := &email.Message{
+			From:    mail.Address{Address: "noreply@auth.test"},
+			To:      []mail.Address{{Address: "user@example.com"}},
+			Subject: subject,
+			Headers: map[string]string{"X-Campaign-Description": subject},
+		}
+		raw, err := m.Bytes()
+		if err != nil {
+			t.Fatalf("Bytes failed: %v", err)
+		}
+		header, _, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+		for _, line := range strings.Split(string(header), "\r\n") {
+			if len(line) > 78 {
+				t.Errorf("header line of %d characters: %q", len(line), line)
+			}
+		}
+
+		msg := parseBuilt(t, m)
+		dec := new(mime.WordDecoder)
+		for _, name := range []string{"Subject", "X-Campaign-Description"} {
+			got, err := dec.DecodeHeader(msg.Header.Get(name))
+			if err != nil || got != subject {
+				t.Errorf("%s decoded to %q (%v)", name, got, err)
+			}
+		}
+	}
+}
+
+/*
+TestEmailMessageBody verifies that a body with long lines and non-ASCII text
+survives the quoted-printable encoding.
+*/
+func TestEmailMessageBody(t *testing.T) {
+	body := strings.Repeat("ünïcödé ", 200) + "\n.\nend"
+	msg := parseBuilt(t, &email.Message{
+		From: mail.Address{Address: "noreply@auth.test"},
+		To:   []mail.Address{{Address: "user@example.com"}},
+		Text: body,
+	})
+	if msg.Header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+		t.Fatalf("expected quoted-printable, got headers %v", msg.Header)
+	}
+	raw, _ := io.ReadAll(msg.Body)
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 76 {
+			t.Fatalf("encoded line too long (%d)", len(line))
+		}
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if got := strings.ReplaceAll(strings.TrimSuffix(string(decoded), "\r\n"), "\r\n", "\n"); got != body {
+		t.Errorf("body did not round trip")
+	}
+}
+
+/*
+TestEmailMessageRejectsInjection verifies that line breaks and bad names or
+addresses are refused with a *HeaderError.
+*/
+func TestEmailMessageRejectsInjection(t *testing.T) {
+	from := mail.Address{Address: "noreply@auth.test"}
+	to := []mail.Address{{Address: "user@example.com"}}
+	cases := []struct {
+		name  string
+		msg   email.Message
+		field string
+		want  error
+	}{
+		{"subject", email.Message{From: from, To: to, Subject: "Hi\r\nBcc: evil@example.com"}, "Subject", email.ErrHeaderInjection},
+		{"display name", email.Message{From: from, To: []mail.Address{{Name: "x\nBcc: evil@example.com", Address: "user@example.com"}}}, "To", email.ErrHeaderInjection},
+		{"address", email.Message{From: from, To: []mail.Address{{Address: "user@example.com\r\nBcc: evil@example.com"}}}, "To", email.ErrHeaderInjection},
+		{"custom value", email.Message{From: from, To: to, Headers: map[string]string{"X-Tag": "a\nb"}}, "X-Tag", email.ErrHeaderInjection},
+		{"reserved header", email.Message{From: from, To: to, Headers: map[string]string{"bcc": "evil@example.com"}}, "bcc", email.ErrInvalidHeader},
+		{"bad header name", email.Message{From: from, To: to, Headers: map[string]string{"X Bad": "v"}}, "X Bad", email.ErrInvalidHeader},
+		{"bad address", email.Message{From: from, To: []mail.Address{{Address: "not-an-address"}}}, "To", email.ErrInvalidAddress},
+		{"no from", email.Message{To: to}, "From", email.ErrInvalidAddress},
+		{"no recipients", email.Message{From: from}, "To", email.ErrInvalidAddress},
+	}
+	for _, tc := range cases {
+		_, err := tc.msg.Bytes()
+		var he *email.HeaderError
+		if !errors.As(err, &he) || he.Field != tc.field || !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected HeaderError{%s, %v}, got: %v", tc.name, tc.field, tc.want, err)
+		}
+	}
+}
+
+/*
+TestEmailSendRejectsInjection verifies that the sending helpers refuse an
+injection attempt before connecting to any server.
+*/
+func TestEmailSendRejectsInjection(t *testing.T) {
+	err := email.Send("127.0.0.1", "1", "noreply@auth.test", "pass", "user@example.com", "Hi\nBcc: evil@example.com", "body")
+	if !errors.Is(err, email.ErrHeaderInjection) {
+		t.Errorf("expected ErrHeaderInjection, got: %v", err)
+	}
+
+	client, _ := email.NewClient(email.Config{Host: "127.0.0.1", Port: "1"})
+	err = client.SendMail(context.Background(), "noreply@auth.test", "user@example.com\r\nBcc: evil@example.com", "Hi", "body")
+	var he *email.HeaderError
+	if !errors.As(err, &he) || he.Field != "To" {
+		t.Errorf("expected a HeaderError for To, got: %v", err)
+	}
+}
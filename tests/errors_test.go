@@ -17,8 +17,11 @@ func TestErrorsAreSentinels(t *testing.T) {
 		auth.ErrDatabaseUnavailable,
 		auth.ErrInvalidToken,
 		auth.ErrTokenExpired,
+		auth.ErrTokenRevoked,
 		auth.ErrOTPExpired,
 		auth.ErrInvalidOTP,
+		auth.ErrOTPAttemptsExceeded,
+		auth.ErrOTPResendCooldown,
 		auth.ErrUserNotFound,
 		auth.ErrInvalidCredentials,
 		auth.ErrSMTPNotInitialized,
@@ -30,9 +33,27 @@ func TestErrorsAreSentinels(t *testing.T) {
 		auth.ErrRefreshTokenInvalid,
 		auth.ErrRefreshTokenRevoked,
 		auth.ErrRefreshTokenExpired,
+		auth.ErrRefreshTokenReused,
+		auth.ErrSessionNotFound,
 		auth.ErrOAuthNotInitialized,
 		auth.ErrOAuthExchangeFailed,
 		auth.ErrOAuthProfileFetchFailed,
+		auth.ErrInvalidDPoPProof,
+		auth.ErrDPoPReplay,
+		auth.ErrDPoPProofRequired,
+		auth.ErrTOTPNotInitialized,
+		auth.ErrTOTPNotEnrolled,
+		auth.ErrTOTPAlreadyEnrolled,
+		auth.ErrInvalidTOTP,
+		auth.ErrTOTPReplay,
+		auth.ErrTOTPLocked,
+		auth.ErrInvalidRecoveryCode,
+		auth.ErrMFAChallengeInvalid,
+		auth.ErrMFAFactorNotAllowed,
+		auth.ErrStepUpAttemptsExceeded,
+		auth.ErrMagicLinkNotInitialized,
+		auth.ErrMagicLinkInvalid,
+		auth.ErrOutboxMessageNotFound,
 	}
 
 	for i, err := range sentinels {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	auth "github.com/GCET-Open-Source-Foundation/auth"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -74,9 +75,17 @@ func preCleanDB(t *testing.T, ctx context.Context) {
 	pool.Exec(ctx, "DROP TABLE IF EXISTS permissions CASCADE")
 	pool.Exec(ctx, "DROP TABLE IF EXISTS refresh_tokens CASCADE")
 	pool.Exec(ctx, "DROP TABLE IF EXISTS otps CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS totp_secrets CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS recovery_codes CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS mfa_challenges CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS step_up_attempts CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS magic_links CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS email_outbox CASCADE")
 	pool.Exec(ctx, "DROP TABLE IF EXISTS users CASCADE")
 	pool.Exec(ctx, "DROP TABLE IF EXISTS roles CASCADE")
 	pool.Exec(ctx, "DROP TABLE IF EXISTS spaces CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS revoked_tokens CASCADE")
+	pool.Exec(ctx, "DROP TABLE IF EXISTS token_watermarks CASCADE")
 }
 
 /*
@@ -91,3 +100,26 @@ func setupRedis(t *testing.T, a *auth.Auth) bool {
 	}
 	return true
 }
+
+/*
+plantOTP stores a known login OTP for email the way SendOTP would, hashed with
+a salt, so tests can verify codes without reading them back from an email.
+*/
+func plantOTP(t *testing.T, a *auth.Auth, email, code string, expiresAt time.Time) {
+	t.Helper()
+	plantPurposeOTP(t, a, email, auth.OTPPurposeLogin, code, expiresAt)
+}
+
+/* plantPurposeOTP is plantOTP for a code sent with SendOTPFor. */
+func plantPurposeOTP(t *testing.T, a *auth.Auth, email string, purpose auth.OTPPurpose, code string, expiresAt time.Time) {
+	t.Helper()
+	salt := "test-otp-salt-0123456789"
+	_, err := a.Conn.Exec(context.Background(), `
+		INSERT INTO otps (email, purpose, code, salt, attempts, expires_at) VALUES ($1, $2, $3, $4, 0, $5)
+		ON CONFLICT (email, purpose) DO UPDATE SET code = $3, salt = $4, attempts = 0, expires_at = $5`,
+		email, string(purpose), a.HashPassword(code, salt), salt, expiresAt,
+	)
+	if err != nil {
+		t.Fatalf("failed to plant OTP: %v", err)
+	}
+}
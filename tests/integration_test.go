@@ -311,22 +311,15 @@ func TestIntegrationCascadeDeleteUser(t *testing.T) {
 
 /*
 TestIntegrationOTPVerify tests OTP store/verify round-trip.
-We bypass SendOTP (needs real SMTP) and insert directly.
+We bypass SendOTP (needs real SMTP) and plant a hashed code directly.
 */
 func TestIntegrationOTPVerify(t *testing.T) {
 	skipIfShort(t)
 	a := setupTestAuth(t)
 
-	expiry := time.Now().Add(5 * time.Minute)
-	_, err := a.Conn.Exec(context.Background(),
-		"INSERT INTO otps (email, code, expires_at) VALUES ($1, $2, $3)",
-		"otp@example.com", "123456", expiry,
-	)
-	if err != nil {
-		t.Fatalf("failed to insert test OTP: %v", err)
-	}
+	plantOTP(t, a, "otp@example.com", "123456", time.Now().Add(5*time.Minute))
 
-	err = a.VerifyOTP("otp@example.com", "999999")
+	err := a.VerifyOTP("otp@example.com", "999999")
 	if err == nil {
 		t.Error("expected error for wrong OTP code")
 	}
@@ -350,10 +343,7 @@ func TestIntegrationOTPExpired(t *testing.T) {
 	a := setupTestAuth(t)
 
 	expiry := time.Now().Add(-1 * time.Minute)
-	_, _ = a.Conn.Exec(context.Background(),
-		"INSERT INTO otps (email, code, expires_at) VALUES ($1, $2, $3)",
-		"expired@example.com", "654321", expiry,
-	)
+	plantOTP(t, a, "expired@example.com", "654321", expiry)
 
 	err := a.VerifyOTP("expired@example.com", "654321")
 	if !errors.Is(err, auth.ErrOTPExpired) {
@@ -361,6 +351,60 @@ func TestIntegrationOTPExpired(t *testing.T) {
 	}
 }
 
+/*
+TestIntegrationOTPAttemptLimit verifies that a code dies after the configured
+number of wrong guesses, even when the right code is tried afterwards.
+*/
+func TestIntegrationOTPAttemptLimit(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.OTPMaxAttemptsInit(3)
+
+	plantOTP(t, a, "guess@example.com", "123456", time.Now().Add(5*time.Minute))
+
+	for i := 0; i < 2; i++ {
+		if err := a.VerifyOTP("guess@example.com", "000000"); !errors.Is(err, auth.ErrInvalidOTP) {
+			t.Errorf("guess %d: expected ErrInvalidOTP, got: %v", i, err)
+		}
+	}
+	if err := a.VerifyOTP("guess@example.com", "000000"); !errors.Is(err, auth.ErrOTPAttemptsExceeded) {
+		t.Errorf("last guess: expected ErrOTPAttemptsExceeded, got: %v", err)
+	}
+	if err := a.VerifyOTP("guess@example.com", "123456"); !errors.Is(err, auth.ErrOTPAttemptsExceeded) {
+		t.Errorf("correct code after lockout: expected ErrOTPAttemptsExceeded, got: %v", err)
+	}
+
+	/* A fresh code starts with a clean counter */
+	plantOTP(t, a, "guess@example.com", "654321", time.Now().Add(5*time.Minute))
+	if err := a.VerifyOTP("guess@example.com", "654321"); err != nil {
+		t.Errorf("fresh code should verify: %v", err)
+	}
+}
+
+/*
+TestIntegrationOTPStoredHashed verifies that SendOTP never writes the plain
+code to the database. Delivery fails (no SMTP server), but the row is saved first.
+*/
+func TestIntegrationOTPStoredHashed(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.SMTPInit("noreply@auth.test", "dummy_pass", "127.0.0.1", "1")
+
+	_ = a.SendOTP("hashed-otp@example.com")
+
+	var code string
+	var salt *string
+	err := a.Conn.QueryRow(context.Background(),
+		"SELECT code, salt FROM otps WHERE email = $1", "hashed-otp@example.com",
+	).Scan(&code, &salt)
+	if err != nil {
+		t.Fatalf("expected an OTP row: %v", err)
+	}
+	if salt == nil || len(code) == 6 {
+		t.Errorf("expected a salted hash, got code %q", code)
+	}
+}
+
 /*
 TestIntegrationOTPExists verifies the OTPExists function.
 */
@@ -369,10 +413,7 @@ func TestIntegrationOTPExists(t *testing.T) {
 	a := setupTestAuth(t)
 
 	expiry := time.Now().Add(5 * time.Minute)
-	_, _ = a.Conn.Exec(context.Background(),
-		"INSERT INTO otps (email, code, expires_at) VALUES ($1, $2, $3)",
-		"exists@example.com", "111111", expiry,
-	)
+	plantOTP(t, a, "exists@example.com", "111111", expiry)
 
 	exists, err := a.OTPExists("exists@example.com")
 	if err != nil {
@@ -399,14 +440,8 @@ func TestIntegrationListActiveOTPs(t *testing.T) {
 	a := setupTestAuth(t)
 
 	expiry := time.Now().Add(5 * time.Minute)
-	_, _ = a.Conn.Exec(context.Background(),
-		"INSERT INTO otps (email, code, expires_at) VALUES ($1, $2, $3)",
-		"active1@example.com", "111111", expiry,
-	)
-	_, _ = a.Conn.Exec(context.Background(),
-		"INSERT INTO otps (email, code, expires_at) VALUES ($1, $2, $3)",
-		"active2@example.com", "222222", expiry,
-	)
+	plantOTP(t, a, "active1@example.com", "111111", expiry)
+	plantOTP(t, a, "active2@example.com", "222222", expiry)
 
 	emails, err := a.ListActiveOTPs(10, 0)
 	if err != nil {
@@ -787,10 +822,7 @@ func TestIntegrationRateLimitedOTPVerification(t *testing.T) {
 	defer rl.Stop()
 
 	expiry := time.Now().Add(5 * time.Minute)
-	_, _ = a.Conn.Exec(context.Background(),
-		"INSERT INTO otps (email, code, expires_at) VALUES ($1, $2, $3)",
-		"otprl@example.com", "999888", expiry,
-	)
+	plantOTP(t, a, "otprl@example.com", "999888", expiry)
 
 	otpKey := "otp:otprl@example.com"
 
@@ -0,0 +1,252 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+var testClients = auth.ClientCredentials{"resource-server": "rs-secret"}
+
+/* postForm sends a form-encoded POST to h, authenticating with Basic auth when id is set. */
+func postForm(h http.Handler, id, secret string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id != "" {
+		req.SetBasicAuth(id, secret)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeIntrospection(t *testing.T, rec *httptest.ResponseRecorder) auth.IntrospectionResponse {
+	t.Helper()
+	var resp auth.IntrospectionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode introspection response: %v", err)
+	}
+	return resp
+}
+
+/*
+TestIntrospectionActiveAccessToken verifies that a valid JWT is reported active with its claims.
+*/
+func TestIntrospectionActiveAccessToken(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.JWTInit("introspect-secret")
+	h := a.IntrospectionHandler(testClients)
+
+	token, _ := a.GenerateToken("introspect@example.com", time.Hour)
+
+	rec := postForm(h, "resource-server", "rs-secret", url.Values{"token": {token}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	resp := decodeIntrospection(t, rec)
+	if !resp.Active {
+		t.Fatal("expected token to be active")
+	}
+	if resp.Username != "introspect@example.com" || resp.TokenType != "Bearer" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if resp.TokenID == "" || resp.ExpiresAt == 0 {
+		t.Errorf("expected jti and exp to be populated: %+v", resp)
+	}
+}
+
+/*
+TestIntrospectionInactiveToken verifies that garbage and expired tokens are reported inactive.
+*/
+func TestIntrospectionInactiveToken(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.JWTInit("introspect-secret")
+	h := a.IntrospectionHandler(testClients)
+
+	expired, _ := a.GenerateToken("introspect@example.com", -time.Hour)
+
+	for _, token := range []string{"not-a-token", expired} {
+		rec := postForm(h, "resource-server", "rs-secret", url.Values{"token": {token}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if resp := decodeIntrospection(t, rec); resp.Active {
+			t.Errorf("expected token %q to be inactive", token)
+		}
+	}
+}
+
+/*
+TestIntrospectionClientAuthentication verifies that callers must authenticate,
+via either Basic auth or form fields.
+*/
+func TestIntrospectionClientAuthentication(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.JWTInit("introspect-secret")
+	h := a.IntrospectionHandler(testClients)
+
+	form := url.Values{"token": {"anything"}}
+
+	if rec := postForm(h, "", "", form); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", rec.Code)
+	}
+	if rec := postForm(h, "resource-server", "wrong", form); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong secret, got %d", rec.Code)
+	}
+	if rec := postForm(h, "unknown", "rs-secret", form); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unknown client, got %d", rec.Code)
+	}
+
+	form.Set("client_id", "resource-server")
+	form.Set("client_secret", "rs-secret")
+	if rec := postForm(h, "", "", form); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 with form credentials, got %d", rec.Code)
+	}
+}
+
+/*
+TestIntrospectionBadRequests covers wrong method and a missing token parameter.
+*/
+func TestIntrospectionBadRequests(t *testing.T) {
+	a := auth.NewBareAuth()
+	h := a.IntrospectionHandler(testClients)
+
+	req := httptest.NewRequest(http.MethodGet, "/introspect", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+
+	if rec := postForm(h, "resource-server", "rs-secret", url.Values{}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing token, got %d", rec.Code)
+	}
+}
+
+/*
+TestRevocationWithoutBackend verifies that revoking a real access token reports
+503 when there is nowhere to store the deny-list entry, and that an invalid token gets 200.
+*/
+func TestRevocationWithoutBackend(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.JWTInit("revocation-secret")
+	h := a.RevocationHandler(testClients)
+
+	token, _ := a.GenerateToken("revoker@example.com", time.Hour)
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	if rec := postForm(h, "resource-server", "rs-secret", form); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a storage backend, got %d", rec.Code)
+	}
+
+	form = url.Values{"token": {"garbage"}, "token_type_hint": {"access_token"}}
+	rec := postForm(h, "resource-server", "rs-secret", form)
+	if rec.Code != http.StatusServiceUnavailable && rec.Code != http.StatusOK {
+		t.Errorf("unexpected status %d for invalid token", rec.Code)
+	}
+
+	if rec := postForm(h, "resource-server", "bad", form); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for bad client credentials, got %d", rec.Code)
+	}
+}
+
+/*
+TestIntegrationIntrospectionAndRevocation tests the full round trip against Postgres:
+introspect active -> revoke -> introspect inactive, for both token types.
+*/
+func TestIntegrationIntrospectionAndRevocation(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("introspection-integration-secret")
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+	_ = a.RegisterUser("rs@example.com", "password")
+
+	introspect := a.IntrospectionHandler(testClients)
+	revoke := a.RevocationHandler(testClients)
+
+	pair, err := a.IssueTokenPair("rs@example.com")
+	if err != nil {
+		t.Fatalf("failed to issue token pair: %v", err)
+	}
+
+	for _, tc := range []struct {
+		token, hint string
+	}{
+		{pair.AccessToken, "access_token"},
+		{pair.RefreshToken, "refresh_token"},
+	} {
+		rec := postForm(introspect, "resource-server", "rs-secret", url.Values{"token": {tc.token}})
+		resp := decodeIntrospection(t, rec)
+		if !resp.Active || resp.TokenType != "Bearer" {
+			t.Fatalf("expected active %s, got %+v", tc.hint, resp)
+		}
+
+		rec = postForm(revoke, "resource-server", "rs-secret", url.Values{"token": {tc.token}, "token_type_hint": {tc.hint}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 revoking %s, got %d", tc.hint, rec.Code)
+		}
+
+		rec = postForm(introspect, "resource-server", "rs-secret", url.Values{"token": {tc.token}})
+		if resp := decodeIntrospection(t, rec); resp.Active {
+			t.Errorf("expected %s to be inactive after revocation", tc.hint)
+		}
+	}
+
+	/* Unknown tokens are not an error per RFC 7009 */
+	rec := postForm(revoke, "resource-server", "rs-secret", url.Values{"token": {"unknown-token"}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for unknown token, got %d", rec.Code)
+	}
+}
+
+/*
+TestIntegrationRevokeRefreshTokenRevokesSession verifies that revoking a
+refresh token through the endpoint also revokes its session's access tokens,
+and that introspecting a refresh token does not mark the session as used.
+*/
+func TestIntegrationRevokeRefreshTokenRevokesSession(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("introspection-session-secret")
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+
+	pair, err := a.IssueTokenPair("grant@example.com")
+	if err != nil {
+		t.Fatalf("failed to issue token pair: %v", err)
+	}
+	other, _ := a.IssueTokenPair("grant@example.com")
+
+	before, _ := a.ListUserSessions("grant@example.com")
+	time.Sleep(20 * time.Millisecond)
+	rec := postForm(a.IntrospectionHandler(testClients), "resource-server", "rs-secret",
+		url.Values{"token": {pair.RefreshToken}, "token_type_hint": {"refresh_token"}})
+	if resp := decodeIntrospection(t, rec); !resp.Active || resp.SessionID == "" {
+		t.Fatalf("expected an active refresh token with its session, got %+v", resp)
+	}
+	after, _ := a.ListUserSessions("grant@example.com")
+	for i := range before {
+		if !after[i].LastUsedAt.Equal(before[i].LastUsedAt) {
+			t.Error("introspection must not update last_used_at")
+		}
+	}
+
+	rec = postForm(a.RevocationHandler(testClients), "resource-server", "rs-secret",
+		url.Values{"token": {pair.RefreshToken}, "token_type_hint": {"refresh_token"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if _, err := a.ValidateToken(pair.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected the session's access token to be revoked, got: %v", err)
+	}
+	if _, err := a.ValidateToken(other.AccessToken); err != nil {
+		t.Errorf("another session's access token should stay valid: %v", err)
+	}
+}
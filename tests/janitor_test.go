@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestJanitorInit verifies configuration validation and that a bare instance
+without a database reports ErrDatabaseUnavailable on a manual run.
+*/
+func TestJanitorInit(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.JanitorInit(auth.JanitorConfig{BatchSize: -1}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got: %v", err)
+	}
+	if err := a.JanitorInit(auth.JanitorConfig{Interval: -1}); err != nil {
+		t.Errorf("a negative interval should disable periodic runs, got: %v", err)
+	}
+	if _, err := a.RunJanitor(); !errors.Is(err, auth.ErrDatabaseUnavailable) {
+		t.Errorf("expected ErrDatabaseUnavailable, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationRunJanitor verifies that a manual run purges expired OTPs,
+expired refresh tokens and revoked refresh tokens past their retention, keeps
+live and unexpired revoked tokens, and updates the stats.
+*/
+func TestIntegrationRunJanitor(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+	_ = a.JanitorInit(auth.JanitorConfig{Interval: -1, BatchSize: 2, RevokedRetention: time.Hour})
+
+	userID := "janitor@example.com"
+	_ = a.RegisterUser(userID, "password")
+	ctx := context.Background()
+
+	past := time.Now().Add(-2 * time.Hour)
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		plantOTP(t, a, email, "123456", past)
+	}
+	plantExpiredRefreshTokens(t, a, userID, "expired", 3)
+
+	live, _ := a.GenerateRefreshToken(userID)
+	oldRevoked, _ := a.GenerateRefreshToken(userID)
+	recentRevoked, _ := a.GenerateRefreshToken(userID)
+	_ = a.RevokeRefreshToken(oldRevoked)
+	_ = a.RevokeRefreshToken(recentRevoked)
+	digest := sha256.Sum256([]byte(oldRevoked))
+	_, _ = a.Conn.Exec(ctx,
+		"UPDATE refresh_tokens SET expires_at = NOW() - INTERVAL '2 hours' WHERE token = $1",
+		hex.EncodeToString(digest[:]),
+	)
+
+	counts, err := a.RunJanitor()
+	if err != nil {
+		t.Fatalf("janitor run failed: %v", err)
+	}
+	if counts.OTPs != 3 || counts.ExpiredRefreshTokens != 3 || counts.RevokedRefreshTokens != 1 {
+		t.Errorf("unexpected counts: %+v", counts)
+	}
+
+	if _, err := a.ValidateRefreshToken(live); err != nil {
+		t.Errorf("live token should survive: %v", err)
+	}
+	if _, err := a.ValidateRefreshToken(recentRevoked); !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+		t.Errorf("unexpired revoked token should be kept, got: %v", err)
+	}
+
+	stats := a.JanitorStats()
+	if stats.Runs != 1 || stats.Deleted.OTPs != 3 || stats.LastError != "" || stats.LastRun.IsZero() {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+/* plantExpiredRefreshTokens inserts n live but expired refresh tokens for userID. */
+func plantExpiredRefreshTokens(t *testing.T, a *auth.Auth, userID, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := a.Conn.Exec(context.Background(),
+			"INSERT INTO refresh_tokens (token, user_id, expires_at, revoked, created_at) VALUES ($1, $2, NOW() - INTERVAL '2 hours', false, NOW())",
+			fmt.Sprintf("%s-%d", prefix, i), userID,
+		)
+		if err != nil {
+			t.Fatalf("failed to plant refresh token: %v", err)
+		}
+	}
+}
+
+/*
+TestIntegrationJanitorKeepsUnexpiredRevokedTokens verifies that a revoked
+refresh token is kept until it expires, however long ago it was revoked, so
+replaying it is still detected as reuse.
+*/
+func TestIntegrationJanitorKeepsUnexpiredRevokedTokens(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 60 * 24 * time.Hour})
+	_ = a.JanitorInit(auth.JanitorConfig{Interval: -1})
+
+	userID := "janitor-revoked@example.com"
+	_ = a.RegisterUser(userID, "password")
+
+	token, _ := a.GenerateRefreshToken(userID)
+	_ = a.RevokeRefreshToken(token)
+	digest := sha256.Sum256([]byte(token))
+	_, _ = a.Conn.Exec(context.Background(),
+		"UPDATE refresh_tokens SET revoked_at = NOW() - INTERVAL '30 days' WHERE token = $1",
+		hex.EncodeToString(digest[:]),
+	)
+
+	counts, err := a.RunJanitor()
+	if err != nil {
+		t.Fatalf("janitor run failed: %v", err)
+	}
+	if counts.RevokedRefreshTokens != 0 {
+		t.Errorf("expected no revoked tokens purged, got: %+v", counts)
+	}
+	if _, err := a.ValidateRefreshToken(token); !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+		t.Errorf("expected the unexpired revoked token to be kept, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationJanitorBatches verifies that a backlog larger than BatchSize
+is purged completely, including one that is an exact multiple of it.
+*/
+func TestIntegrationJanitorBatches(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JanitorInit(auth.JanitorConfig{Interval: -1, BatchSize: 2})
+
+	userID := "janitor-batch@example.com"
+	_ = a.RegisterUser(userID, "password")
+	plantExpiredRefreshTokens(t, a, userID, "batch", 5)
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		plantOTP(t, a, fmt.Sprintf("batch-%d@example.com", i), "123456", past)
+	}
+
+	counts, err := a.RunJanitor()
+	if err != nil {
+		t.Fatalf("janitor run failed: %v", err)
+	}
+	if counts.ExpiredRefreshTokens != 5 || counts.OTPs != 4 {
+		t.Errorf("unexpected counts: %+v", counts)
+	}
+
+	var left int
+	_ = a.Conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM refresh_tokens WHERE user_id = $1", userID).Scan(&left)
+	if left != 0 {
+		t.Errorf("expected every expired refresh token purged, %d left", left)
+	}
+}
+
+/*
+TestIntegrationJanitorStatsAccumulate verifies that JanitorStats sums the
+deleted rows of every run while RunJanitor returns only its own.
+*/
+func TestIntegrationJanitorStatsAccumulate(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JanitorInit(auth.JanitorConfig{Interval: -1})
+
+	userID := "janitor-stats@example.com"
+	_ = a.RegisterUser(userID, "password")
+
+	plantExpiredRefreshTokens(t, a, userID, "first", 2)
+	if _, err := a.RunJanitor(); err != nil {
+		t.Fatalf("first janitor run failed: %v", err)
+	}
+	plantExpiredRefreshTokens(t, a, userID, "second", 3)
+	counts, err := a.RunJanitor()
+	if err != nil {
+		t.Fatalf("second janitor run failed: %v", err)
+	}
+	if counts.ExpiredRefreshTokens != 3 {
+		t.Errorf("expected 3 deleted by the second run, got: %+v", counts)
+	}
+
+	stats := a.JanitorStats()
+	if stats.Runs != 2 || stats.Failures != 0 || stats.Deleted.ExpiredRefreshTokens != 5 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+/*
+TestIntegrationJanitorFailure verifies that a failing table is reported in
+the error and LastError without stopping the other purges, and that the
+next clean run clears LastError but keeps the failure count.
+*/
+func TestIntegrationJanitorFailure(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JanitorInit(auth.JanitorConfig{Interval: -1})
+	ctx := context.Background()
+
+	userID := "janitor-failure@example.com"
+	_ = a.RegisterUser(userID, "password")
+	plantExpiredRefreshTokens(t, a, userID, "failure", 2)
+
+	if _, err := a.Conn.Exec(ctx, "ALTER TABLE magic_links RENAME TO magic_links_hidden"); err != nil {
+		t.Fatalf("failed to hide magic_links: %v", err)
+	}
+	counts, err := a.RunJanitor()
+	if err == nil || !errors.Is(err, auth.ErrDatabaseUnavailable) || !strings.Contains(err.Error(), "magic_links") {
+		t.Errorf("expected a magic_links ErrDatabaseUnavailable, got: %v", err)
+	}
+	if counts.ExpiredRefreshTokens != 2 {
+		t.Errorf("other tables should still be purged, got: %+v", counts)
+	}
+	stats := a.JanitorStats()
+	if stats.Failures != 1 || !strings.Contains(stats.LastError, "magic_links") {
+		t.Errorf("unexpected stats after a failed run: %+v", stats)
+	}
+
+	if _, err := a.Conn.Exec(ctx, "ALTER TABLE magic_links_hidden RENAME TO magic_links"); err != nil {
+		t.Fatalf("failed to restore magic_links: %v", err)
+	}
+	if _, err := a.RunJanitor(); err != nil {
+		t.Fatalf("janitor run failed: %v", err)
+	}
+	stats = a.JanitorStats()
+	if stats.Runs != 2 || stats.Failures != 1 || stats.LastError != "" {
+		t.Errorf("unexpected stats after a clean run: %+v", stats)
+	}
+}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+var testMagicLinkConfig = auth.MagicLinkConfig{
+	SigningKey:       bytes.Repeat([]byte{0x24}, 32),
+	AllowedRedirects: []string{"https://app.example.com/auth/magic"},
+}
+
+/*
+TestMagicLinkInit verifies validation of the magic link settings.
+*/
+func TestMagicLinkInit(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.MagicLinkInit(auth.MagicLinkConfig{SigningKey: []byte("short"), AllowedRedirects: []string{"https://x.test/"}}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a short key, got: %v", err)
+	}
+	if err := a.MagicLinkInit(auth.MagicLinkConfig{SigningKey: testMagicLinkConfig.SigningKey}); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput without redirects, got: %v", err)
+	}
+	if err := a.MagicLinkInit(auth.MagicLinkConfig{SigningKey: testMagicLinkConfig.SigningKey, AllowedRedirects: []string{"/relative"}}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a relative redirect, got: %v", err)
+	}
+	if err := a.MagicLinkInit(testMagicLinkConfig); err != nil {
+		t.Errorf("valid config should be accepted: %v", err)
+	}
+}
+
+/*
+TestMagicLinkRedirectAllowList verifies that links can only point at the
+allowed redirect URLs.
+*/
+func TestMagicLinkRedirectAllowList(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.SendMagicLink("user@example.com", "https://app.example.com/auth/magic"); !errors.Is(err, auth.ErrMagicLinkNotInitialized) {
+		t.Errorf("expected ErrMagicLinkNotInitialized, got: %v", err)
+	}
+	_ = a.MagicLinkInit(testMagicLinkConfig)
+
+	for _, bad := range []string{
+		"https://evil.example.net/auth/magic",
+		"http://app.example.com/auth/magic",
+		"https://app.example.com/other",
+		"https://attacker@app.example.com/auth/magic",
+		"https://app.example.com/auth/magic-evil",
+		"https://app.example.com/auth/magic/../admin",
+		"https://app.example.com/auth/magic/%2e%2e/admin",
+	} {
+		if err := a.SendMagicLink("user@example.com", bad); !errors.Is(err, auth.ErrInvalidInput) {
+			t.Errorf("%s: expected ErrInvalidInput, got: %v", bad, err)
+		}
+	}
+
+	/* An allowed URL gets past the check and fails later for want of a database */
+	for _, good := range []string{
+		"https://app.example.com/auth/magic?next=/home",
+		"https://app.example.com/auth/magic/callback",
+	} {
+		if err := a.SendMagicLink("user@example.com", good); !errors.Is(err, auth.ErrNotInitialized) {
+			t.Errorf("%s: expected ErrNotInitialized, got: %v", good, err)
+		}
+	}
+}
+
+/*
+TestConsumeMagicLinkForged verifies that unsigned or altered tokens are
+rejected without a database.
+*/
+func TestConsumeMagicLinkForged(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.MagicLinkInit(testMagicLinkConfig)
+
+	for _, token := range []string{"garbage", "abc.def", "AAAA.AAAA"} {
+		if _, err := a.ConsumeMagicLink(token); !errors.Is(err, auth.ErrMagicLinkInvalid) {
+			t.Errorf("%q: expected ErrMagicLinkInvalid, got: %v", token, err)
+		}
+	}
+}
+
+/*
+TestIntegrationSendMagicLink verifies that links are only sent to known users
+unless CreateUsers is set, and that only a digest is stored.
+*/
+func TestIntegrationSendMagicLink(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.SMTPInit("noreply@auth.test", "dummy_pass", "127.0.0.1", "1")
+	_ = a.MagicLinkInit(testMagicLinkConfig)
+
+	if err := a.SendMagicLink("nobody@example.com", "https://app.example.com/auth/magic"); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got: %v", err)
+	}
+
+	cfg := testMagicLinkConfig
+	cfg.CreateUsers = true
+	_ = a.MagicLinkInit(cfg)
+
+	/* Delivery fails (no SMTP server), but the link is stored first */
+	_ = a.SendMagicLink("newcomer@example.com", "https://app.example.com/auth/magic")
+
+	var token string
+	err := a.Conn.QueryRow(context.Background(),
+		"SELECT token FROM magic_links WHERE email = $1", "newcomer@example.com",
+	).Scan(&token)
+	if err != nil {
+		t.Fatalf("expected a stored link: %v", err)
+	}
+	if len(token) != 64 {
+		t.Errorf("expected a SHA-256 digest, got %q", token)
+	}
+}
+
+/*
+TestIntegrationMagicLinkRoundTrip follows a link from the notifier to a token
+pair, and checks that it only works once.
+*/
+func TestIntegrationMagicLinkRoundTrip(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	rec := &auth.RecordingNotifier{}
+	_ = a.NotifierInit(rec)
+	_ = a.JWTInit("magic-link-secret", 15*time.Minute)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+	cfg := testMagicLinkConfig
+	cfg.CreateUsers = true
+	_ = a.MagicLinkInit(cfg)
+
+	if err := a.SendMagicLink("linked@example.com", "https://app.example.com/auth/magic"); err != nil {
+		t.Fatalf("SendMagicLink failed: %v", err)
+	}
+	msg, ok := rec.Last("linked@example.com")
+	if !ok || msg.Kind != auth.MessageKindMagicLink {
+		t.Fatalf("expected a magic link message, got %+v", msg)
+	}
+	link, err := url.Parse(msg.Link)
+	if err != nil {
+		t.Fatalf("bad link %q: %v", msg.Link, err)
+	}
+	token := link.Query().Get("token")
+
+	res, err := a.ConsumeMagicLink(token)
+	if err != nil {
+		t.Fatalf("ConsumeMagicLink failed: %v", err)
+	}
+	if res.Tokens == nil {
+		t.Fatalf("expected tokens, got %+v", res)
+	}
+	claims, _ := a.ValidateToken(res.Tokens.AccessToken)
+	if claims.UserID != "linked@example.com" {
+		t.Errorf("expected the token for linked@example.com, got %q", claims.UserID)
+	}
+
+	if _, err := a.ConsumeMagicLink(token); !errors.Is(err, auth.ErrMagicLinkInvalid) {
+		t.Errorf("expected ErrMagicLinkInvalid on reuse, got: %v", err)
+	}
+}
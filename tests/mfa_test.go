@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestMFAInit verifies validation of the login state machine settings.
+*/
+func TestMFAInit(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.MFAInit(auth.MFAConfig{MaxAttempts: -1}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got: %v", err)
+	}
+	if err := a.MFAInit(auth.MFAConfig{ChallengeExpiry: time.Minute, EmailOTP: true}); err != nil {
+		t.Errorf("valid config should be accepted: %v", err)
+	}
+}
+
+/* setupMFAAuth returns an instance ready to issue tokens, with one registered user. */
+func setupMFAAuth(t *testing.T, userID string) *auth.Auth {
+	t.Helper()
+	a := setupTestAuth(t)
+	_ = a.JWTInit("mfa-test-secret", 15*time.Minute)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+	if err := a.RegisterUser(userID, "password123"); err != nil {
+		t.Fatalf("RegisterUser failed: %v", err)
+	}
+	return a
+}
+
+/*
+TestIntegrationLoginWithoutMFA verifies that a user with no second factor
+gets tokens straight away, marked single-factor, and keeps the claims across
+a refresh.
+*/
+func TestIntegrationLoginWithoutMFA(t *testing.T) {
+	skipIfShort(t)
+	a := setupMFAAuth(t, "plain-user")
+
+	if _, err := a.Login("plain-user", "wrong"); !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got: %v", err)
+	}
+
+	res, err := a.Login("plain-user", "password123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if res.Tokens == nil || res.Challenge != nil {
+		t.Fatalf("expected tokens without a challenge, got %+v", res)
+	}
+	claims, _ := a.ValidateToken(res.Tokens.AccessToken)
+	if claims.ACR != auth.ACRSingleFactor || !slices.Equal(claims.AMR, []string{"pwd"}) || claims.AuthTime == nil {
+		t.Errorf("unexpected assurance claims: acr=%q amr=%v", claims.ACR, claims.AMR)
+	}
+
+	refreshed, err := a.RefreshTokenPair(res.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("RefreshTokenPair failed: %v", err)
+	}
+	claims, _ = a.ValidateToken(refreshed.AccessToken)
+	if claims.ACR != auth.ACRSingleFactor {
+		t.Errorf("acr should survive a refresh, got %q", claims.ACR)
+	}
+
+	stepped, err := a.StepUp(refreshed.AccessToken, auth.MFAFactorPassword, "password123")
+	if err != nil {
+		t.Fatalf("StepUp failed: %v", err)
+	}
+	claims, _ = a.ValidateToken(stepped)
+	if claims.ACR != auth.ACRSingleFactor || claims.SessionID == "" {
+		t.Errorf("password step-up should keep the level and session, got acr=%q sid=%q", claims.ACR, claims.SessionID)
+	}
+}
+
+/*
+TestIntegrationLoginWithTOTP walks a user with an authenticator app through
+the challenge, and checks that a challenge is single-use.
+*/
+func TestIntegrationLoginWithTOTP(t *testing.T) {
+	skipIfShort(t)
+	a := setupMFAAuth(t, "mfa-user")
+	_ = a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme"})
+
+	enr, err := a.EnrollTOTP("mfa-user")
+	if err != nil {
+		t.Fatalf("EnrollTOTP failed: %v", err)
+	}
+	/* Confirm with the previous step so the current one is still unused */
+	prev, _ := a.TOTPCode(enr.Secret, time.Now().Add(-30*time.Second))
+	if err := a.ConfirmTOTP("mfa-user", prev); err != nil {
+		t.Fatalf("ConfirmTOTP failed: %v", err)
+	}
+	codes, _ := a.GenerateRecoveryCodes("mfa-user")
+
+	res, err := a.Login("mfa-user", "password123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if res.Tokens != nil || res.Challenge == nil {
+		t.Fatalf("expected a challenge, got %+v", res)
+	}
+	if !slices.Equal(res.Challenge.Factors, []auth.MFAFactor{auth.MFAFactorTOTP, auth.MFAFactorRecoveryCode}) {
+		t.Errorf("unexpected factors: %v", res.Challenge.Factors)
+	}
+
+	if _, err := a.CompleteMFA(res.Challenge.Token, auth.MFAFactorEmailOTP, "123456"); !errors.Is(err, auth.ErrMFAFactorNotAllowed) {
+		t.Errorf("expected ErrMFAFactorNotAllowed, got: %v", err)
+	}
+
+	code, _ := a.TOTPCode(enr.Secret, time.Now())
+	pair, err := a.CompleteMFA(res.Challenge.Token, auth.MFAFactorTOTP, code)
+	if err != nil {
+		t.Fatalf("CompleteMFA failed: %v", err)
+	}
+	claims, _ := a.ValidateToken(pair.AccessToken)
+	if claims.ACR != auth.ACRMultiFactor || !slices.Contains(claims.AMR, "otp") || !slices.Contains(claims.AMR, "mfa") {
+		t.Errorf("unexpected assurance claims: acr=%q amr=%v", claims.ACR, claims.AMR)
+	}
+
+	if _, err := a.CompleteMFA(res.Challenge.Token, auth.MFAFactorRecoveryCode, codes[0]); !errors.Is(err, auth.ErrMFAChallengeInvalid) {
+		t.Errorf("challenge must be single-use, got: %v", err)
+	}
+
+	stepped, err := a.StepUp(pair.AccessToken, auth.MFAFactorRecoveryCode, codes[0])
+	if err != nil {
+		t.Fatalf("StepUp failed: %v", err)
+	}
+	claims, _ = a.ValidateToken(stepped)
+	if !slices.Contains(claims.AMR, "kba") || claims.AuthTime == nil {
+		t.Errorf("expected kba in amr after a recovery code step-up, got %v", claims.AMR)
+	}
+}
+
+/*
+TestIntegrationLoginWithEmailOTP verifies the email factor offered by
+MFAConfig.EmailOTP to users whose ID is an email address.
+*/
+func TestIntegrationLoginWithEmailOTP(t *testing.T) {
+	skipIfShort(t)
+	a := setupMFAAuth(t, "emailmfa@example.com")
+	rec := &auth.RecordingNotifier{}
+	_ = a.NotifierInit(rec)
+	_ = a.MFAInit(auth.MFAConfig{EmailOTP: true})
+
+	res, err := a.Login("emailmfa@example.com", "password123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if res.Challenge == nil || !slices.Equal(res.Challenge.Factors, []auth.MFAFactor{auth.MFAFactorEmailOTP}) {
+		t.Fatalf("expected an email OTP challenge, got %+v", res)
+	}
+
+	if err := a.SendMFAEmailOTP(res.Challenge.Token); err != nil {
+		t.Fatalf("SendMFAEmailOTP failed: %v", err)
+	}
+	msg, ok := rec.Last("emailmfa@example.com")
+	if !ok || msg.Purpose != auth.OTPPurposeMFA {
+		t.Fatalf("expected an MFA code, got %+v", msg)
+	}
+
+	pair, err := a.CompleteMFA(res.Challenge.Token, auth.MFAFactorEmailOTP, msg.Code)
+	if err != nil {
+		t.Fatalf("CompleteMFA failed: %v", err)
+	}
+	claims, _ := a.ValidateToken(pair.AccessToken)
+	if claims.ACR != auth.ACRMultiFactor {
+		t.Errorf("expected %s, got %q", auth.ACRMultiFactor, claims.ACR)
+	}
+}
+
+/*
+TestIntegrationStepUpAttemptLimit verifies that StepUp shares the challenge's
+attempt budget, counted separately for each factor, and that the budget
+comes back once the window is over.
+*/
+func TestIntegrationStepUpAttemptLimit(t *testing.T) {
+	skipIfShort(t)
+	a := setupMFAAuth(t, "stepup-user")
+	_ = a.MFAInit(auth.MFAConfig{MaxAttempts: 2, ChallengeExpiry: time.Second})
+	pair, err := a.IssueTokenPair("stepup-user")
+	if err != nil {
+		t.Fatalf("IssueTokenPair failed: %v", err)
+	}
+
+	if _, err := a.StepUp(pair.AccessToken, "carrier_pigeon", "coo"); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for an unknown factor, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := a.StepUp(pair.AccessToken, auth.MFAFactorPassword, "wrong"); err == nil || errors.Is(err, auth.ErrStepUpAttemptsExceeded) {
+			t.Fatalf("expected a wrong password, got: %v", err)
+		}
+	}
+	_, err = a.StepUp(pair.AccessToken, auth.MFAFactorPassword, "password123")
+	var ra *auth.RetryAfterError
+	if !errors.As(err, &ra) || !errors.Is(err, auth.ErrStepUpAttemptsExceeded) {
+		t.Fatalf("expected ErrStepUpAttemptsExceeded, got: %v", err)
+	}
+	if ra.RetryAfter > time.Second {
+		t.Errorf("expected a wait of up to a second, got %v", ra.RetryAfter)
+	}
+
+	/* Each factor has its own budget */
+	if _, err := a.StepUp(pair.AccessToken, auth.MFAFactorRecoveryCode, "not-a-code"); errors.Is(err, auth.ErrStepUpAttemptsExceeded) {
+		t.Errorf("recovery codes should not share the password's budget")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := a.StepUp(pair.AccessToken, auth.MFAFactorPassword, "password123"); err != nil {
+		t.Errorf("step-up should work once the window is over: %v", err)
+	}
+}
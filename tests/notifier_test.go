@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestNotifierInit verifies that a nil notifier is rejected.
+*/
+func TestNotifierInit(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.NotifierInit(nil); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if err := a.NotifierInit(&auth.RecordingNotifier{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+/*
+TestRecordingNotifier verifies that messages are kept in order per recipient.
+*/
+func TestRecordingNotifier(t *testing.T) {
+	r := &auth.RecordingNotifier{}
+	_ = r.Notify(context.Background(), auth.Message{To: "a@example.com", Code: "1"})
+	_ = r.Notify(context.Background(), auth.Message{To: "b@example.com", Code: "2"})
+	_ = r.Notify(context.Background(), auth.Message{To: "a@example.com", Code: "3"})
+
+	if got := len(r.Messages()); got != 3 {
+		t.Errorf("expected 3 messages, got %d", got)
+	}
+	if m, ok := r.Last("a@example.com"); !ok || m.Code != "3" {
+		t.Errorf("expected the latest message for a@example.com, got %+v", m)
+	}
+	if _, ok := r.Last("c@example.com"); ok {
+		t.Error("expected no message for an unknown recipient")
+	}
+
+	r.Reset()
+	if got := len(r.Messages()); got != 0 {
+		t.Errorf("expected no messages after Reset, got %d", got)
+	}
+}
+
+/*
+TestWebhookNotifier verifies the JSON body, the signature header and that
+error statuses are reported.
+*/
+func TestWebhookNotifier(t *testing.T) {
+	secret := []byte("webhook-secret")
+	status := http.StatusNoContent
+	var got auth.Message
+	var sigOK bool
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		sigOK = r.Header.Get("X-Auth-Signature") == "sha256="+hex.EncodeToString(mac.Sum(nil))
+		_ = json.Unmarshal(body, &got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	w := &auth.WebhookNotifier{URL: srv.URL, Secret: secret}
+	msg := auth.Message{Kind: auth.MessageKindOTP, To: "user@example.com", Purpose: auth.OTPPurposeLogin, Code: "123456"}
+	if err := w.Notify(context.Background(), msg); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if !sigOK {
+		t.Error("signature header did not match the body")
+	}
+	if got.To != msg.To || got.Code != msg.Code || got.Kind != msg.Kind {
+		t.Errorf("unexpected body: %+v", got)
+	}
+
+	status = http.StatusBadGateway
+	if err := w.Notify(context.Background(), msg); err == nil {
+		t.Error("expected an error for a 502 response")
+	}
+}
+
+/*
+TestIntegrationSendOTPThroughNotifier verifies that SendOTP uses the
+configured notifier and that the delivered code verifies.
+*/
+func TestIntegrationSendOTPThroughNotifier(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	rec := &auth.RecordingNotifier{}
+	_ = a.NotifierInit(rec)
+
+	if err := a.SendOTP("notify@example.com"); err != nil {
+		t.Fatalf("SendOTP failed: %v", err)
+	}
+	msg, ok := rec.Last("notify@example.com")
+	if !ok || msg.Kind != auth.MessageKindOTP || msg.Code == "" {
+		t.Fatalf("expected an OTP message, got %+v", msg)
+	}
+	if err := a.VerifyOTP("notify@example.com", msg.Code); err != nil {
+		t.Errorf("delivered code should verify: %v", err)
+	}
+}
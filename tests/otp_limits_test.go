@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestOTPSendLimitsInit verifies validation of the send limits.
+*/
+func TestOTPSendLimitsInit(t *testing.T) {
+	a := auth.NewBareAuth()
+	defer a.Close()
+
+	if err := a.OTPSendLimitsInit(auth.OTPSendLimits{ResendInterval: -time.Second}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a negative interval, got: %v", err)
+	}
+	if err := a.OTPSendLimitsInit(auth.OTPSendLimits{PerIPDaily: -1}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a negative cap, got: %v", err)
+	}
+	if err := a.OTPSendLimitsInit(auth.OTPSendLimits{ResendInterval: time.Minute, PerRecipientDaily: 5, PerIPDaily: 20}); err != nil {
+		t.Errorf("valid limits should be accepted: %v", err)
+	}
+}
+
+/*
+TestRetryAfterError verifies that the error unwraps to its sentinel.
+*/
+func TestRetryAfterError(t *testing.T) {
+	var err error = &auth.RetryAfterError{Err: auth.ErrOTPResendCooldown, RetryAfter: 30 * time.Second}
+
+	if !errors.Is(err, auth.ErrOTPResendCooldown) {
+		t.Errorf("expected to unwrap to ErrOTPResendCooldown, got: %v", err)
+	}
+	var ra *auth.RetryAfterError
+	if !errors.As(err, &ra) || ra.RetryAfter != 30*time.Second {
+		t.Errorf("expected RetryAfter of 30s, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationOTPResendCooldown verifies that a second code for the same
+email and purpose is refused until the interval has passed, while other
+purposes are unaffected.
+*/
+func TestIntegrationOTPResendCooldown(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.NotifierInit(&auth.RecordingNotifier{})
+	if err := a.OTPSendLimitsInit(auth.OTPSendLimits{ResendInterval: time.Minute}); err != nil {
+		t.Fatalf("OTPSendLimitsInit failed: %v", err)
+	}
+
+	_ = a.SendOTP("cooldown@example.com")
+
+	err := a.SendOTP("Cooldown@Example.com")
+	var ra *auth.RetryAfterError
+	if !errors.As(err, &ra) || !errors.Is(err, auth.ErrOTPResendCooldown) {
+		t.Fatalf("expected a resend cooldown, got: %v", err)
+	}
+	if ra.RetryAfter <= 0 || ra.RetryAfter > time.Minute {
+		t.Errorf("expected a wait of up to a minute, got %v", ra.RetryAfter)
+	}
+
+	err = a.SendOTPFor("cooldown@example.com", auth.OTPPurposeVerifyEmail)
+	if errors.Is(err, auth.ErrOTPResendCooldown) {
+		t.Errorf("another purpose should not be in cooldown")
+	}
+}
+
+/*
+TestIntegrationOTPDailyQuotas verifies the per-recipient and per-IP caps.
+*/
+func TestIntegrationOTPDailyQuotas(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.NotifierInit(&auth.RecordingNotifier{})
+	if err := a.OTPSendLimitsInit(auth.OTPSendLimits{PerRecipientDaily: 2, PerIPDaily: 3}); err != nil {
+		t.Fatalf("OTPSendLimitsInit failed: %v", err)
+	}
+
+	_ = a.SendOTPFrom("quota@example.com", auth.OTPPurposeLogin, "203.0.113.7")
+	_ = a.SendOTPFrom("quota@example.com", auth.OTPPurposeStepUp, "203.0.113.7")
+	err := a.SendOTPFrom("quota@example.com", auth.OTPPurposeVerifyEmail, "198.51.100.1")
+	if !errors.Is(err, auth.ErrRateLimitExceeded) {
+		t.Errorf("expected the per-recipient cap, got: %v", err)
+	}
+
+	_ = a.SendOTPFrom("other@example.com", auth.OTPPurposeLogin, "203.0.113.7")
+	err = a.SendOTPFrom("third@example.com", auth.OTPPurposeLogin, "203.0.113.7")
+	var ra *auth.RetryAfterError
+	if !errors.As(err, &ra) || !errors.Is(err, auth.ErrRateLimitExceeded) {
+		t.Fatalf("expected the per-IP cap, got: %v", err)
+	}
+	if ra.RetryAfter <= 23*time.Hour {
+		t.Errorf("expected a wait of about a day, got %v", ra.RetryAfter)
+	}
+}
+
+/*
+TestIntegrationOTPFailedSendIsRefunded verifies that a code the mail server
+did not accept does not count against the cooldown or the daily caps.
+*/
+func TestIntegrationOTPFailedSendIsRefunded(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	n := &flakyNotifier{}
+	n.down.Store(true)
+	_ = a.NotifierInit(n)
+	if err := a.OTPSendLimitsInit(auth.OTPSendLimits{ResendInterval: time.Minute, PerRecipientDaily: 1, PerIPDaily: 1}); err != nil {
+		t.Fatalf("OTPSendLimitsInit failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err := a.SendOTPFrom("refund@example.com", auth.OTPPurposeLogin, "203.0.113.9")
+		if err == nil || errors.Is(err, auth.ErrOTPResendCooldown) || errors.Is(err, auth.ErrRateLimitExceeded) {
+			t.Fatalf("expected a delivery error, got: %v", err)
+		}
+	}
+
+	n.down.Store(false)
+	if err := a.SendOTPFrom("refund@example.com", auth.OTPPurposeLogin, "203.0.113.9"); err != nil {
+		t.Fatalf("failed sends should not use up the quota: %v", err)
+	}
+	if err := a.SendOTPFrom("refund@example.com", auth.OTPPurposeLogin, "203.0.113.9"); !errors.Is(err, auth.ErrOTPResendCooldown) {
+		t.Errorf("a delivered code should still be counted, got: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestOTPPurposeInit verifies validation of per-purpose settings.
+*/
+func TestOTPPurposeInit(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.OTPPurposeInit("", auth.OTPPurposeConfig{}); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if err := a.OTPPurposeInit(auth.OTPPurposeStepUp, auth.OTPPurposeConfig{Length: 3}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for short length, got: %v", err)
+	}
+	if err := a.OTPPurposeInit(auth.OTPPurposeStepUp, auth.OTPPurposeConfig{Body: "{{.Code"}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a broken template, got: %v", err)
+	}
+	if err := a.OTPPurposeInit("delete_account", auth.OTPPurposeConfig{
+		Length:  8,
+		Expiry:  2 * time.Minute,
+		Subject: "Confirm account deletion",
+		Body:    "Code {{.Code}} for {{.Email}}, valid {{.Minutes}} minutes.",
+	}); err != nil {
+		t.Errorf("custom purpose should be accepted: %v", err)
+	}
+}
+
+/*
+TestIntegrationOTPPurposeScoping verifies that codes only verify for their own
+purpose and that codes for different purposes coexist.
+*/
+func TestIntegrationOTPPurposeScoping(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	userEmail := "scoped@example.com"
+	expiry := time.Now().Add(5 * time.Minute)
+
+	plantOTP(t, a, userEmail, "111111", expiry)
+	plantPurposeOTP(t, a, userEmail, auth.OTPPurposeResetPassword, "222222", expiry)
+
+	if err := a.VerifyOTPFor(userEmail, auth.OTPPurposeResetPassword, "111111"); !errors.Is(err, auth.ErrInvalidOTP) {
+		t.Errorf("login code must not reset a password, got: %v", err)
+	}
+	if err := a.VerifyOTP(userEmail, "222222"); !errors.Is(err, auth.ErrInvalidOTP) {
+		t.Errorf("reset code must not log in, got: %v", err)
+	}
+	if err := a.VerifyOTPFor(userEmail, auth.OTPPurposeVerifyEmail, "111111"); !errors.Is(err, auth.ErrInvalidOTP) {
+		t.Errorf("expected ErrInvalidOTP for a purpose with no code, got: %v", err)
+	}
+
+	if err := a.VerifyOTPFor(userEmail, auth.OTPPurposeResetPassword, "222222"); err != nil {
+		t.Errorf("reset code should verify for its purpose: %v", err)
+	}
+	if err := a.VerifyOTP(userEmail, "111111"); err != nil {
+		t.Errorf("login code should survive the reset code being used: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/* flakyNotifier fails while down is set and records messages otherwise. */
+type flakyNotifier struct {
+	auth.RecordingNotifier
+	down atomic.Bool
+}
+
+func (f *flakyNotifier) Notify(ctx context.Context, msg auth.Message) error {
+	if f.down.Load() {
+		return errors.New("smtp server unavailable")
+	}
+	return f.RecordingNotifier.Notify(ctx, msg)
+}
+
+/* waitFor polls cond until it holds or five seconds pass. */
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+/* outboxCount returns how many messages have the given status. */
+func outboxCount(t *testing.T, a *auth.Auth, status auth.OutboxStatus) int {
+	t.Helper()
+	msgs, err := a.OutboxMessages(status, 100, 0)
+	if err != nil {
+		t.Fatalf("OutboxMessages failed: %v", err)
+	}
+	return len(msgs)
+}
+
+/*
+TestOutboxValidation verifies the checks that need no database.
+*/
+func TestOutboxValidation(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.OutboxInit(auth.OutboxConfig{MaxAttempts: -1}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got: %v", err)
+	}
+	if err := a.OutboxInit(auth.OutboxConfig{EncryptionKey: []byte("short")}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a short key, got: %v", err)
+	}
+	if err := a.OutboxInit(auth.OutboxConfig{}); !errors.Is(err, auth.ErrDatabaseUnavailable) {
+		t.Errorf("expected ErrDatabaseUnavailable, got: %v", err)
+	}
+	if _, err := a.OutboxMessages("sent", 10, 0); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for unknown status, got: %v", err)
+	}
+	if _, err := a.OutboxMessages(auth.OutboxDead, 0, 0); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for zero limit, got: %v", err)
+	}
+	if _, err := a.RunOutbox(); !errors.Is(err, auth.ErrDatabaseUnavailable) {
+		t.Errorf("expected ErrDatabaseUnavailable, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationOutboxRetriesDelivery verifies that SendOTP succeeds while the
+notifier is down, and that the queued code is delivered once it recovers.
+*/
+func TestIntegrationOutboxRetriesDelivery(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	n := &flakyNotifier{}
+	n.down.Store(true)
+	_ = a.NotifierInit(n)
+	if err := a.OutboxInit(auth.OutboxConfig{PollInterval: time.Hour, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}); err != nil {
+		t.Fatalf("OutboxInit failed: %v", err)
+	}
+
+	if err := a.SendOTP("outbox@example.com"); err != nil {
+		t.Fatalf("SendOTP should queue while the notifier is down: %v", err)
+	}
+	waitFor(t, "a failed attempt", func() bool {
+		msgs, _ := a.OutboxMessages(auth.OutboxPending, 10, 0)
+		return len(msgs) == 1 && msgs[0].Attempts >= 1 && strings.Contains(msgs[0].LastError, "unavailable")
+	})
+
+	n.down.Store(false)
+	waitFor(t, "delivery", func() bool {
+		_, _ = a.RunOutbox()
+		_, ok := n.Last("outbox@example.com")
+		return ok
+	})
+	if c := outboxCount(t, a, auth.OutboxPending); c != 0 {
+		t.Errorf("expected the delivered message to leave the outbox, %d pending", c)
+	}
+
+	msg, _ := n.Last("outbox@example.com")
+	if err := a.VerifyOTP("outbox@example.com", msg.Code); err != nil {
+		t.Errorf("queued code should verify: %v", err)
+	}
+}
+
+/*
+TestIntegrationOutboxDeadLetter verifies that a message is dead lettered
+after MaxAttempts and can be inspected, retried and discarded.
+*/
+func TestIntegrationOutboxDeadLetter(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	n := &flakyNotifier{}
+	n.down.Store(true)
+	_ = a.NotifierInit(n)
+	_ = a.OutboxInit(auth.OutboxConfig{PollInterval: time.Hour, MaxAttempts: 1})
+
+	if err := a.SendOTP("dead@example.com"); err != nil {
+		t.Fatalf("SendOTP failed: %v", err)
+	}
+	waitFor(t, "dead letter", func() bool {
+		_, _ = a.RunOutbox()
+		return outboxCount(t, a, auth.OutboxDead) == 1
+	})
+	dead, _ := a.OutboxMessages(auth.OutboxDead, 10, 0)
+	if dead[0].To != "dead@example.com" || dead[0].Kind != auth.MessageKindOTP || dead[0].LastError == "" {
+		t.Errorf("unexpected dead letter: %+v", dead[0])
+	}
+
+	n.down.Store(false)
+	if err := a.RetryOutboxMessage(dead[0].ID); err != nil {
+		t.Fatalf("RetryOutboxMessage failed: %v", err)
+	}
+	waitFor(t, "delivery after retry", func() bool {
+		_, _ = a.RunOutbox()
+		_, ok := n.Last("dead@example.com")
+		return ok
+	})
+	if err := a.RetryOutboxMessage(dead[0].ID); !errors.Is(err, auth.ErrOutboxMessageNotFound) {
+		t.Errorf("expected ErrOutboxMessageNotFound for a delivered message, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationOutboxExpiredMessage verifies that a message whose code has
+expired is dead lettered without being sent and cannot be retried.
+*/
+func TestIntegrationOutboxExpiredMessage(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	n := &flakyNotifier{}
+	n.down.Store(true)
+	_ = a.NotifierInit(n)
+	_ = a.OutboxInit(auth.OutboxConfig{PollInterval: time.Hour})
+
+	if err := a.SendOTP("late@example.com"); err != nil {
+		t.Fatalf("SendOTP failed: %v", err)
+	}
+	n.down.Store(false)
+	if _, err := a.Conn.Exec(context.Background(),
+		"UPDATE email_outbox SET expires_at = NOW() - INTERVAL '1 minute', next_attempt_at = NOW()"); err != nil {
+		t.Fatalf("failed to expire message: %v", err)
+	}
+	waitFor(t, "expiry", func() bool {
+		_, _ = a.RunOutbox()
+		return outboxCount(t, a, auth.OutboxDead) == 1
+	})
+	if _, ok := n.Last("late@example.com"); ok {
+		t.Error("an expired message must not be delivered")
+	}
+
+	dead, _ := a.OutboxMessages(auth.OutboxDead, 10, 0)
+	if err := a.RetryOutboxMessage(dead[0].ID); !errors.Is(err, auth.ErrOutboxMessageNotFound) {
+		t.Errorf("expected ErrOutboxMessageNotFound, got: %v", err)
+	}
+	if err := a.DiscardOutboxMessage(dead[0].ID); err != nil {
+		t.Errorf("DiscardOutboxMessage failed: %v", err)
+	}
+	if err := a.DiscardOutboxMessage(dead[0].ID); !errors.Is(err, auth.ErrOutboxMessageNotFound) {
+		t.Errorf("expected ErrOutboxMessageNotFound, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationOutboxEncryptsMessages verifies that with an EncryptionKey the
+code is not stored in clear, and that the message still gets delivered.
+*/
+func TestIntegrationOutboxEncryptsMessages(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	n := &flakyNotifier{}
+	n.down.Store(true)
+	_ = a.NotifierInit(n)
+	if err := a.OutboxInit(auth.OutboxConfig{PollInterval: time.Hour, EncryptionKey: testTOTPKey}); err != nil {
+		t.Fatalf("OutboxInit failed: %v", err)
+	}
+
+	if err := a.SendOTP("sealed@example.com"); err != nil {
+		t.Fatalf("SendOTP failed: %v", err)
+	}
+	var stored string
+	_ = a.Conn.QueryRow(context.Background(), "SELECT message::text FROM email_outbox").Scan(&stored)
+	if !strings.Contains(stored, `"sealed"`) || strings.Contains(stored, `"code"`) {
+		t.Errorf("expected an encrypted message, got %s", stored)
+	}
+
+	n.down.Store(false)
+	waitFor(t, "delivery", func() bool {
+		_, _ = a.RunOutbox()
+		_, ok := n.Last("sealed@example.com")
+		return ok
+	})
+	msg, _ := n.Last("sealed@example.com")
+	if err := a.VerifyOTP("sealed@example.com", msg.Code); err != nil {
+		t.Errorf("decrypted code should verify: %v", err)
+	}
+}
+
+/*
+TestIntegrationJanitorWipesExpiredMessages verifies that the janitor drops
+the content of dead letters, and of messages nobody delivered, once their
+code has expired.
+*/
+func TestIntegrationJanitorWipesExpiredMessages(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	n := &flakyNotifier{}
+	n.down.Store(true)
+	_ = a.NotifierInit(n)
+	_ = a.OutboxInit(auth.OutboxConfig{PollInterval: time.Hour, MaxAttempts: 1})
+
+	_ = a.SendOTP("wipe-dead@example.com")
+	waitFor(t, "dead letter", func() bool {
+		_, _ = a.RunOutbox()
+		return outboxCount(t, a, auth.OutboxDead) == 1
+	})
+	/* Queued straight into the table, as if no worker had run */
+	_, err := a.Conn.Exec(context.Background(),
+		"INSERT INTO email_outbox (kind, recipient, message, expires_at) VALUES ('otp', 'wipe-pending@example.com', '{}', NOW() + INTERVAL '1 hour')")
+	if err != nil {
+		t.Fatalf("failed to queue message: %v", err)
+	}
+	_, _ = a.Conn.Exec(context.Background(), "UPDATE email_outbox SET expires_at = NOW() - INTERVAL '1 minute'")
+
+	if _, err := a.RunJanitor(); err != nil {
+		t.Fatalf("RunJanitor failed: %v", err)
+	}
+	var left int
+	_ = a.Conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM email_outbox WHERE message IS NOT NULL").Scan(&left)
+	if left != 0 {
+		t.Errorf("expected every expired message to be wiped, %d left", left)
+	}
+	if c := outboxCount(t, a, auth.OutboxDead); c != 2 {
+		t.Errorf("expected the undelivered message to be dead lettered, %d dead", c)
+	}
+}
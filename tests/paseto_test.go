@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+func newLocalKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+/*
+TestPASETOInitInvalid verifies that malformed PASETO configurations are rejected.
+*/
+func TestPASETOInitInvalid(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	cases := []auth.PASETOConfig{
+		{Format: auth.TokenFormatJWT},
+		{Format: auth.TokenFormatPASETOLocal, LocalKey: []byte("too-short")},
+		{Format: auth.TokenFormatPASETOPublic},
+		{Format: auth.TokenFormatPASETOPublic, PublicKey: ed25519.PublicKey("bad")},
+	}
+	for i, cfg := range cases {
+		if err := a.PASETOInit(cfg); !errors.Is(err, auth.ErrInvalidInput) {
+			t.Errorf("case %d: expected ErrInvalidInput, got: %v", i, err)
+		}
+	}
+}
+
+/*
+TestPASETOLocalRoundTrip verifies that v4.local tokens work through the
+unchanged GenerateToken / ValidateToken / LoginJWT API.
+*/
+func TestPASETOLocalRoundTrip(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.PASETOInit(auth.PASETOConfig{Format: auth.TokenFormatPASETOLocal, LocalKey: newLocalKey(t)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	token, err := a.GenerateToken("paseto@example.com")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	if !strings.HasPrefix(token, "v4.local.") {
+		t.Fatalf("expected a v4.local token, got %q", token)
+	}
+	if strings.Contains(token, "paseto@example.com") {
+		t.Error("v4.local payload should be encrypted")
+	}
+
+	claims, err := a.LoginJWT(token)
+	if err != nil {
+		t.Fatalf("failed to validate token: %v", err)
+	}
+	if claims.UserID != "paseto@example.com" || claims.ID == "" || claims.ExpiresAt == nil {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+}
+
+/*
+TestPASETOPublicRoundTrip verifies v4.public signing, and that a verify-only
+instance can validate but not issue tokens.
+*/
+func TestPASETOPublicRoundTrip(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	issuer := auth.NewBareAuth()
+	_ = issuer.PASETOInit(auth.PASETOConfig{Format: auth.TokenFormatPASETOPublic, PrivateKey: priv})
+
+	token, err := issuer.GenerateToken("signed@example.com")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	if !strings.HasPrefix(token, "v4.public.") {
+		t.Fatalf("expected a v4.public token, got %q", token)
+	}
+
+	verifier := auth.NewBareAuth()
+	_ = verifier.PASETOInit(auth.PASETOConfig{Format: auth.TokenFormatPASETOPublic, PublicKey: pub})
+
+	claims, err := verifier.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("verifier failed to validate token: %v", err)
+	}
+	if claims.UserID != "signed@example.com" {
+		t.Errorf("expected 'signed@example.com', got %q", claims.UserID)
+	}
+
+	if _, err := verifier.GenerateToken("nope"); !errors.Is(err, auth.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized for verify-only instance, got: %v", err)
+	}
+}
+
+/*
+TestPASETORejectsTampering verifies that modified, expired and wrong-key tokens fail.
+*/
+func TestPASETORejectsTampering(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.PASETOInit(auth.PASETOConfig{Format: auth.TokenFormatPASETOLocal, LocalKey: newLocalKey(t)})
+
+	token, _ := a.GenerateToken("tamper@example.com")
+
+	/* Flip a character in the middle of the body */
+	mid := len(token) / 2
+	flipped := byte('A')
+	if token[mid] == 'A' {
+		flipped = 'B'
+	}
+	tampered := token[:mid] + string(flipped) + token[mid+1:]
+	if _, err := a.ValidateToken(tampered); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for tampered token, got: %v", err)
+	}
+
+	expired, _ := a.GenerateToken("tamper@example.com", -time.Hour)
+	if _, err := a.ValidateToken(expired); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for expired token, got: %v", err)
+	}
+
+	other := auth.NewBareAuth()
+	_ = other.PASETOInit(auth.PASETOConfig{Format: auth.TokenFormatPASETOLocal, LocalKey: newLocalKey(t)})
+	if _, err := other.ValidateToken(token); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken with the wrong key, got: %v", err)
+	}
+}
+
+/*
+TestPASETORejectsOtherFormats verifies that a PASETO instance never accepts
+a JWT or a PASETO token of the other purpose.
+*/
+func TestPASETORejectsOtherFormats(t *testing.T) {
+	jwtAuth := auth.NewBareAuth()
+	_ = jwtAuth.JWTInit("some-secret")
+	jwtToken, _ := jwtAuth.GenerateToken("mixed@example.com")
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	public := auth.NewBareAuth()
+	_ = public.PASETOInit(auth.PASETOConfig{Format: auth.TokenFormatPASETOPublic, PrivateKey: priv})
+	publicToken, _ := public.GenerateToken("mixed@example.com")
+
+	local := auth.NewBareAuth()
+	_ = local.PASETOInit(auth.PASETOConfig{Format: auth.TokenFormatPASETOLocal, LocalKey: newLocalKey(t)})
+
+	for _, token := range []string{jwtToken, publicToken} {
+		if _, err := local.ValidateToken(token); !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("expected ErrInvalidToken for foreign token, got: %v", err)
+		}
+	}
+}
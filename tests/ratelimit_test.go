@@ -203,6 +203,32 @@ func TestRateLimiterReset(t *testing.T) {
 	}
 }
 
+/*
+TestRateLimiterRetryAfter checks that RetryAfter is zero while requests are
+left and counts down to the oldest entry leaving the window once full.
+*/
+func TestRateLimiterRetryAfter(t *testing.T) {
+	rl, _ := auth.NewRateLimiter(auth.RateLimiterConfig{
+		MaxRequests: 2,
+		Window:      time.Minute,
+	})
+	defer rl.Stop()
+
+	_ = rl.Allow(context.Background(), "user1")
+	if d, _ := rl.RetryAfter(context.Background(), "user1"); d != 0 {
+		t.Errorf("expected no wait with a request left, got %v", d)
+	}
+
+	_ = rl.Allow(context.Background(), "user1")
+	d, err := rl.RetryAfter(context.Background(), "user1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d <= 55*time.Second || d > time.Minute {
+		t.Errorf("expected a wait of about a minute, got %v", d)
+	}
+}
+
 /*
 TestRateLimiterStop verifies that the stop function can be called multiple times safely.
 */
@@ -367,3 +393,31 @@ func TestRedisRateLimiterExpiry(t *testing.T) {
 		t.Errorf("expected request to be allowed after window expiry, got: %v", err)
 	}
 }
+
+func TestRedisRateLimiterRetryAfter(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if !setupRedis(t, a) {
+		t.Skip("Redis is not available")
+	}
+
+	rl, _ := a.NewRedisRateLimiter(auth.RateLimiterConfig{
+		MaxRequests: 2,
+		Window:      time.Minute,
+	})
+	rl.Reset(context.Background(), "user1")
+
+	_ = rl.Allow(context.Background(), "user1")
+	if d, _ := rl.RetryAfter(context.Background(), "user1"); d != 0 {
+		t.Errorf("expected no wait with a request left, got %v", d)
+	}
+
+	_ = rl.Allow(context.Background(), "user1")
+	d, err := rl.RetryAfter(context.Background(), "user1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d <= 55*time.Second || d > time.Minute {
+		t.Errorf("expected a wait of about a minute, got %v", d)
+	}
+}
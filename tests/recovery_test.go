@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestRecoveryCodesWithoutDatabase verifies input checks on a bare instance.
+*/
+func TestRecoveryCodesWithoutDatabase(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if _, err := a.GenerateRecoveryCodes(""); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if err := a.UseRecoveryCode("user", "abcd-efgh-jkmn"); !errors.Is(err, auth.ErrDatabaseUnavailable) {
+		t.Errorf("expected ErrDatabaseUnavailable, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationRecoveryCodes verifies that codes are single-use, stored hashed,
+and invalidated when a new batch is generated.
+*/
+func TestIntegrationRecoveryCodes(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if err := a.RegisterUser("recovery-user", "password123"); err != nil {
+		t.Fatalf("RegisterUser failed: %v", err)
+	}
+
+	var events []auth.SecurityEvent
+	a.OnSecurityEvent(func(ev auth.SecurityEvent) { events = append(events, ev) })
+
+	codes, err := a.GenerateRecoveryCodes("recovery-user")
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes failed: %v", err)
+	}
+	if len(codes) != auth.RecoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", auth.RecoveryCodeCount, len(codes))
+	}
+
+	var stored string
+	_ = a.Conn.QueryRow(context.Background(),
+		"SELECT code_hash FROM recovery_codes WHERE user_id = $1 LIMIT 1", "recovery-user",
+	).Scan(&stored)
+	for _, c := range codes {
+		if strings.Contains(stored, strings.ReplaceAll(c, "-", "")) {
+			t.Fatal("recovery codes must be stored hashed")
+		}
+	}
+
+	/* Formatting is ignored */
+	if err := a.UseRecoveryCode("recovery-user", strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))); err != nil {
+		t.Errorf("UseRecoveryCode failed: %v", err)
+	}
+	if err := a.UseRecoveryCode("recovery-user", codes[0]); !errors.Is(err, auth.ErrInvalidRecoveryCode) {
+		t.Errorf("expected ErrInvalidRecoveryCode on reuse, got: %v", err)
+	}
+	if n, _ := a.RecoveryCodesRemaining("recovery-user"); n != auth.RecoveryCodeCount-1 {
+		t.Errorf("expected %d codes left, got %d", auth.RecoveryCodeCount-1, n)
+	}
+	if len(events) != 1 || events[0].Type != auth.EventRecoveryCodeUsed {
+		t.Errorf("expected one recovery_code_used event, got %v", events)
+	}
+
+	if _, err := a.GenerateRecoveryCodes("recovery-user"); err != nil {
+		t.Fatalf("regenerating failed: %v", err)
+	}
+	if err := a.UseRecoveryCode("recovery-user", codes[1]); !errors.Is(err, auth.ErrInvalidRecoveryCode) {
+		t.Errorf("old batch must be invalid after regenerating, got: %v", err)
+	}
+	if n, _ := a.RecoveryCodesRemaining("recovery-user"); n != auth.RecoveryCodeCount {
+		t.Errorf("expected a full new batch, got %d", n)
+	}
+}
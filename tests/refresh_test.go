@@ -1,10 +1,16 @@
 package tests
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
 	auth "github.com/GCET-Open-Source-Foundation/auth"
+	"github.com/redis/go-redis/v9"
 )
 
 /*
@@ -119,3 +125,302 @@ func TestRevokeAllUserRefreshTokensWithRedis(t *testing.T) {
 		t.Errorf("expected other user's token to remain valid, got err: %v", err)
 	}
 }
+
+/*
+TestIntegrationRefreshTokenReuseRevokesFamily verifies reuse detection:
+replaying a rotated token revokes its whole family, emits a security event,
+and leaves the user's other sessions alone.
+*/
+func TestIntegrationRefreshTokenReuseRevokesFamily(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("reuse-family-secret")
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+
+	var events []auth.SecurityEvent
+	a.OnSecurityEvent(func(ev auth.SecurityEvent) {
+		events = append(events, ev)
+	})
+
+	userID := "family@example.com"
+	_ = a.RegisterUser(userID, "password")
+
+	pair, err := a.IssueTokenPair(userID)
+	if err != nil {
+		t.Fatalf("failed to issue token pair: %v", err)
+	}
+	other, _ := a.IssueTokenPair(userID)
+	first, otherSession := pair.RefreshToken, other.RefreshToken
+
+	second, _, err := a.RotateRefreshToken(first)
+	if err != nil {
+		t.Fatalf("first rotation failed: %v", err)
+	}
+	third, _, err := a.RotateRefreshToken(second)
+	if err != nil {
+		t.Fatalf("second rotation failed: %v", err)
+	}
+
+	/* An attacker replays the stolen first token */
+	_, _, err = a.RotateRefreshToken(first)
+	if !errors.Is(err, auth.ErrRefreshTokenReused) || !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+		t.Fatalf("expected ErrRefreshTokenReused wrapping ErrRefreshTokenRevoked, got: %v", err)
+	}
+
+	if _, err := a.ValidateRefreshToken(third); !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+		t.Errorf("latest token in the family should be revoked, got: %v", err)
+	}
+	if _, err := a.ValidateRefreshToken(otherSession); err != nil {
+		t.Errorf("other sessions should be unaffected: %v", err)
+	}
+	if _, err := a.ValidateToken(pair.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("access token of the replayed family should be revoked, got: %v", err)
+	}
+	if _, err := a.ValidateToken(other.AccessToken); err != nil {
+		t.Errorf("other sessions' access tokens should be unaffected: %v", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 security event, got %d", len(events))
+	}
+	if events[0].Type != auth.EventRefreshTokenReuse || events[0].UserID != userID || events[0].SessionID == "" {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+}
+
+/*
+TestIntegrationLoggedOutTokenIsNotReuse verifies that presenting a token
+revoked by logout, rather than rotated out, fails without reuse handling.
+*/
+func TestIntegrationLoggedOutTokenIsNotReuse(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+
+	var events []auth.SecurityEvent
+	a.OnSecurityEvent(func(ev auth.SecurityEvent) {
+		events = append(events, ev)
+	})
+
+	token, _ := a.GenerateRefreshToken("logout@example.com")
+	if err := a.RevokeRefreshToken(token); err != nil {
+		t.Fatalf("failed to revoke token: %v", err)
+	}
+
+	_, _, err := a.RotateRefreshToken(token)
+	if !errors.Is(err, auth.ErrRefreshTokenRevoked) || errors.Is(err, auth.ErrRefreshTokenReused) {
+		t.Errorf("expected plain ErrRefreshTokenRevoked, got: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no security event, got %+v", events)
+	}
+}
+
+/*
+TestIntegrationRefreshTokenHashedAtRest verifies that Postgres does not hold
+the raw refresh token, while lookups by the raw value still work.
+*/
+func TestIntegrationRefreshTokenHashedAtRest(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+
+	userID := "hashed@example.com"
+	_ = a.RegisterUser(userID, "password")
+
+	token, err := a.GenerateRefreshToken(userID)
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+
+	var raw int
+	_ = a.Conn.QueryRow(context.Background(),
+		"SELECT COUNT(*) FROM refresh_tokens WHERE token = $1", token,
+	).Scan(&raw)
+	if raw != 0 {
+		t.Error("raw refresh token should not be stored in Postgres")
+	}
+
+	if got, err := a.ValidateRefreshToken(token); err != nil || got != userID {
+		t.Errorf("expected token to validate for %s, got %q, err: %v", userID, got, err)
+	}
+}
+
+/*
+TestIntegrationRefreshRotationConcurrent verifies that parallel rotations of the
+same token mint a single successor: within the grace period every caller gets
+that successor, and the session is not revoked.
+*/
+func TestIntegrationRefreshRotationConcurrent(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour, RotationGracePeriod: 10 * time.Second})
+
+	userID := "parallel@example.com"
+	_ = a.RegisterUser(userID, "password")
+	token, _ := a.GenerateRefreshToken(userID)
+
+	const workers = 5
+	results := make([]string, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, errs[i] = a.RotateRefreshToken(token)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < workers; i++ {
+		if errs[i] != nil {
+			t.Fatalf("rotation %d failed: %v", i, errs[i])
+		}
+		if results[i] != results[0] {
+			t.Errorf("rotation %d returned a different successor", i)
+		}
+	}
+
+	if _, err := a.ValidateRefreshToken(results[0]); err != nil {
+		t.Errorf("successor should be valid: %v", err)
+	}
+	sessions, _ := a.ListUserSessions(userID)
+	if len(sessions) != 1 {
+		t.Errorf("expected exactly one live token in the session, got %d", len(sessions))
+	}
+}
+
+/*
+TestIntegrationRefreshRotationNoGrace verifies that without a grace period the
+loser of a rotation race is treated as reuse.
+*/
+func TestIntegrationRefreshRotationNoGrace(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+	_ = a.RegisterUser("strict@example.com", "password")
+
+	token, _ := a.GenerateRefreshToken("strict@example.com")
+	next, _, err := a.RotateRefreshToken(token)
+	if err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+
+	if _, _, err := a.RotateRefreshToken(token); !errors.Is(err, auth.ErrRefreshTokenReused) {
+		t.Errorf("expected ErrRefreshTokenReused, got: %v", err)
+	}
+	if _, err := a.ValidateRefreshToken(next); !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+		t.Errorf("successor should be revoked with the family, got: %v", err)
+	}
+}
+
+/*
+TestRefreshTokenRevokedNeverValidatesWithRedis verifies that once a cached
+token is revoked by any path (single revoke, revoke-all, session revoke or
+rotation) it never validates again, even after repeated validations.
+*/
+func TestRefreshTokenRevokedNeverValidatesWithRedis(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if !setupRedis(t, a) {
+		t.Skip("Redis is not available")
+	}
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+
+	userID := "cache@example.com"
+	_ = a.RegisterUser(userID, "password")
+
+	/* Validate each token first so it is definitely served from cache */
+	issue := func() string {
+		token, _ := a.GenerateRefreshToken(userID)
+		if _, err := a.ValidateRefreshToken(token); err != nil {
+			t.Fatalf("fresh token should validate: %v", err)
+		}
+		return token
+	}
+
+	single := issue()
+	_ = a.RevokeRefreshToken(single)
+
+	rotated := issue()
+	_, _, _ = a.RotateRefreshToken(rotated)
+
+	session := issue()
+	sessions, _ := a.ListUserSessions(userID)
+	for _, s := range sessions {
+		_ = a.RevokeSession(userID, s.SessionID)
+	}
+
+	all := issue()
+	if err := a.RevokeAllUserRefreshTokens(userID); err != nil {
+		t.Fatalf("revoke all failed: %v", err)
+	}
+
+	for name, token := range map[string]string{"single": single, "rotated": rotated, "session": session, "all": all} {
+		for i := 0; i < 3; i++ {
+			if _, err := a.ValidateRefreshToken(token); !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+				t.Errorf("%s: expected ErrRefreshTokenRevoked on attempt %d, got: %v", name, i, err)
+			}
+		}
+	}
+}
+
+/*
+TestRedisInitPurgesLegacyRefreshCache verifies that cache entries from before
+refresh tokens were hashed are deleted at startup, and current ones are kept.
+*/
+func TestRedisInitPurgesLegacyRefreshCache(t *testing.T) {
+	skipIfShort(t)
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: testRedisHost, Password: testRedisPass})
+	defer rdb.Close()
+	if rdb.Ping(ctx).Err() != nil {
+		t.Skip("Redis is not available")
+	}
+
+	rdb.Del(ctx, "refresh_cache:hashed")
+	rdb.Set(ctx, "refresh:legacy-raw-token", "legacy@example.com", time.Hour)
+	rdb.SAdd(ctx, "user_tokens:legacy@example.com", "legacy-raw-token")
+	rdb.Set(ctx, "refresh:current-digest", "u:current@example.com", time.Hour)
+	rdb.Set(ctx, "refresh:revoked-digest", "revoked", time.Hour)
+
+	a := setupTestAuth(t)
+	if !setupRedis(t, a) {
+		t.Skip("Redis is not available")
+	}
+
+	if n := rdb.Exists(ctx, "refresh:legacy-raw-token", "user_tokens:legacy@example.com").Val(); n != 0 {
+		t.Errorf("expected legacy keys to be deleted, %d left", n)
+	}
+	if n := rdb.Exists(ctx, "refresh:current-digest", "refresh:revoked-digest").Val(); n != 2 {
+		t.Errorf("expected current entries to be kept, %d left", n)
+	}
+	rdb.Del(ctx, "refresh:current-digest", "refresh:revoked-digest")
+}
+
+/*
+TestRefreshTokenLiveCacheIsShortLived verifies that a live refresh token is
+cached for at most a minute, bounding how long a stale entry could outlive a
+revocation that Redis missed.
+*/
+func TestRefreshTokenLiveCacheIsShortLived(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if !setupRedis(t, a) {
+		t.Skip("Redis is not available")
+	}
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+
+	token, err := a.GenerateRefreshToken("cachettl@example.com")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: testRedisHost, Password: testRedisPass})
+	defer rdb.Close()
+	sum := sha256.Sum256([]byte(token))
+	ttl := rdb.TTL(context.Background(), "refresh:"+hex.EncodeToString(sum[:])).Val()
+	if ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected a live cache TTL of at most a minute, got %v", ttl)
+	}
+}
@@ -0,0 +1,217 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+TestGenerateTokenUniqueID verifies that every access token carries a distinct jti.
+*/
+func TestGenerateTokenUniqueID(t *testing.T) {
+	a := auth.NewBareAuth()
+	_ = a.JWTInit("test-secret")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		token, err := a.GenerateToken("testuser")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		claims, err := a.ValidateToken(token)
+		if err != nil {
+			t.Fatalf("unexpected error validating token: %v", err)
+		}
+		if claims.ID == "" {
+			t.Fatal("expected a non-empty jti claim")
+		}
+		if seen[claims.ID] {
+			t.Fatalf("duplicate jti %q", claims.ID)
+		}
+		seen[claims.ID] = true
+	}
+}
+
+/*
+TestRevokeAccessTokenInputs checks input validation without any storage backend.
+*/
+func TestRevokeAccessTokenInputs(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.RevokeAccessToken("", time.Now().Add(time.Hour)); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+
+	/* Already expired tokens need no deny-list entry */
+	if err := a.RevokeAccessToken("some-jti", time.Now().Add(-time.Hour)); err != nil {
+		t.Errorf("expected nil for expired token, got: %v", err)
+	}
+
+	if err := a.RevokeAccessToken("some-jti", time.Now().Add(time.Hour)); !errors.Is(err, auth.ErrDatabaseUnavailable) {
+		t.Errorf("expected ErrDatabaseUnavailable without a backend, got: %v", err)
+	}
+
+	if err := a.RevokeAllUserAccessTokens(""); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationRevokeAccessToken verifies the Postgres-backed deny-list:
+a revoked token fails validation while other tokens stay valid.
+*/
+func TestIntegrationRevokeAccessToken(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("revoke-test-secret")
+
+	token, _ := a.GenerateToken("revoke@example.com")
+	other, _ := a.GenerateToken("revoke@example.com")
+
+	claims, err := a.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("token should be valid before revocation: %v", err)
+	}
+
+	if err := a.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		t.Fatalf("failed to revoke token: %v", err)
+	}
+
+	_, err = a.ValidateToken(token)
+	if !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked, got: %v", err)
+	}
+
+	if _, err := a.ValidateToken(other); err != nil {
+		t.Errorf("other token should remain valid: %v", err)
+	}
+}
+
+/*
+TestIntegrationRevokeAllUserAccessTokens verifies the per-user watermark:
+tokens issued before it are rejected, tokens issued after it are accepted.
+*/
+func TestIntegrationRevokeAllUserAccessTokens(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("watermark-test-secret")
+
+	oldToken, _ := a.GenerateToken("mark@example.com")
+	otherUser, _ := a.GenerateToken("bystander@example.com")
+
+	/* iat has one-second precision, make sure the watermark is strictly later */
+	time.Sleep(1100 * time.Millisecond)
+
+	if err := a.RevokeAllUserAccessTokens("mark@example.com"); err != nil {
+		t.Fatalf("failed to set watermark: %v", err)
+	}
+
+	_, err := a.ValidateToken(oldToken)
+	if !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked for old token, got: %v", err)
+	}
+
+	if _, err := a.ValidateToken(otherUser); err != nil {
+		t.Errorf("other user's token should remain valid: %v", err)
+	}
+
+	/* Tokens from the watermark's own second are rejected too */
+	time.Sleep(1100 * time.Millisecond)
+	newToken, _ := a.GenerateToken("mark@example.com")
+	if _, err := a.ValidateToken(newToken); err != nil {
+		t.Errorf("token issued after the watermark should be valid: %v", err)
+	}
+}
+
+/*
+TestIntegrationRevokeAllSameSecond verifies that a token issued in the same
+second as RevokeAllUserAccessTokens does not survive it.
+*/
+func TestIntegrationRevokeAllSameSecond(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("same-second-secret")
+
+	token, _ := a.GenerateToken("samesecond@example.com")
+	if err := a.RevokeAllUserAccessTokens("samesecond@example.com"); err != nil {
+		t.Fatalf("failed to set watermark: %v", err)
+	}
+	if _, err := a.ValidateToken(token); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked for a token from the same second, got: %v", err)
+	}
+}
+
+/*
+TestRevokeAccessTokenWithRedis verifies that the deny-list and watermark
+work through the Redis path.
+*/
+func TestRevokeAccessTokenWithRedis(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if !setupRedis(t, a) {
+		t.Skip("Redis is not available")
+	}
+	_ = a.JWTInit("redis-revoke-secret")
+
+	token, _ := a.GenerateToken("redisrevoke@example.com")
+	claims, err := a.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("token should be valid before revocation: %v", err)
+	}
+
+	if err := a.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		t.Fatalf("failed to revoke token: %v", err)
+	}
+	if _, err := a.ValidateToken(token); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked, got: %v", err)
+	}
+
+	second, _ := a.GenerateToken("redisrevoke@example.com")
+	time.Sleep(1100 * time.Millisecond)
+
+	if err := a.RevokeAllUserAccessTokens("redisrevoke@example.com"); err != nil {
+		t.Fatalf("failed to set watermark: %v", err)
+	}
+	if _, err := a.ValidateToken(second); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked after watermark, got: %v", err)
+	}
+}
+
+/*
+TestRevokeAccessTokenSurvivesRedisFlush verifies that Postgres keeps the
+deny-list and watermark when the Redis cache loses them.
+*/
+func TestRevokeAccessTokenSurvivesRedisFlush(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if !setupRedis(t, a) {
+		t.Skip("Redis is not available")
+	}
+	_ = a.JWTInit("redis-flush-secret")
+
+	token, _ := a.GenerateToken("flush@example.com")
+	claims, _ := a.ValidateToken(token)
+	other, _ := a.GenerateToken("flushall@example.com")
+	if err := a.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		t.Fatalf("failed to revoke token: %v", err)
+	}
+	if err := a.RevokeAllUserAccessTokens("flushall@example.com"); err != nil {
+		t.Fatalf("failed to set watermark: %v", err)
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: testRedisHost, Password: testRedisPass})
+	defer rdb.Close()
+	rdb.Del(context.Background(), "revoked_jti:"+claims.ID, "token_watermark:flushall@example.com")
+
+	if _, err := a.ValidateToken(token); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("revoked token came back after a cache flush: %v", err)
+	}
+	if _, err := a.ValidateToken(other); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("watermarked token came back after a cache flush: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestIntegrationListUserSessions verifies that device metadata is recorded and
+survives rotation, and that each session is listed once.
+*/
+func TestIntegrationListUserSessions(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+
+	userID := "sessions@example.com"
+	_ = a.RegisterUser(userID, "password")
+
+	laptop, err := a.GenerateRefreshToken(userID, auth.SessionInfo{
+		DeviceName: "Laptop",
+		UserAgent:  "Mozilla/5.0",
+		IPAddress:  "203.0.113.7",
+	})
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	_, _ = a.GenerateRefreshToken(userID, auth.SessionInfo{DeviceName: "Phone"})
+
+	if _, _, err := a.RotateRefreshToken(laptop); err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+
+	sessions, err := a.ListUserSessions(userID)
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+
+	var found bool
+	for _, s := range sessions {
+		if s.DeviceName != "Laptop" {
+			continue
+		}
+		found = true
+		if s.UserAgent != "Mozilla/5.0" || s.IPAddress != "203.0.113.7" {
+			t.Errorf("device metadata lost on rotation: %+v", s)
+		}
+		if s.SessionID == "" || s.LastUsedAt.IsZero() || s.LastUsedAt.Before(s.CreatedAt) {
+			t.Errorf("unexpected session fields: %+v", s)
+		}
+	}
+	if !found {
+		t.Error("expected the Laptop session to be listed")
+	}
+}
+
+/*
+TestIntegrationRevokeSession verifies per-device logout, and that a user
+cannot revoke someone else's session.
+*/
+func TestIntegrationRevokeSession(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+	_ = a.RegisterUser("alice@example.com", "password")
+	_ = a.RegisterUser("mallory@example.com", "password")
+
+	keep, _ := a.GenerateRefreshToken("alice@example.com", auth.SessionInfo{DeviceName: "Desktop"})
+	drop, _ := a.GenerateRefreshToken("alice@example.com", auth.SessionInfo{DeviceName: "Tablet"})
+
+	sessions, _ := a.ListUserSessions("alice@example.com")
+	var target string
+	for _, s := range sessions {
+		if s.DeviceName == "Tablet" {
+			target = s.SessionID
+		}
+	}
+	if target == "" {
+		t.Fatal("expected the Tablet session to be listed")
+	}
+
+	if err := a.RevokeSession("mallory@example.com", target); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound for another user's session, got: %v", err)
+	}
+
+	if err := a.RevokeSession("alice@example.com", target); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+	if _, err := a.ValidateRefreshToken(drop); !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+		t.Errorf("expected revoked session's token to fail, got: %v", err)
+	}
+	if _, err := a.ValidateRefreshToken(keep); err != nil {
+		t.Errorf("other session should remain valid: %v", err)
+	}
+
+	if err := a.RevokeSession("alice@example.com", target); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound for an already revoked session, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationRevokeSessionDeniesAccessTokens verifies that logging a device
+out also refuses the access tokens carrying its sid.
+*/
+func TestIntegrationRevokeSessionDeniesAccessTokens(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("revoke-session-secret")
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 1 * time.Hour})
+	_ = a.RegisterUser("alice@example.com", "password")
+
+	drop, err := a.IssueTokenPair("alice@example.com")
+	if err != nil {
+		t.Fatalf("failed to issue token pair: %v", err)
+	}
+	keep, _ := a.IssueTokenPair("alice@example.com")
+	claims, err := a.ValidateToken(drop.AccessToken)
+	if err != nil || claims.SessionID == "" {
+		t.Fatalf("expected an access token with a sid, got %+v (%v)", claims, err)
+	}
+
+	if err := a.RevokeSession("alice@example.com", claims.SessionID); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+	if _, err := a.ValidateToken(drop.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected the session's access token to be revoked, got: %v", err)
+	}
+	if _, err := a.ValidateToken(keep.AccessToken); err != nil {
+		t.Errorf("other session's access token should remain valid: %v", err)
+	}
+}
+
+/*
+TestSessionsRequireDatabase verifies input and database checks without Postgres.
+*/
+func TestSessionsRequireDatabase(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if _, err := a.ListUserSessions(""); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if err := a.RevokeSession("user@example.com", ""); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if _, err := a.ListUserSessions("user@example.com"); !errors.Is(err, auth.ErrDatabaseUnavailable) {
+		t.Errorf("expected ErrDatabaseUnavailable, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationSessionSlidingExpiry verifies that rotation slides the idle
+window forward but never past MaxSessionAge, and that a session past its
+maximum age cannot be refreshed.
+*/
+func TestIntegrationSessionSlidingExpiry(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{
+		IdleTimeout:   1 * time.Hour,
+		MaxSessionAge: 30 * time.Minute,
+	})
+
+	userID := "sliding@example.com"
+	_ = a.RegisterUser(userID, "password")
+
+	start := time.Now()
+	token, _ := a.GenerateRefreshToken(userID)
+	rotated, _, err := a.RotateRefreshToken(token)
+	if err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+
+	sessions, _ := a.ListUserSessions(userID)
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].ExpiresAt.After(start.Add(30*time.Minute + time.Second)) {
+		t.Errorf("expiry %v should be capped by MaxSessionAge", sessions[0].ExpiresAt)
+	}
+
+	/* Shrink the cap below the session's age */
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{IdleTimeout: 1 * time.Hour, MaxSessionAge: time.Millisecond})
+	time.Sleep(10 * time.Millisecond)
+
+	if _, _, err := a.RotateRefreshToken(rotated); !errors.Is(err, auth.ErrRefreshTokenExpired) {
+		t.Errorf("expected ErrRefreshTokenExpired past MaxSessionAge, got: %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+	"github.com/GCET-Open-Source-Foundation/auth/email"
+)
+
+/*
+fakeSMTP is a minimal SMTP server for exercising the email client.
+It advertises the given extensions, answers AUTH LOGIN, and records the
+credentials and message it receives.
+*/
+type fakeSMTP struct {
+	ln         net.Listener
+	extensions []string
+	tlsConfig  *tls.Config
+	hang       bool
+
+	mu       sync.Mutex
+	username string
+	password string
+	data     string
+	upgraded bool
+}
+
+func startFakeSMTP(t *testing.T, f *fakeSMTP) (host, port string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	f.ln = ln
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	host, port, _ = net.SplitHostPort(ln.Addr().String())
+	return host, port
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	if f.hang {
+		/* Accept the connection and never greet */
+		_, _ = conn.Read(make([]byte, 1))
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			exts := f.extensions
+			f.mu.Lock()
+			if f.upgraded {
+				exts = nil
+				for _, e := range f.extensions {
+					if e != "STARTTLS" {
+						exts = append(exts, e)
+					}
+				}
+			}
+			f.mu.Unlock()
+			/* The first line is the greeting, the rest are extensions */
+			lines := append([]string{"fake"}, exts...)
+			for i, l := range lines {
+				if i == len(lines)-1 {
+					reply("250 " + l)
+				} else {
+					reply("250-" + l)
+				}
+			}
+		case cmd == "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.upgraded = true
+			f.mu.Unlock()
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+		case cmd == "AUTH LOGIN":
+			reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+			user, _ := readLine()
+			reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+			pass, _ := readLine()
+			f.mu.Lock()
+			f.username, f.password = decode(user), decode(pass)
+			f.mu.Unlock()
+			reply("235 ok")
+		case strings.HasPrefix(cmd, "MAIL FROM"), strings.HasPrefix(cmd, "RCPT TO"):
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var b strings.Builder
+			for {
+				l, ok := readLine()
+				if !ok || l == "." {
+					break
+				}
+				/* Undo dot-stuffing and keep CRLF, so the data is the message as sent */
+				l = strings.TrimPrefix(l, ".")
+				b.WriteString(l + "\r\n")
+			}
+			f.mu.Lock()
+			f.data = b.String()
+			f.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+/* selfSignedTLS returns a server config for 127.0.0.1 and a pool trusting it. */
+func selfSignedTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+/*
+TestEmailClientConfigValidation verifies that NewClient rejects a missing
+host or port and unknown modes.
+*/
+func TestEmailClientConfigValidation(t *testing.T) {
+	bad := []email.Config{
+		{Port: "25"},
+		{Host: "127.0.0.1"},
+		{Host: "127.0.0.1", Port: "25", TLS: email.TLSMode(42)},
+		{Host: "127.0.0.1", Port: "25", Auth: email.AuthMechanism(42)},
+	}
+	for i, cfg := range bad {
+		if _, err := email.NewClient(cfg); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+	if _, err := email.NewClient(email.Config{Host: "127.0.0.1", Port: "25"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+/*
+TestEmailClientLoginAuth verifies that a send over a plain connection to
+localhost authenticates with LOGIN and delivers the message.
+*/
+func TestEmailClientLoginAuth(t *testing.T) {
+	srv := &fakeSMTP{extensions: []string{"AUTH LOGIN"}}
+	host, port := startFakeSMTP(t, srv)
+
+	client, err := email.NewClient(email.Config{
+		Host: host, Port: port, Username: "noreply@auth.test", Password: "secret",
+		TLS: email.NoTLS, Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if err := client.SendMail(context.Background(), "noreply@auth.test", "user@example.com", "Hello", "Body text"); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.username != "noreply@auth.test" || srv.password != "secret" {
+		t.Errorf("server got credentials %q/%q", srv.username, srv.password)
+	}
+	if !strings.Contains(srv.data, "Subject: Hello") || !strings.Contains(srv.data, "Body text") {
+		t.Errorf("unexpected message data: %q", srv.data)
+	}
+}
+
+/*
+TestEmailClientSTARTTLSRequired verifies that STARTTLSRequired refuses a
+server without STARTTLS, while the opportunistic mode carries on.
+*/
+func TestEmailClientSTARTTLSRequired(t *testing.T) {
+	srv := &fakeSMTP{}
+	host, port := startFakeSMTP(t, srv)
+
+	client, _ := email.NewClient(email.Config{Host: host, Port: port, TLS: email.STARTTLSRequired})
+	err := client.SendMail(context.Background(), "noreply@auth.test", "user@example.com", "s", "b")
+	if !errors.Is(err, email.ErrSTARTTLSUnavailable) {
+		t.Errorf("expected ErrSTARTTLSUnavailable, got: %v", err)
+	}
+
+	client, _ = email.NewClient(email.Config{Host: host, Port: port})
+	if err := client.SendMail(context.Background(), "noreply@auth.test", "user@example.com", "s", "b"); err != nil {
+		t.Errorf("opportunistic send failed: %v", err)
+	}
+}
+
+/*
+TestEmailClientSTARTTLSCustomCA verifies the STARTTLS upgrade against a
+server whose certificate is only trusted through RootCAs.
+*/
+func TestEmailClientSTARTTLSCustomCA(t *testing.T) {
+	tlsCfg, pool := selfSignedTLS(t)
+	srv := &fakeSMTP{extensions: []string{"STARTTLS"}, tlsConfig: tlsCfg}
+	host, port := startFakeSMTP(t, srv)
+
+	client, _ := email.NewClient(email.Config{Host: host, Port: port, TLS: email.STARTTLSRequired, RootCAs: pool})
+	if err := client.SendMail(context.Background(), "noreply@auth.test", "user@example.com", "s", "b"); err != nil {
+		t.Fatalf("send with custom CA failed: %v", err)
+	}
+	srv.mu.Lock()
+	upgraded := srv.upgraded
+	srv.mu.Unlock()
+	if !upgraded {
+		t.Error("expected the connection to be upgraded")
+	}
+
+	/* Without the pool the self-signed certificate must be rejected */
+	client, _ = email.NewClient(email.Config{Host: host, Port: port, TLS: email.STARTTLSRequired})
+	if err := client.SendMail(context.Background(), "noreply@auth.test", "user@example.com", "s", "b"); err == nil {
+		t.Error("expected an untrusted certificate to be rejected")
+	}
+}
+
+/*
+TestEmailClientImplicitTLS verifies sending to a server that speaks TLS
+from the start, as on port 465.
+*/
+func TestEmailClientImplicitTLS(t *testing.T) {
+	tlsCfg, pool := selfSignedTLS(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsCfg)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &fakeSMTP{ln: ln, extensions: []string{"AUTH LOGIN"}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	client, _ := email.NewClient(email.Config{
+		Host: host, Port: port, Username: "noreply@auth.test", Password: "secret",
+		TLS: email.ImplicitTLS, RootCAs: pool,
+	})
+	if err := client.SendMail(context.Background(), "noreply@auth.test", "user@example.com", "s", "b"); err != nil {
+		t.Fatalf("implicit TLS send failed: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.username != "noreply@auth.test" {
+		t.Errorf("expected authentication over TLS, got username %q", srv.username)
+	}
+}
+
+/*
+TestEmailClientTimeout verifies that a server which never answers cannot
+block a send past the configured timeout.
+*/
+func TestEmailClientTimeout(t *testing.T) {
+	host, port := startFakeSMTP(t, &fakeSMTP{hang: true})
+
+	client, _ := email.NewClient(email.Config{Host: host, Port: port, Timeout: 200 * time.Millisecond})
+	start := time.Now()
+	err := client.SendMail(context.Background(), "noreply@auth.test", "user@example.com", "s", "b")
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("send took %v, timeout not enforced", elapsed)
+	}
+}
+
+/*
+TestEmailClientContextCancel verifies that cancelling the context aborts a
+send that is waiting on the server.
+*/
+func TestEmailClientContextCancel(t *testing.T) {
+	host, port := startFakeSMTP(t, &fakeSMTP{hang: true})
+
+	client, _ := email.NewClient(email.Config{Host: host, Port: port, Timeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := client.SendMail(ctx, "noreply@auth.test", "user@example.com", "s", "b")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("send took %v after cancellation", elapsed)
+	}
+}
+
+/*
+TestSMTPClientInit verifies the configuration checks and that the
+configured client is what delivers messages.
+*/
+func TestSMTPClientInit(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.SMTPClientInit("", email.Config{Host: "127.0.0.1", Port: "25"}); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if err := a.SMTPClientInit("not-an-email", email.Config{Host: "127.0.0.1", Port: "25"}); !errors.Is(err, auth.ErrInvalidEmail) {
+		t.Errorf("expected ErrInvalidEmail, got: %v", err)
+	}
+	if err := a.SMTPClientInit("noreply@auth.test", email.Config{}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got: %v", err)
+	}
+
+	srv := &fakeSMTP{}
+	host, port := startFakeSMTP(t, srv)
+	client, _ := email.NewClient(email.Config{Host: host, Port: port, TLS: email.NoTLS})
+	n := &auth.SMTPNotifier{From: "noreply@auth.test", Client: client}
+	err := n.Notify(context.Background(), auth.Message{Kind: auth.MessageKindOTP, To: "user@example.com", Subject: "Code", Body: "123456"})
+	if err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !strings.Contains(srv.data, "123456") {
+		t.Errorf("message not delivered through the client: %q", srv.data)
+	}
+}
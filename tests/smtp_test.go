@@ -93,11 +93,9 @@ func TestSMTPMockOTPDelivery(t *testing.T) {
 		t.Fatalf("unexpected SendOTP failure: %v", err)
 	}
 
-	var otp string
-	err = a.Conn.QueryRow(context.Background(), "SELECT code FROM otps WHERE email = $1", userEmail).Scan(&otp)
-	if err != nil {
-		t.Fatalf("failed to retrieve generated OTP: %v", err)
-	}
+	/* Only the hash of the sent code is stored, so replace it with a known one */
+	otp := "482916"
+	plantOTP(t, a, userEmail, otp, time.Now().Add(5*time.Minute))
 
 	sender := "noreply@auth.test"
 	subject := "Your Verification Code"
@@ -274,11 +272,9 @@ func TestSMTPMockFullOTPFlow(t *testing.T) {
 		t.Fatalf("unexpected error from SendOTP: %v", err)
 	}
 
-	var otp string
-	err = a.Conn.QueryRow(context.Background(), "SELECT code FROM otps WHERE email = $1", userEmail).Scan(&otp)
-	if err != nil {
-		t.Fatalf("failed to fetch generated OTP: %v", err)
-	}
+	/* Only the hash of the sent code is stored, so replace it with a known one */
+	otp := "482916"
+	plantOTP(t, a, userEmail, otp, time.Now().Add(5*time.Minute))
 
 	body := fmt.Sprintf("Your OTP is: %s\n\nValid for 5 minutes.", otp)
 	inputPath := writeInputFile(t, "noreply@auth.test", "Your Verification Code", body)
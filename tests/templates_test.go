@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+	"github.com/GCET-Open-Source-Foundation/auth/email"
+)
+
+/* localizedTemplates returns English and Portuguese OTP templates. */
+func localizedTemplates() fstest.MapFS {
+	return fstest.MapFS{
+		"en/otp.subject.txt": {Data: []byte("Your code")},
+		"en/otp.txt":         {Data: []byte("Code: {{.Code}}")},
+		"en/otp.html":        {Data: []byte("<p>Code: <b>{{.Code}}</b></p>")},
+		"pt/otp.subject.txt": {Data: []byte("Seu código")},
+		"pt/otp.txt":         {Data: []byte("Código: {{.Code}}")},
+		"pt/otp.html":        {Data: []byte("<p>Código: <b>{{.Code}}</b> para {{.Email}}</p>")},
+		"README.md":          {Data: []byte("ignored")},
+	}
+}
+
+/*
+TestEmailTemplatesInitValidation verifies that broken or incomplete template
+sets are rejected when they are loaded.
+*/
+func TestEmailTemplatesInitValidation(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.EmailTemplatesInit(auth.EmailTemplatesConfig{}); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+
+	cases := map[string]auth.EmailTemplatesConfig{
+		"missing subject": {FS: fstest.MapFS{"en/otp.txt": {Data: []byte("{{.Code}}")}}},
+		"html only":       {FS: fstest.MapFS{"en/otp.html": {Data: []byte("<p>{{.Code}}</p>")}}},
+		"bad syntax": {FS: fstest.MapFS{
+			"en/otp.subject.txt": {Data: []byte("Code")},
+			"en/otp.txt":         {Data: []byte("{{.Code")},
+		}},
+		"bad default locale": {FS: localizedTemplates(), DefaultLocale: "not a locale"},
+	}
+	for name, cfg := range cases {
+		if err := a.EmailTemplatesInit(cfg); !errors.Is(err, auth.ErrInvalidInput) {
+			t.Errorf("%s: expected ErrInvalidInput, got: %v", name, err)
+		}
+	}
+
+	if err := a.EmailTemplatesInit(auth.EmailTemplatesConfig{FS: localizedTemplates()}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+/*
+TestSetUserLocaleValidation verifies input checks that need no database.
+*/
+func TestSetUserLocaleValidation(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.SetUserLocale("", "de"); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if err := a.SetUserLocale("user@example.com", "de_DE!"); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got: %v", err)
+	}
+	if err := a.SetUserLocale("user@example.com", "pt-BR"); !errors.Is(err, auth.ErrDatabaseUnavailable) {
+		t.Errorf("expected ErrDatabaseUnavailable, got: %v", err)
+	}
+}
+
+/*
+TestSMTPNotifierMultipart verifies that a message with an HTML body is sent
+as multipart/alternative with both parts.
+*/
+func TestSMTPNotifierMultipart(t *testing.T) {
+	srv := &fakeSMTP{}
+	host, port := startFakeSMTP(t, srv)
+	client, _ := email.NewClient(email.Config{Host: host, Port: port, TLS: email.NoTLS})
+	n := &auth.SMTPNotifier{From: "noreply@auth.test", Client: client}
+
+	err := n.Notify(context.Background(), auth.Message{
+		Kind: auth.MessageKindOTP, To: "user@example.com", Subject: "Code",
+		Body: "Code: 123456", HTML: "<p>Code: <b>123456</b></p>",
+	})
+	if err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, want := range []string{
+		"Content-Type: multipart/alternative; boundary=",
+		"Content-Type: text/plain; charset=\"UTF-8\"",
+		"Content-Type: text/html; charset=\"UTF-8\"",
+		"Code: 123456",
+		"<p>Code: <b>123456</b></p>",
+	} {
+		if !strings.Contains(srv.data, want) {
+			t.Errorf("message is missing %q:\n%s", want, srv.data)
+		}
+	}
+}
+
+/*
+TestIntegrationLocalizedOTP verifies that the template set is chosen from
+the user's preferred language, falling back from region to base language
+and then to the default locale.
+*/
+func TestIntegrationLocalizedOTP(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	rec := &auth.RecordingNotifier{}
+	_ = a.NotifierInit(rec)
+	if err := a.EmailTemplatesInit(auth.EmailTemplatesConfig{FS: localizedTemplates()}); err != nil {
+		t.Fatalf("EmailTemplatesInit failed: %v", err)
+	}
+
+	if err := a.RegisterUser("maria@example.com", "password123"); err != nil {
+		t.Fatalf("RegisterUser failed: %v", err)
+	}
+	if err := a.SetUserLocale("maria@example.com", "pt-BR"); err != nil {
+		t.Fatalf("SetUserLocale failed: %v", err)
+	}
+	if err := a.SetUserLocale("nobody@example.com", "de"); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got: %v", err)
+	}
+
+	if err := a.SendOTP("maria@example.com"); err != nil {
+		t.Fatalf("SendOTP failed: %v", err)
+	}
+	msg, _ := rec.Last("maria@example.com")
+	if msg.Subject != "Seu código" || msg.Locale != "pt-BR" {
+		t.Errorf("expected the Portuguese template, got subject %q locale %q", msg.Subject, msg.Locale)
+	}
+	if msg.Body != "Código: "+msg.Code {
+		t.Errorf("unexpected text body %q", msg.Body)
+	}
+	if !strings.Contains(msg.HTML, "<b>"+msg.Code+"</b>") || !strings.Contains(msg.HTML, "maria@example.com") {
+		t.Errorf("unexpected HTML body %q", msg.HTML)
+	}
+
+	/* No account, so no preference: the default locale */
+	if err := a.SendOTP("guest@example.com"); err != nil {
+		t.Fatalf("SendOTP failed: %v", err)
+	}
+	msg, _ = rec.Last("guest@example.com")
+	if msg.Subject != "Your code" {
+		t.Errorf("expected the English template, got subject %q", msg.Subject)
+	}
+}
+
+/*
+TestIntegrationOTPTemplatePrecedence verifies that purpose settings from
+OTPPurposeInit win over the generic localized template, and that without
+any templates the built-in email has an HTML part.
+*/
+func TestIntegrationOTPTemplatePrecedence(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	rec := &auth.RecordingNotifier{}
+	_ = a.NotifierInit(rec)
+
+	if err := a.SendOTP("plain@example.com"); err != nil {
+		t.Fatalf("SendOTP failed: %v", err)
+	}
+	msg, _ := rec.Last("plain@example.com")
+	if msg.Subject != "Your Verification Code" || !strings.Contains(msg.HTML, msg.Code) {
+		t.Errorf("expected the built-in template with HTML, got %+v", msg)
+	}
+
+	_ = a.EmailTemplatesInit(auth.EmailTemplatesConfig{FS: localizedTemplates()})
+	_ = a.OTPPurposeInit(auth.OTPPurposeResetPassword, auth.OTPPurposeConfig{Subject: "Reset your password"})
+	if err := a.SendOTPFor("plain@example.com", auth.OTPPurposeResetPassword); err != nil {
+		t.Fatalf("SendOTPFor failed: %v", err)
+	}
+	msg, _ = rec.Last("plain@example.com")
+	if msg.Subject != "Reset your password" {
+		t.Errorf("expected the purpose subject, got %q", msg.Subject)
+	}
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+/*
+TestTokenPairJSONShape verifies that TokenPair encodes with the RFC 6749 field names.
+*/
+func TestTokenPairJSONShape(t *testing.T) {
+	pair := auth.TokenPair{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		ExpiresIn:    3600,
+		TokenType:    "Bearer",
+	}
+
+	raw, err := json.Marshal(pair)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var fields map[string]interface{}
+	_ = json.Unmarshal(raw, &fields)
+	for _, key := range []string{"access_token", "refresh_token", "expires_in", "token_type"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("expected field %q in %s", key, raw)
+		}
+	}
+}
+
+/*
+TestIssueTokenPairInputs checks the guards that run before any database access.
+*/
+func TestIssueTokenPairInputs(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if _, err := a.IssueTokenPair(""); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if _, err := a.IssueTokenPair("user"); !errors.Is(err, auth.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized without JWTInit, got: %v", err)
+	}
+	if _, err := a.RefreshTokenPair(""); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput, got: %v", err)
+	}
+	if _, err := a.RefreshTokenPair("token"); !errors.Is(err, auth.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized without JWTInit, got: %v", err)
+	}
+}
+
+/*
+TestIntegrationTokenPairFlow tests issue -> validate -> refresh and checks
+that the session ID survives rotation.
+*/
+func TestIntegrationTokenPairFlow(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	_ = a.JWTInit("token-pair-secret", 15*time.Minute)
+	_ = a.RefreshTokenInit(auth.RefreshTokenConfig{Expiry: 24 * time.Hour})
+	_ = a.RegisterUser("pair@example.com", "password")
+
+	pair, err := a.IssueTokenPair("pair@example.com")
+	if err != nil {
+		t.Fatalf("failed to issue token pair: %v", err)
+	}
+	if pair.TokenType != "Bearer" {
+		t.Errorf("expected token_type Bearer, got %q", pair.TokenType)
+	}
+	if pair.ExpiresIn != 900 {
+		t.Errorf("expected expires_in 900, got %d", pair.ExpiresIn)
+	}
+
+	claims, err := a.ValidateToken(pair.AccessToken)
+	if err != nil {
+		t.Fatalf("access token should be valid: %v", err)
+	}
+	if claims.SessionID == "" {
+		t.Fatal("expected access token to carry a session ID")
+	}
+
+	next, err := a.RefreshTokenPair(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed to refresh token pair: %v", err)
+	}
+	if next.RefreshToken == pair.RefreshToken {
+		t.Error("expected a rotated refresh token")
+	}
+
+	nextClaims, err := a.ValidateToken(next.AccessToken)
+	if err != nil {
+		t.Fatalf("new access token should be valid: %v", err)
+	}
+	if nextClaims.SessionID != claims.SessionID {
+		t.Errorf("expected session %q to survive rotation, got %q", claims.SessionID, nextClaims.SessionID)
+	}
+
+	_, err = a.RefreshTokenPair(pair.RefreshToken)
+	if !errors.Is(err, auth.ErrRefreshTokenRevoked) {
+		t.Errorf("expected ErrRefreshTokenRevoked for the old refresh token, got: %v", err)
+	}
+
+	other, _ := a.IssueTokenPair("pair@example.com")
+	otherClaims, _ := a.ValidateToken(other.AccessToken)
+	if otherClaims.SessionID == claims.SessionID {
+		t.Error("separate logins should get separate sessions")
+	}
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/GCET-Open-Source-Foundation/auth"
+)
+
+var testTOTPKey = bytes.Repeat([]byte{0x42}, 32)
+
+/*
+TestTOTPInit verifies validation of the TOTP settings.
+*/
+func TestTOTPInit(t *testing.T) {
+	a := auth.NewBareAuth()
+
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: []byte("short"), Issuer: "Acme"}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a short key, got: %v", err)
+	}
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey}); !errors.Is(err, auth.ErrEmptyInput) {
+		t.Errorf("expected ErrEmptyInput without an issuer, got: %v", err)
+	}
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme", Digits: 7}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for 7 digits, got: %v", err)
+	}
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme", Period: 1500 * time.Millisecond}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a fractional period, got: %v", err)
+	}
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme", MaxAttempts: -1}); !errors.Is(err, auth.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for negative attempts, got: %v", err)
+	}
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme"}); err != nil {
+		t.Errorf("valid config should be accepted: %v", err)
+	}
+}
+
+/*
+TestTOTPCodeRFC6238Vectors checks code generation against the SHA-1 test
+vectors in RFC 6238 Appendix B.
+*/
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	a := auth.NewBareAuth()
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme", Digits: 8}); err != nil {
+		t.Fatalf("TOTPInit failed: %v", err)
+	}
+
+	/* base32 of the ASCII seed "12345678901234567890" */
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range vectors {
+		got, err := a.TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("TOTPCode failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("at %d: expected %s, got %s", unix, want, got)
+		}
+	}
+}
+
+/*
+TestIntegrationTOTPEnrollment walks through enrolling, confirming, verifying
+and disabling an authenticator app.
+*/
+func TestIntegrationTOTPEnrollment(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	if err := a.TOTPInit(auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme"}); err != nil {
+		t.Fatalf("TOTPInit failed: %v", err)
+	}
+	if err := a.RegisterUser("totp-user", "password123"); err != nil {
+		t.Fatalf("RegisterUser failed: %v", err)
+	}
+
+	enr, err := a.EnrollTOTP("totp-user")
+	if err != nil {
+		t.Fatalf("EnrollTOTP failed: %v", err)
+	}
+	if !strings.HasPrefix(enr.URI, "otpauth://totp/Acme:totp-user?") || !strings.Contains(enr.URI, "secret="+enr.Secret) {
+		t.Errorf("unexpected URI: %s", enr.URI)
+	}
+	if !bytes.HasPrefix(enr.QRCode, []byte("\x89PNG")) {
+		t.Error("expected a PNG QR code")
+	}
+
+	var stored string
+	_ = a.Conn.QueryRow(context.Background(), "SELECT secret FROM totp_secrets WHERE user_id = $1", "totp-user").Scan(&stored)
+	if stored == "" || strings.Contains(stored, enr.Secret) {
+		t.Error("secret must be stored encrypted")
+	}
+
+	now := time.Now()
+	code, _ := a.TOTPCode(enr.Secret, now)
+	if err := a.VerifyTOTP("totp-user", code); !errors.Is(err, auth.ErrTOTPNotEnrolled) {
+		t.Errorf("unconfirmed enrollment must not verify, got: %v", err)
+	}
+	if err := a.ConfirmTOTP("totp-user", code); err != nil {
+		t.Fatalf("ConfirmTOTP failed: %v", err)
+	}
+	if enabled, _ := a.TOTPEnabled("totp-user"); !enabled {
+		t.Error("expected TOTP to be enabled after confirming")
+	}
+	if err := a.VerifyTOTP("totp-user", code); !errors.Is(err, auth.ErrTOTPReplay) {
+		t.Errorf("expected ErrTOTPReplay for the confirmation code, got: %v", err)
+	}
+
+	next, _ := a.TOTPCode(enr.Secret, now.Add(30*time.Second))
+	if err := a.VerifyTOTP("totp-user", next); err != nil {
+		t.Errorf("next step should verify within the skew window: %v", err)
+	}
+	if err := a.VerifyTOTP("totp-user", "000000"); !errors.Is(err, auth.ErrInvalidTOTP) && !errors.Is(err, auth.ErrTOTPReplay) {
+		t.Errorf("expected ErrInvalidTOTP, got: %v", err)
+	}
+
+	if _, err := a.EnrollTOTP("totp-user"); !errors.Is(err, auth.ErrTOTPAlreadyEnrolled) {
+		t.Errorf("expected ErrTOTPAlreadyEnrolled, got: %v", err)
+	}
+	if err := a.DisableTOTP("totp-user"); err != nil {
+		t.Errorf("DisableTOTP failed: %v", err)
+	}
+	if enabled, _ := a.TOTPEnabled("totp-user"); enabled {
+		t.Error("expected TOTP to be disabled")
+	}
+}
+
+/*
+TestIntegrationTOTPLockout verifies that wrong codes in a row lock the user
+out, that an accepted code resets the count, and that the lockout expires.
+*/
+func TestIntegrationTOTPLockout(t *testing.T) {
+	skipIfShort(t)
+	a := setupTestAuth(t)
+	cfg := auth.TOTPConfig{EncryptionKey: testTOTPKey, Issuer: "Acme", Skew: 3, MaxAttempts: 3, Lockout: time.Second}
+	if err := a.TOTPInit(cfg); err != nil {
+		t.Fatalf("TOTPInit failed: %v", err)
+	}
+	_ = a.RegisterUser("totp-lockout", "password123")
+	enr, err := a.EnrollTOTP("totp-lockout")
+	if err != nil {
+		t.Fatalf("EnrollTOTP failed: %v", err)
+	}
+	now := time.Now()
+	code, _ := a.TOTPCode(enr.Secret, now)
+	if err := a.ConfirmTOTP("totp-lockout", code); err != nil {
+		t.Fatalf("ConfirmTOTP failed: %v", err)
+	}
+
+	wrong := func() {
+		t.Helper()
+		if err := a.VerifyTOTP("totp-lockout", "000000"); !errors.Is(err, auth.ErrInvalidTOTP) {
+			t.Fatalf("expected ErrInvalidTOTP, got: %v", err)
+		}
+	}
+
+	wrong()
+	wrong()
+	next, _ := a.TOTPCode(enr.Secret, now.Add(30*time.Second))
+	if err := a.VerifyTOTP("totp-lockout", next); err != nil {
+		t.Fatalf("right code before the limit should verify: %v", err)
+	}
+
+	/* The success reset the count, so it takes three more to lock */
+	wrong()
+	wrong()
+	wrong()
+	later, _ := a.TOTPCode(enr.Secret, now.Add(60*time.Second))
+	err = a.VerifyTOTP("totp-lockout", later)
+	var ra *auth.RetryAfterError
+	if !errors.As(err, &ra) || !errors.Is(err, auth.ErrTOTPLocked) {
+		t.Fatalf("expected ErrTOTPLocked, got: %v", err)
+	}
+	if ra.RetryAfter <= 0 || ra.RetryAfter > cfg.Lockout {
+		t.Errorf("expected a wait of up to %v, got %v", cfg.Lockout, ra.RetryAfter)
+	}
+
+	time.Sleep(cfg.Lockout + 100*time.Millisecond)
+	if err := a.VerifyTOTP("totp-lockout", later); err != nil {
+		t.Errorf("code should verify once the lockout is over: %v", err)
+	}
+}
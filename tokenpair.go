@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+TokenPair is the response returned by IssueTokenPair and RefreshTokenPair.
+Its JSON form matches the successful token response of RFC 6749 section 5.1,
+so handlers can encode it straight to the client.
+ExpiresIn is the access token lifetime in seconds.
+*/
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+}
+
+/*
+IssueTokenPair creates a new refresh token session for the user and an access
+token bound to it through the sid claim.
+JWTInit (or PASETOInit) and RefreshTokenInit must have been called.
+An optional SessionInfo records the device the user is logging in from.
+*/
+func (a *Auth) IssueTokenPair(userID string, info ...SessionInfo) (*TokenPair, error) {
+	if userID == "" {
+		return nil, ErrEmptyInput
+	}
+	if !a.canSignTokens() {
+		return nil, ErrNotInitialized
+	}
+
+	return a.issueSessionPair(newSessionSeed(userID, info))
+}
+
+/* issueSessionPair starts a refresh token session from seed and returns its first pair. */
+func (a *Auth) issueSessionPair(seed *RefreshToken) (*TokenPair, error) {
+	rt, err := a.generateRefreshToken(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.newTokenPair(rt)
+}
+
+/*
+RefreshTokenPair rotates the given refresh token and returns a fresh pair.
+The new access token carries the same session ID as the refresh token chain.
+*/
+func (a *Auth) RefreshTokenPair(refreshToken string) (*TokenPair, error) {
+	if refreshToken == "" {
+		return nil, ErrEmptyInput
+	}
+	/* Check before rotating, otherwise the old token is burned for nothing */
+	if !a.canSignTokens() {
+		return nil, ErrNotInitialized
+	}
+
+	rt, err := a.rotateRefreshToken(refreshToken, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return a.newTokenPair(rt)
+}
+
+/* newTokenPair mints the access token that accompanies the given refresh token. */
+func (a *Auth) newTokenPair(rt *RefreshToken) (*TokenPair, error) {
+	claims, err := a.newClaims(rt.UserID, a.jwtExpiry)
+	if err != nil {
+		return nil, err
+	}
+	claims.SessionID = rt.SessionID
+	if len(rt.AMR) > 0 {
+		/* The session was opened through Login, carry its assurance forward */
+		claims.AMR = rt.AMR
+		claims.ACR = rt.ACR
+		claims.AuthTime = jwt.NewNumericDate(rt.SessionStartedAt)
+	}
+
+	tokenType := "Bearer"
+	if rt.DPoPJKT != "" {
+		claims.Confirmation = &Confirmation{JKT: rt.DPoPJKT}
+		tokenType = "DPoP"
+	}
+
+	accessToken, err := a.signClaims(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate access token: %w", err)
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: rt.Token,
+		ExpiresIn:    int64(a.jwtExpiry.Seconds()),
+		TokenType:    tokenType,
+	}, nil
+}
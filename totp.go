@@ -0,0 +1,449 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/skip2/go-qrcode"
+)
+
+/*
+TOTPConfig configures authenticator app codes (RFC 6238).
+EncryptionKey is the 32-byte AES-256 key the per-user secrets are encrypted
+with at rest; keep it outside the database. Issuer is the name shown in the
+authenticator app. Digits is 6 (default) or 8, Period is the time step
+(default 30 seconds) and Skew is how many steps either side of the current
+one are accepted to allow for clock drift (default 1).
+The defaults are what every common authenticator app expects.
+MaxAttempts is how many wrong codes in a row lock a user's TOTP (default 5)
+and Lockout how long it then stays locked (default 15 minutes). Six digits
+are few enough to guess without this.
+*/
+type TOTPConfig struct {
+	EncryptionKey []byte
+	Issuer        string
+	Digits        int
+	Period        time.Duration
+	Skew          int
+	MaxAttempts   int
+	Lockout       time.Duration
+}
+
+/*
+TOTPEnrollment is what EnrollTOTP returns for the user to scan.
+Secret is the base32 secret for manual entry, URI the otpauth:// URI and
+QRCode a PNG of the URI, generated locally so the secret never leaves the server.
+*/
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+	QRCode []byte
+}
+
+const (
+	totpSecretSize = 20 /* 160 bits, as RFC 4226 recommends for HMAC-SHA1 */
+	totpQRSize     = 256
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/*
+TOTPInit enables authenticator app codes. Zero fields keep their defaults.
+Call it again with the same EncryptionKey to change the other settings;
+secrets stored under a different key can no longer be read.
+*/
+func (a *Auth) TOTPInit(cfg TOTPConfig) error {
+	if len(cfg.EncryptionKey) != 32 {
+		return fmt.Errorf("%w: totp encryption key must be 32 bytes", ErrInvalidInput)
+	}
+	if cfg.Issuer == "" {
+		return ErrEmptyInput
+	}
+	if cfg.Digits == 0 {
+		cfg.Digits = 6
+	}
+	if cfg.Digits != 6 && cfg.Digits != 8 {
+		return fmt.Errorf("%w: totp digits %d (must be 6 or 8)", ErrInvalidInput, cfg.Digits)
+	}
+	if cfg.Period == 0 {
+		cfg.Period = 30 * time.Second
+	}
+	if cfg.Period < time.Second || cfg.Period%time.Second != 0 {
+		return fmt.Errorf("%w: totp period %v (must be whole seconds)", ErrInvalidInput, cfg.Period)
+	}
+	if cfg.Skew == 0 {
+		cfg.Skew = 1
+	}
+	if cfg.Skew < 0 {
+		/* A negative skew means exactly the current step */
+		cfg.Skew = 0
+	}
+	if cfg.MaxAttempts < 0 || cfg.Lockout < 0 {
+		return fmt.Errorf("%w: totp attempts and lockout cannot be negative", ErrInvalidInput)
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Lockout == 0 {
+		cfg.Lockout = 15 * time.Minute
+	}
+
+	key := make([]byte, len(cfg.EncryptionKey))
+	copy(key, cfg.EncryptionKey)
+	cfg.EncryptionKey = key
+
+	a.totpCfg = &cfg
+	return nil
+}
+
+/*
+EnrollTOTP generates a new secret for the user and stores it, encrypted,
+as a pending enrollment. The user scans the returned QR code and then calls
+ConfirmTOTP with the first code their app shows. Enrolling again before
+confirming replaces the pending secret; once confirmed, the user must
+DisableTOTP first.
+*/
+func (a *Auth) EnrollTOTP(userID string) (*TOTPEnrollment, error) {
+	if userID == "" {
+		return nil, ErrEmptyInput
+	}
+	if a.totpCfg == nil {
+		return nil, ErrTOTPNotInitialized
+	}
+	if a.Conn == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(raw)
+
+	sealed, err := a.sealTOTPSecret(userID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := a.Conn.Exec(a.ctx, `
+		INSERT INTO totp_secrets (user_id, secret, confirmed, last_step, created_at)
+		VALUES ($1, $2, false, 0, NOW())
+		ON CONFLICT (user_id)
+		DO UPDATE SET secret = $2, last_step = 0, created_at = NOW(), failed_attempts = 0, locked_until = NULL
+		WHERE totp_secrets.confirmed = false
+	`, userID, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrTOTPAlreadyEnrolled
+	}
+
+	uri := a.totpURI(userID, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, totpQRSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render totp qr code: %w", err)
+	}
+
+	return &TOTPEnrollment{Secret: secret, URI: uri, QRCode: png}, nil
+}
+
+/*
+ConfirmTOTP finishes enrollment. It checks the code against the pending
+secret and, if it matches, turns TOTP on for the user. The code counts as
+used, so it cannot be replayed to VerifyTOTP.
+*/
+func (a *Auth) ConfirmTOTP(userID, code string) error {
+	return a.checkTOTP(userID, code, false)
+}
+
+/*
+VerifyTOTP checks a code from the user's authenticator app. Each code is
+accepted at most once: a code for a time step at or before the last accepted
+one returns ErrTOTPReplay, even within its validity window.
+After TOTPConfig.MaxAttempts rejected codes in a row the user is locked out
+for TOTPConfig.Lockout, and every call returns a *RetryAfterError wrapping
+ErrTOTPLocked, right code or not. An accepted code resets the count.
+*/
+func (a *Auth) VerifyTOTP(userID, code string) error {
+	return a.checkTOTP(userID, code, true)
+}
+
+/* TOTPEnabled reports whether the user has a confirmed authenticator app. */
+func (a *Auth) TOTPEnabled(userID string) (bool, error) {
+	if userID == "" {
+		return false, ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return false, ErrDatabaseUnavailable
+	}
+
+	var enabled bool
+	err := a.Conn.QueryRow(a.ctx,
+		"SELECT EXISTS(SELECT 1 FROM totp_secrets WHERE user_id = $1 AND confirmed = true)",
+		userID,
+	).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	return enabled, nil
+}
+
+/* DisableTOTP removes the user's secret, confirmed or pending. */
+func (a *Auth) DisableTOTP(userID string) error {
+	if userID == "" {
+		return ErrEmptyInput
+	}
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	tag, err := a.Conn.Exec(a.ctx, "DELETE FROM totp_secrets WHERE user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTOTPNotEnrolled
+	}
+	return nil
+}
+
+/*
+TOTPCode returns the code for a base32 secret at the given time, using the
+configured digits and period. It is meant for tests and tooling; servers
+should call VerifyTOTP.
+*/
+func (a *Auth) TOTPCode(secret string, at time.Time) (string, error) {
+	if a.totpCfg == nil {
+		return "", ErrTOTPNotInitialized
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, a.totpStep(at), a.totpCfg.Digits), nil
+}
+
+/*
+checkTOTP is the shared body of ConfirmTOTP and VerifyTOTP. confirmed selects
+which state the stored secret must be in. The matching step is written back
+with a conditional UPDATE, so two requests racing with the same code cannot
+both succeed. Like VerifyOTP, it counts the attempt before checking the
+code, so parallel guesses cannot get past MaxAttempts either; the attempt
+that reaches the limit sets the lockout up front and only lifts it if its
+code is accepted.
+*/
+func (a *Auth) checkTOTP(userID, code string, confirmed bool) error {
+	if userID == "" || code == "" {
+		return ErrEmptyInput
+	}
+	if a.totpCfg == nil {
+		return ErrTOTPNotInitialized
+	}
+	if a.Conn == nil {
+		return ErrDatabaseUnavailable
+	}
+
+	cfg := a.totpCfg
+
+	/* An expired lockout starts the count afresh */
+	var sealed string
+	var lastStep int64
+	err := a.Conn.QueryRow(a.ctx, `
+		UPDATE totp_secrets
+		SET failed_attempts = CASE WHEN locked_until IS NULL THEN failed_attempts + 1 ELSE 1 END,
+			locked_until = CASE
+				WHEN (CASE WHEN locked_until IS NULL THEN failed_attempts + 1 ELSE 1 END) >= $3
+				THEN NOW() + $4 * INTERVAL '1 millisecond'
+			END
+		WHERE user_id = $1 AND confirmed = $2 AND (locked_until IS NULL OR locked_until <= NOW())
+		RETURNING secret, last_step`,
+		userID, confirmed, cfg.MaxAttempts, cfg.Lockout.Milliseconds(),
+	).Scan(&sealed, &lastStep)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return a.totpLockedError(userID, confirmed)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+
+	secret, err := a.openTOTPSecret(userID, sealed)
+	if err != nil {
+		return err
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	step, ok := a.matchTOTP(key, code, time.Now())
+	if !ok {
+		return ErrInvalidTOTP
+	}
+	if step <= lastStep {
+		return ErrTOTPReplay
+	}
+
+	tag, err := a.Conn.Exec(a.ctx, `
+		UPDATE totp_secrets
+		SET last_step = $3, confirmed = true, confirmed_at = COALESCE(confirmed_at, NOW()),
+			failed_attempts = 0, locked_until = NULL
+		WHERE user_id = $1 AND confirmed = $2 AND last_step < $3
+	`, userID, confirmed, step)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTOTPReplay
+	}
+	return nil
+}
+
+/*
+totpLockedError tells a locked-out user apart from one with no secret, and
+reports how long the lockout has left.
+*/
+func (a *Auth) totpLockedError(userID string, confirmed bool) error {
+	var remaining float64
+	err := a.Conn.QueryRow(a.ctx,
+		"SELECT COALESCE(EXTRACT(EPOCH FROM locked_until - NOW()), 0)::float8 FROM totp_secrets WHERE user_id = $1 AND confirmed = $2",
+		userID, confirmed,
+	).Scan(&remaining)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	wait := max(time.Duration(remaining*float64(time.Second)), 0)
+	return &RetryAfterError{Err: ErrTOTPLocked, RetryAfter: wait}
+}
+
+/*
+matchTOTP looks for code within the skew window around now and returns the
+step it belongs to. Every candidate is compared, in constant time, so the
+response time does not reveal which step matched.
+*/
+func (a *Auth) matchTOTP(key []byte, code string, now time.Time) (int64, bool) {
+	cfg := a.totpCfg
+	if len(code) != cfg.Digits {
+		return 0, false
+	}
+
+	current := a.totpStep(now)
+	var matched int64
+	found := false
+	for i := -cfg.Skew; i <= cfg.Skew; i++ {
+		step := current + int64(i)
+		if step < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step, cfg.Digits)), []byte(code)) == 1 && !found {
+			matched, found = step, true
+		}
+	}
+	return matched, found
+}
+
+/* totpStep returns the RFC 6238 time step (T) for a moment. */
+func (a *Auth) totpStep(at time.Time) int64 {
+	return at.Unix() / int64(a.totpCfg.Period/time.Second)
+}
+
+/* hotp computes an RFC 4226 HMAC-SHA1 one-time password. */
+func hotp(key []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	/* Dynamic truncation (RFC 4226 section 5.3) */
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(math.Pow10(digits))
+	return fmt.Sprintf("%0*d", digits, bin%mod)
+}
+
+/* decodeTOTPSecret accepts a base32 secret with or without padding, any case. */
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	key, err := totpEncoding.DecodeString(s)
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("%w: totp secret is not valid base32", ErrInvalidInput)
+	}
+	return key, nil
+}
+
+/* totpURI builds the otpauth:// key URI understood by authenticator apps. */
+func (a *Auth) totpURI(userID, secret string) string {
+	cfg := a.totpCfg
+	label := url.PathEscape(cfg.Issuer + ":" + userID)
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", cfg.Issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(cfg.Digits))
+	q.Set("period", strconv.Itoa(int(cfg.Period/time.Second)))
+
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+/*
+sealTOTPSecret encrypts a secret with AES-256-GCM. The user ID is bound in as
+additional data, so a ciphertext copied to another user's row does not decrypt.
+*/
+func (a *Auth) sealTOTPSecret(userID, secret string) (string, error) {
+	gcm, err := a.totpCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return hex.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), []byte(userID))), nil
+}
+
+/* openTOTPSecret reverses sealTOTPSecret. */
+func (a *Auth) openTOTPSecret(userID, sealed string) (string, error) {
+	gcm, err := a.totpCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := hex.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("%w: stored totp secret is corrupt", ErrInvalidInput)
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(userID))
+	if err != nil {
+		return "", fmt.Errorf("%w: stored totp secret does not decrypt with this key", ErrInvalidInput)
+	}
+	return string(plain), nil
+}
+
+func (a *Auth) totpCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(a.totpCfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}